@@ -0,0 +1,19 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+func GetCharacter(characterID uint) (*Character, error) {
+	payload, err := ESI.GetCached(fmt.Sprintf(EveApiCharacterAPIUrl, characterID))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get character %d: %w", characterID, err)
+	}
+	character := Character{}
+	err = json.Unmarshal(payload, &character)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal character %d: %w", characterID, err)
+	}
+	return &character, nil
+}
@@ -0,0 +1,262 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultUserAgent = "CharName: Laszlo Bariani"
+const DefaultESITimeout = 30 * time.Second
+
+var ESI = NewESIClient(getEnv("ESI_USER_AGENT", DefaultUserAgent), getEnvDuration("ESI_TIMEOUT", DefaultESITimeout))
+
+type ESIClient struct {
+	HTTPClient *http.Client
+	UserAgent  string
+	MaxRetries int
+	Backoff    time.Duration
+	// Requests are held back once fewer errors than this remain in the ESI error budget
+	MinErrorRemain int
+	// Responses kept for conditional requests, the least recently used are dropped first
+	MaxCacheEntries int
+
+	lock        sync.Mutex
+	random      *rand.Rand
+	errorRemain int
+	errorReset  time.Time
+	cache       map[string]esiCacheEntry
+}
+
+type esiCacheEntry struct {
+	etag    string
+	expires time.Time
+	body    []byte
+	used    time.Time
+}
+
+func NewESIClient(userAgent string, timeout time.Duration) *ESIClient {
+	return &ESIClient{
+		HTTPClient:      &http.Client{Timeout: timeout},
+		UserAgent:       userAgent,
+		MaxRetries:      5,
+		Backoff:         time.Second,
+		MinErrorRemain:  10,
+		MaxCacheEntries: 1000,
+		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		errorRemain:     -1,
+		cache:           make(map[string]esiCacheEntry),
+	}
+}
+
+func (c *ESIClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		c.waitErrorBudget()
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("unable to rewind request body: %w", err)
+			}
+			req.Body = body
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			lastErr = err
+			if attempt >= c.MaxRetries {
+				return nil, fmt.Errorf("giving up on %s after %d attempts: %w", req.URL, attempt+1, lastErr)
+			}
+			time.Sleep(c.backoff(attempt))
+			continue
+		}
+		c.updateErrorBudget(resp.Header)
+		wait, retry := c.retryDelay(resp, attempt)
+		if !retry || attempt >= c.MaxRetries {
+			return resp, nil
+		}
+		fmt.Printf("ESI returned %s for %s, retrying in %s.\n", resp.Status, req.URL, wait)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		time.Sleep(wait)
+	}
+}
+
+func (c *ESIClient) GetCached(url string) ([]byte, error) {
+	entry, ok := c.getCacheEntry(url)
+	if ok && time.Now().Before(entry.expires) {
+		return entry.body, nil
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	if ok && entry.etag != "" {
+		req.Header.Add("If-None-Match", entry.etag)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && ok {
+		entry.expires = getExpires(resp.Header)
+		c.setCacheEntry(url, entry)
+		return entry.body, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid Status Code: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	etag := resp.Header.Get("ETag")
+	expires := getExpires(resp.Header)
+	if etag != "" || time.Now().Before(expires) {
+		c.setCacheEntry(url, esiCacheEntry{etag: etag, expires: expires, body: body})
+	}
+	return body, nil
+}
+
+// An expired entry without ETag cannot be revalidated and is dropped
+func (c *ESIClient) getCacheEntry(url string) (esiCacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.cache[url]
+	if !ok {
+		return entry, false
+	}
+	if entry.etag == "" && !time.Now().Before(entry.expires) {
+		delete(c.cache, url)
+		return esiCacheEntry{}, false
+	}
+	entry.used = time.Now()
+	c.cache[url] = entry
+	return entry, true
+}
+
+func (c *ESIClient) setCacheEntry(url string, entry esiCacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	entry.used = now
+	if _, ok := c.cache[url]; !ok && len(c.cache) >= c.MaxCacheEntries {
+		for key, cached := range c.cache {
+			if cached.etag == "" && !now.Before(cached.expires) {
+				delete(c.cache, key)
+			}
+		}
+		for len(c.cache) >= c.MaxCacheEntries && len(c.cache) > 0 {
+			oldest := ""
+			for key, cached := range c.cache {
+				if oldest == "" || cached.used.Before(c.cache[oldest].used) {
+					oldest = key
+				}
+			}
+			delete(c.cache, oldest)
+		}
+	}
+	c.cache[url] = entry
+}
+
+func (c *ESIClient) retryDelay(resp *http.Response, attempt int) (time.Duration, bool) {
+	switch {
+	case resp.StatusCode == 420:
+		c.lock.Lock()
+		wait := time.Until(c.errorReset)
+		c.lock.Unlock()
+		if wait <= 0 {
+			wait = c.backoff(attempt)
+		}
+		return wait, true
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		if wait, ok := getRetryAfter(resp.Header); ok {
+			return wait, true
+		}
+		return c.backoff(attempt), true
+	case resp.StatusCode >= 500:
+		return c.backoff(attempt), true
+	}
+	return 0, false
+}
+
+func (c *ESIClient) backoff(attempt int) time.Duration {
+	c.lock.Lock()
+	jitter := time.Duration(c.random.Int63n(int64(c.Backoff)))
+	c.lock.Unlock()
+	return c.Backoff*time.Duration(1<<uint(attempt)) + jitter
+}
+
+func (c *ESIClient) updateErrorBudget(header http.Header) {
+	remain, err := strconv.Atoi(header.Get("X-ESI-Error-Limit-Remain"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.Atoi(header.Get("X-ESI-Error-Limit-Reset"))
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	c.errorRemain = remain
+	c.errorReset = time.Now().Add(time.Duration(reset) * time.Second)
+	c.lock.Unlock()
+}
+
+func (c *ESIClient) waitErrorBudget() {
+	c.lock.Lock()
+	remain := c.errorRemain
+	wait := time.Until(c.errorReset)
+	c.lock.Unlock()
+	if remain < 0 || remain >= c.MinErrorRemain || wait <= 0 {
+		return
+	}
+	fmt.Printf("ESI error budget low (%d left), waiting %s for reset.\n", remain, wait)
+	time.Sleep(wait)
+}
+
+func getRetryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+func getExpires(header http.Header) time.Time {
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return time.Time{}
+	}
+	return expires
+}
+
+func getEnv(name string, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubESI answers the requests with the given handlers in turn, the last one
+// answers all the following requests
+type stubESI struct {
+	lock     sync.Mutex
+	handlers []http.HandlerFunc
+	requests []*http.Request
+	bodies   []string
+}
+
+func (s *stubESI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.lock.Lock()
+	n := len(s.requests)
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, string(body))
+	s.lock.Unlock()
+	if n >= len(s.handlers) {
+		n = len(s.handlers) - 1
+	}
+	s.handlers[n](w, r)
+}
+
+func (s *stubESI) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.requests)
+}
+
+func status(code int, header map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range header {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			w.Write([]byte(`{"ok":true}`))
+		}
+	}
+}
+
+func newTestClient(t *testing.T, stub *stubESI) (*ESIClient, string) {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	client := NewESIClient("test", 5*time.Second)
+	client.Backoff = 10 * time.Millisecond
+	client.MaxRetries = 3
+	return client, server.URL
+}
+
+func TestDoRetriesServerErrors(t *testing.T) {
+	stub := &stubESI{handlers: []http.HandlerFunc{status(502, nil), status(500, nil), status(200, nil)}}
+	client, url := newTestClient(t, stub)
+	req, _ := http.NewRequest("POST", url, strings.NewReader("[1,2]"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want 200", resp.StatusCode)
+	}
+	if stub.count() != 3 {
+		t.Errorf("%d requests, want 3", stub.count())
+	}
+	for i, body := range stub.bodies {
+		if body != "[1,2]" {
+			t.Errorf("attempt %d sent body %q", i+1, body)
+		}
+	}
+	if agent := stub.requests[0].Header.Get("User-Agent"); agent != "test" {
+		t.Errorf("User-Agent %q, want test", agent)
+	}
+}
+
+func TestDoGivesUp(t *testing.T) {
+	stub := &stubESI{handlers: []http.HandlerFunc{status(500, nil)}}
+	client, url := newTestClient(t, stub)
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 500 {
+		t.Errorf("status %d, want 500", resp.StatusCode)
+	}
+	if stub.count() != client.MaxRetries+1 {
+		t.Errorf("%d requests, want %d", stub.count(), client.MaxRetries+1)
+	}
+}
+
+func TestDoDoesNotRetryClientErrors(t *testing.T) {
+	stub := &stubESI{handlers: []http.HandlerFunc{status(404, nil)}}
+	client, url := newTestClient(t, stub)
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if stub.count() != 1 {
+		t.Errorf("%d requests, want 1", stub.count())
+	}
+}
+
+func TestDoHonoursRetryAfter(t *testing.T) {
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		stub := &stubESI{handlers: []http.HandlerFunc{status(code, map[string]string{"Retry-After": "1"}), status(200, nil)}}
+		client, url := newTestClient(t, stub)
+		req, _ := http.NewRequest("GET", url, nil)
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Errorf("%d: retried after %s, want Retry-After of 1s", code, elapsed)
+		}
+		if stub.count() != 2 {
+			t.Errorf("%d: %d requests, want 2", code, stub.count())
+		}
+	}
+}
+
+func TestDoWaitsForErrorLimitReset(t *testing.T) {
+	limited := map[string]string{"X-ESI-Error-Limit-Remain": "0", "X-ESI-Error-Limit-Reset": "1"}
+	stub := &stubESI{handlers: []http.HandlerFunc{status(420, limited), status(200, nil)}}
+	client, url := newTestClient(t, stub)
+	req, _ := http.NewRequest("GET", url, nil)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("retried after %s, want the 1s error limit reset", elapsed)
+	}
+	if stub.count() != 2 {
+		t.Errorf("%d requests, want 2", stub.count())
+	}
+}
+
+func TestDoHoldsBackOnLowErrorBudget(t *testing.T) {
+	low := map[string]string{"X-ESI-Error-Limit-Remain": "5", "X-ESI-Error-Limit-Reset": "1"}
+	stub := &stubESI{handlers: []http.HandlerFunc{status(404, low), status(200, nil)}}
+	client, url := newTestClient(t, stub)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", url, nil)
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		elapsed := time.Since(start)
+		if i == 0 && elapsed > 500*time.Millisecond {
+			t.Errorf("first request waited %s", elapsed)
+		}
+		if i == 1 && elapsed < 900*time.Millisecond {
+			t.Errorf("request sent after %s with 5 errors left, want a wait for the reset", elapsed)
+		}
+	}
+}
+
+func TestGetCachedRevalidatesWithETag(t *testing.T) {
+	stub := &stubESI{handlers: []http.HandlerFunc{
+		status(200, map[string]string{"ETag": `"v1"`}),
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotModified)
+		},
+	}}
+	client, url := newTestClient(t, stub)
+	for i := 0; i < 2; i++ {
+		body, err := client.GetCached(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `{"ok":true}` {
+			t.Errorf("call %d returned %q", i+1, body)
+		}
+	}
+	if stub.count() != 2 {
+		t.Fatalf("%d requests, want 2", stub.count())
+	}
+	if match := stub.requests[0].Header.Get("If-None-Match"); match != "" {
+		t.Errorf("first request sent If-None-Match %q", match)
+	}
+	if match := stub.requests[1].Header.Get("If-None-Match"); match != `"v1"` {
+		t.Errorf("second request sent If-None-Match %q, want \"v1\"", match)
+	}
+}
+
+func TestGetCachedUntilExpires(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	stub := &stubESI{handlers: []http.HandlerFunc{status(200, map[string]string{"Expires": expires})}}
+	client, url := newTestClient(t, stub)
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetCached(url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.count() != 1 {
+		t.Errorf("%d requests, want 1 before Expires", stub.count())
+	}
+}
+
+func TestGetCachedSkipsExpiredResponses(t *testing.T) {
+	expired := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	stub := &stubESI{handlers: []http.HandlerFunc{status(200, map[string]string{"Expires": expired})}}
+	client, url := newTestClient(t, stub)
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetCached(url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.count() != 2 {
+		t.Errorf("%d requests, want 2", stub.count())
+	}
+	if match := stub.requests[1].Header.Get("If-None-Match"); match != "" {
+		t.Errorf("uncached request sent If-None-Match %q", match)
+	}
+}
+
+func TestGetCachedDropsLeastRecentlyUsed(t *testing.T) {
+	stub := &stubESI{handlers: []http.HandlerFunc{status(200, map[string]string{"ETag": `"v1"`})}}
+	client, url := newTestClient(t, stub)
+	client.MaxCacheEntries = 2
+	for _, path := range []string{"/a", "/b", "/a", "/c"} {
+		if _, err := client.GetCached(url + path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.cache) != 2 {
+		t.Fatalf("%d cached responses, want 2", len(client.cache))
+	}
+	if _, ok := client.cache[url+"/b"]; ok {
+		t.Error("the least recently used response was kept")
+	}
+	if _, ok := client.cache[url+"/a"]; !ok {
+		t.Error("a response used again was dropped")
+	}
+}
+
+func TestGetCachedDropsExpiredEntriesWithoutETag(t *testing.T) {
+	stub := &stubESI{handlers: []http.HandlerFunc{status(200, nil)}}
+	client, url := newTestClient(t, stub)
+	client.MaxCacheEntries = 2
+	client.cache[url+"/expired"] = esiCacheEntry{expires: time.Now().Add(-time.Minute), used: time.Now()}
+	client.cache[url+"/etag"] = esiCacheEntry{etag: `"v1"`, expires: time.Now().Add(-time.Minute)}
+	expires := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	stub.handlers = []http.HandlerFunc{status(200, map[string]string{"Expires": expires})}
+	if _, err := client.GetCached(url + "/new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.cache[url+"/expired"]; ok {
+		t.Error("an expired response without ETag was kept over an older one with ETag")
+	}
+	if _, ok := client.cache[url+"/etag"]; !ok {
+		t.Error("a response which can be revalidated was dropped")
+	}
+
+	if _, ok := client.getCacheEntry(url + "/etag"); !ok {
+		t.Error("an expired response with ETag cannot be revalidated")
+	}
+	client.cache[url+"/expired"] = esiCacheEntry{expires: time.Now().Add(-time.Minute)}
+	if _, ok := client.getCacheEntry(url + "/expired"); ok || len(client.cache) != 2 {
+		t.Errorf("expired response without ETag used, %d cached responses", len(client.cache))
+	}
+}
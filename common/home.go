@@ -0,0 +1,116 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	StatusKill     = "kill"
+	StatusLoss     = "loss"
+	StatusInvolved = "involved"
+)
+
+// HomeEntities are the characters, corporations and alliances killmails are
+// classified for.
+type HomeEntities struct {
+	Characters   map[uint]bool
+	Corporations map[uint]bool
+	Alliances    map[uint]bool
+}
+
+func NewHomeEntities(characters []uint, corporations []uint, alliances []uint) *HomeEntities {
+	h := &HomeEntities{
+		Characters:   make(map[uint]bool),
+		Corporations: make(map[uint]bool),
+		Alliances:    make(map[uint]bool),
+	}
+	for _, ID := range characters {
+		h.Characters[ID] = true
+	}
+	for _, ID := range corporations {
+		h.Corporations[ID] = true
+	}
+	for _, ID := range alliances {
+		h.Alliances[ID] = true
+	}
+	return h
+}
+
+// GetTokensHomeEntities uses the corporations of the registered corporation
+// tokens, or their character for personal tokens.
+func GetTokensHomeEntities(db *gorm.DB) (*HomeEntities, error) {
+	tokens, err := GetActiveTokens(db)
+	if err != nil {
+		return nil, err
+	}
+	characters := []uint{}
+	corporations := []uint{}
+	for _, token := range *tokens {
+		if token.ReadsCorporationKillmails() {
+			corporations = append(corporations, token.CorpID)
+		} else if token.CharID != 0 {
+			characters = append(characters, token.CharID)
+		}
+	}
+	return NewHomeEntities(characters, corporations, nil), nil
+}
+
+func (t *Tenant) HomeEntities() *HomeEntities {
+	return NewHomeEntities(nil, []uint{t.ID}, nil)
+}
+
+func ParseIDs(value string) ([]uint, error) {
+	res := []uint{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		ID, err := strconv.ParseUint(field, 10, 64)
+		if err != nil || ID == 0 {
+			return nil, fmt.Errorf("invalid ID %q", field)
+		}
+		res = append(res, uint(ID))
+	}
+	return res, nil
+}
+
+func (h *HomeEntities) Empty() bool {
+	return len(h.Characters) == 0 && len(h.Corporations) == 0 && len(h.Alliances) == 0
+}
+
+func (h *HomeEntities) Matches(characterID uint, corporationID uint, allianceID uint) bool {
+	return h.Characters[characterID] || h.Corporations[corporationID] || h.Alliances[allianceID]
+}
+
+// Classify uses the affiliations recorded on the killmail, which are the ones
+// at the time of the kill.
+func (h *HomeEntities) Classify(km *Killmail) string {
+	if km.Victim != nil && h.Matches(km.Victim.CharacterID, km.Victim.CorporationID, km.Victim.AllianceID) {
+		return StatusLoss
+	}
+	if km.Attackers != nil {
+		for _, attacker := range *km.Attackers {
+			if h.Matches(attacker.CharacterID, attacker.CorporationID, attacker.AllianceID) {
+				return StatusKill
+			}
+		}
+	}
+	return StatusInvolved
+}
+
+func (h *HomeEntities) IDs() ([]uint, []uint, []uint) {
+	return mapKeys(h.Characters), mapKeys(h.Corporations), mapKeys(h.Alliances)
+}
+
+func mapKeys(m map[uint]bool) []uint {
+	res := []uint{}
+	for key := range m {
+		res = append(res, key)
+	}
+	return res
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+const (
+	testCharacterID   = 2112000001
+	testCorporationID = 98000001
+	testAllianceID    = 99000001
+	otherCorporation  = 98000002
+)
+
+func newHomeTestKillmail(victimCorporationID uint, attackerCorporationIDs ...uint) *Killmail {
+	attackers := []Attacker{}
+	for i, corporationID := range attackerCorporationIDs {
+		attackers = append(attackers, Attacker{CharacterID: 2113000001 + uint(i), CorporationID: corporationID})
+	}
+	return &Killmail{
+		Victim:    &Victim{CharacterID: testCharacterID, CorporationID: victimCorporationID},
+		Attackers: &attackers,
+	}
+}
+
+func TestHomeEntitiesMatches(t *testing.T) {
+	home := NewHomeEntities([]uint{testCharacterID}, []uint{testCorporationID}, []uint{testAllianceID})
+	tests := []struct {
+		character   uint
+		corporation uint
+		alliance    uint
+		want        bool
+	}{
+		{testCharacterID, otherCorporation, 0, true},
+		{2112000002, testCorporationID, 0, true},
+		{2112000002, otherCorporation, testAllianceID, true},
+		{2112000002, otherCorporation, 99000002, false},
+		// NPC attackers carry no character nor alliance
+		{0, 1000125, 0, false},
+	}
+	for _, test := range tests {
+		if got := home.Matches(test.character, test.corporation, test.alliance); got != test.want {
+			t.Errorf("Matches(%d, %d, %d) = %t, want %t", test.character, test.corporation, test.alliance, got, test.want)
+		}
+	}
+	if !NewHomeEntities(nil, nil, nil).Empty() || home.Empty() {
+		t.Error("Empty does not tell home entities apart")
+	}
+	if NewHomeEntities(nil, nil, nil).Matches(0, 0, 0) {
+		t.Error("empty home entities match missing IDs")
+	}
+}
+
+// A pilot leaving the home corporation: the killmails keep the corporation at
+// the time of the kill
+func TestHomeEntitiesClassifyCorporationChange(t *testing.T) {
+	corporation := NewHomeEntities(nil, []uint{testCorporationID}, nil)
+	character := NewHomeEntities([]uint{testCharacterID}, nil, nil)
+	tests := []struct {
+		name string
+		km   *Killmail
+		home *HomeEntities
+		want string
+	}{
+		{"loss before leaving", newHomeTestKillmail(testCorporationID, otherCorporation), corporation, StatusLoss},
+		{"loss after leaving", newHomeTestKillmail(otherCorporation, 98000003), corporation, StatusInvolved},
+		{"killed by the new corporation", newHomeTestKillmail(testCorporationID, otherCorporation), NewHomeEntities(nil, []uint{otherCorporation}, nil), StatusKill},
+		{"personal token follows the character", newHomeTestKillmail(otherCorporation, 98000003), character, StatusLoss},
+		{"kill on another home attacker", newHomeTestKillmail(otherCorporation, 98000003, testCorporationID), corporation, StatusKill},
+		{"home on both sides", newHomeTestKillmail(testCorporationID, testCorporationID), corporation, StatusLoss},
+		{"no home entity", newHomeTestKillmail(otherCorporation, 98000003), NewHomeEntities(nil, nil, nil), StatusInvolved},
+		{"without victim nor attackers", &Killmail{}, corporation, StatusInvolved},
+	}
+	for _, test := range tests {
+		if got := test.home.Classify(test.km); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"", "[]", false},
+		{"98000001, 98000002,", "[98000001 98000002]", false},
+		{"98000001,0", "", true},
+		{"98000001,corp", "", true},
+	}
+	for _, test := range tests {
+		IDs, err := ParseIDs(test.value)
+		if (err != nil) != test.err || (!test.err && fmt.Sprint(IDs) != test.want) {
+			t.Errorf("ParseIDs(%q) = %v, %v", test.value, IDs, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+const jwksExpiry = 12 * time.Hour
+
+// An unknown kid fetches the keys again, at most this often
+const jwksMinRefresh = time.Minute
+
+// SSO keys endpoint, overridable to stand in a local JWKS server
+var JWKSUrl = getEnv("SSO_JWKS_URL", EveApiJWKUrl)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+var ssoKeys = &jwksCache{}
+
+// jwksCache keeps the SSO signing keys. CCP rotates them, so keys are fetched
+// again when they expire or when a token is signed with an unknown one.
+type jwksCache struct {
+	lock    sync.Mutex
+	keys    jose.JSONWebKeySet
+	fetched time.Time
+	// Closed when the fetch in progress is done
+	fetching chan struct{}
+}
+
+func (c *jwksCache) get(kid string) (jose.JSONWebKey, error) {
+	c.lock.Lock()
+	key, found := c.find(kid)
+	stale := time.Since(c.fetched) > jwksExpiry
+	// Lookups needing the keys wait for the fetch in progress instead of
+	// fetching them again, the lock is not held during the fetch
+	for c.fetching != nil && (!found || stale) {
+		fetching := c.fetching
+		c.lock.Unlock()
+		<-fetching
+		c.lock.Lock()
+		key, found = c.find(kid)
+		stale = time.Since(c.fetched) > jwksExpiry
+	}
+	if found && !stale {
+		c.lock.Unlock()
+		return key, nil
+	}
+	if !found && !stale && time.Since(c.fetched) < jwksMinRefresh {
+		c.lock.Unlock()
+		return key, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	c.fetching = make(chan struct{})
+	c.lock.Unlock()
+	keys, err := fetchJWKS(JWKSUrl)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	close(c.fetching)
+	c.fetching = nil
+	if err != nil {
+		// Keys rarely change, the previous ones are better than none
+		if found {
+			fmt.Println("ERROR: keeping previous SSO keys:", err)
+			return key, nil
+		}
+		return key, err
+	}
+	c.keys = *keys
+	c.fetched = time.Now()
+	key, found = c.find(kid)
+	if !found {
+		return key, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return key, nil
+}
+
+// Tokens without kid can only be checked against a single key
+func (c *jwksCache) find(kid string) (jose.JSONWebKey, bool) {
+	if kid == "" {
+		if len(c.keys.Keys) == 1 {
+			return c.keys.Keys[0], true
+		}
+		return jose.JSONWebKey{}, false
+	}
+	keys := c.keys.Key(kid)
+	if len(keys) == 0 {
+		return jose.JSONWebKey{}, false
+	}
+	return keys[0], true
+}
+
+func fetchJWKS(url string) (*jose.JSONWebKeySet, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ESI.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get SSO keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get SSO keys: invalid Status Code: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	keys := jose.JSONWebKeySet{}
+	err = json.Unmarshal(body, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal SSO keys: %w", err)
+	}
+	return &keys, nil
+}
@@ -0,0 +1,320 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose"
+)
+
+const testClientID = "client"
+
+// stubJWKS serves the public keys of the signing keys, or fails with the
+// given status
+type stubJWKS struct {
+	lock    sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	status  int
+	fetches int
+	// When set, requests are announced on requested and wait for release
+	requested chan struct{}
+	release   chan struct{}
+}
+
+func (s *stubJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.release != nil {
+		s.requested <- struct{}{}
+		<-s.release
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fetches++
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	set := jose.JSONWebKeySet{}
+	for kid, key := range s.keys {
+		set.Keys = append(set.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: "RS256", Use: "sig"})
+	}
+	json.NewEncoder(w).Encode(set)
+}
+
+func (s *stubJWKS) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys[kid] = key
+	return key
+}
+
+func (s *stubJWKS) setStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+func (s *stubJWKS) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.fetches
+}
+
+// useTestJWKS points the SSO keys to a stub, with an empty cache
+func useTestJWKS(t *testing.T) *stubJWKS {
+	stub := &stubJWKS{keys: make(map[string]*rsa.PrivateKey)}
+	server := httptest.NewServer(stub)
+	url, keys := JWKSUrl, ssoKeys
+	JWKSUrl, ssoKeys = server.URL, &jwksCache{}
+	t.Cleanup(func() {
+		server.Close()
+		JWKSUrl, ssoKeys = url, keys
+	})
+	return stub
+}
+
+// setFetched ages the cached keys
+func setFetched(at time.Time) {
+	ssoKeys.lock.Lock()
+	defer ssoKeys.lock.Unlock()
+	ssoKeys.fetched = at
+}
+
+func newTestPayload() map[string]interface{} {
+	return map[string]interface{}{
+		"scp":   []string{"esi-killmails.read_killmails.v1"},
+		"sub":   "CHARACTER:EVE:2112000001",
+		"name":  "Test Pilot",
+		"owner": "owner-hash",
+		"exp":   time.Now().Add(20 * time.Minute).Unix(),
+		"iss":   "https://login.eveonline.com",
+		"aud":   []string{testClientID, ssoAudience},
+	}
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, payload map[string]interface{}) string {
+	opts := &jose.SignerOptions{}
+	if kid != "" {
+		opts = opts.WithHeader("kid", kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := signer.Sign(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := object.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestGetTokenPayloadSelectsKeyByKid(t *testing.T) {
+	stub := useTestJWKS(t)
+	first := stub.addKey(t, "JWT-Signature-Key-1")
+	second := stub.addKey(t, "JWT-Signature-Key-2")
+
+	payload, err := GetTokenPayload(signTestToken(t, second, "JWT-Signature-Key-2", newTestPayload()), testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Name != "Test Pilot" || payload.Owner != "owner-hash" {
+		t.Errorf("payload %+v", payload)
+	}
+	if charID, err := payload.CharacterID(); err != nil || charID != 2112000001 {
+		t.Errorf("character %d, %v", charID, err)
+	}
+	_, err = GetTokenPayload(signTestToken(t, first, "JWT-Signature-Key-2", newTestPayload()), testClientID)
+	if err == nil {
+		t.Error("a token signed with another key than its kid was accepted")
+	}
+	// Without kid, the key cannot be chosen among several
+	_, err = GetTokenPayload(signTestToken(t, first, "", newTestPayload()), testClientID)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token without kid: got %v, want %v", err, ErrUnknownKey)
+	}
+	if stub.count() != 1 {
+		t.Errorf("%d fetches, want the keys fetched once", stub.count())
+	}
+}
+
+func TestGetTokenPayloadRefetchesUnknownKid(t *testing.T) {
+	stub := useTestJWKS(t)
+	first := stub.addKey(t, "JWT-Signature-Key-1")
+	if _, err := GetTokenPayload(signTestToken(t, first, "JWT-Signature-Key-1", newTestPayload()), testClientID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated keys are only fetched again once jwksMinRefresh has passed
+	rotated := stub.addKey(t, "JWT-Signature-Key-2")
+	token := signTestToken(t, rotated, "JWT-Signature-Key-2", newTestPayload())
+	for i := 0; i < 3; i++ {
+		if _, err := GetTokenPayload(token, testClientID); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("got %v, want %v", err, ErrUnknownKey)
+		}
+	}
+	if stub.count() != 1 {
+		t.Errorf("%d fetches within jwksMinRefresh, want 1", stub.count())
+	}
+	setFetched(time.Now().Add(-jwksMinRefresh - time.Second))
+	if _, err := GetTokenPayload(token, testClientID); err != nil {
+		t.Fatal(err)
+	}
+	if stub.count() != 2 {
+		t.Errorf("%d fetches, want 2", stub.count())
+	}
+}
+
+func TestGetTokenPayloadRefetchesExpiredKeys(t *testing.T) {
+	stub := useTestJWKS(t)
+	key := stub.addKey(t, "JWT-Signature-Key-1")
+	token := signTestToken(t, key, "JWT-Signature-Key-1", newTestPayload())
+	for i := 0; i < 2; i++ {
+		if _, err := GetTokenPayload(token, testClientID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.count() != 1 {
+		t.Errorf("%d fetches, want the keys cached", stub.count())
+	}
+
+	// A key removed from the set is no longer trusted once the keys expire
+	stub.lock.Lock()
+	delete(stub.keys, "JWT-Signature-Key-1")
+	stub.lock.Unlock()
+	setFetched(time.Now().Add(-jwksExpiry + time.Minute))
+	if _, err := GetTokenPayload(token, testClientID); err != nil {
+		t.Fatalf("keys not expired yet: %s", err)
+	}
+	setFetched(time.Now().Add(-jwksExpiry - time.Second))
+	if _, err := GetTokenPayload(token, testClientID); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v, want %v", err, ErrUnknownKey)
+	}
+	if stub.count() != 2 {
+		t.Errorf("%d fetches, want 2", stub.count())
+	}
+}
+
+func TestGetTokenPayloadKeepsKeysOnFetchError(t *testing.T) {
+	stub := useTestJWKS(t)
+	key := stub.addKey(t, "JWT-Signature-Key-1")
+	token := signTestToken(t, key, "JWT-Signature-Key-1", newTestPayload())
+	if _, err := GetTokenPayload(token, testClientID); err != nil {
+		t.Fatal(err)
+	}
+
+	stub.setStatus(http.StatusNotFound)
+	setFetched(time.Now().Add(-jwksExpiry - time.Second))
+	if _, err := GetTokenPayload(token, testClientID); err != nil {
+		t.Errorf("previous keys not used: %s", err)
+	}
+	if stub.count() != 2 {
+		t.Errorf("%d fetches, want 2", stub.count())
+	}
+	unknown := stub.addKey(t, "JWT-Signature-Key-2")
+	_, err := GetTokenPayload(signTestToken(t, unknown, "JWT-Signature-Key-2", newTestPayload()), testClientID)
+	if err == nil || !strings.Contains(err.Error(), "unable to get SSO keys") {
+		t.Errorf("unknown key without SSO keys: got %v", err)
+	}
+}
+
+func TestGetTokenPayloadValidatesClaims(t *testing.T) {
+	stub := useTestJWKS(t)
+	key := stub.addKey(t, "JWT-Signature-Key-1")
+	tests := []struct {
+		name  string
+		claim string
+		value interface{}
+		err   string
+	}{
+		{"valid", "", nil, ""},
+		{"issuer without scheme", "iss", "login.eveonline.com", ""},
+		{"other issuer", "iss", "https://login.example.com", "invalid token issuer"},
+		{"single audience", "aud", ssoAudience, "invalid token audience"},
+		{"other client", "aud", []string{"other", ssoAudience}, "invalid token audience"},
+		{"not for EVE Online", "aud", []string{testClientID}, "invalid token audience"},
+		{"expired within leeway", "exp", time.Now().Add(-tokenLeeway / 2).Unix(), ""},
+		{"expired", "exp", time.Now().Add(-tokenLeeway - time.Minute).Unix(), "token expired"},
+	}
+	for _, test := range tests {
+		payload := newTestPayload()
+		if test.claim != "" {
+			payload[test.claim] = test.value
+		}
+		_, err := GetTokenPayload(signTestToken(t, key, "JWT-Signature-Key-1", payload), testClientID)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestJWKSCacheFetchesWithoutBlockingLookups(t *testing.T) {
+	stub := useTestJWKS(t)
+	stub.addKey(t, "JWT-Signature-Key-1")
+	if _, err := ssoKeys.get("JWT-Signature-Key-1"); err != nil {
+		t.Fatal(err)
+	}
+	stub.addKey(t, "JWT-Signature-Key-2")
+	setFetched(time.Now().Add(-2 * jwksMinRefresh))
+	stub.requested = make(chan struct{}, 2)
+	stub.release = make(chan struct{})
+
+	errs := make(chan error, 2)
+	lookup := func() {
+		_, err := ssoKeys.get("JWT-Signature-Key-2")
+		errs <- err
+	}
+	go lookup()
+	select {
+	case <-stub.requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotated keys not fetched")
+	}
+	// Known keys are served while the keys are fetched
+	done := make(chan error)
+	go func() {
+		_, err := ssoKeys.get("JWT-Signature-Key-1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("known key: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("known key lookup blocked by the fetch")
+	}
+	// A second lookup of the new key waits for the fetch in progress
+	go lookup()
+	time.Sleep(50 * time.Millisecond)
+	close(stub.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("rotated key: %s", err)
+		}
+	}
+	if stub.count() != 2 {
+		t.Errorf("%d fetches, want 2", stub.count())
+	}
+}
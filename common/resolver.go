@@ -0,0 +1,152 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	CategoryAlliance      = "alliance"
+	CategoryCharacter     = "character"
+	CategoryConstellation = "constellation"
+	CategoryCorporation   = "corporation"
+	CategoryFaction       = "faction"
+	CategoryInventoryType = "inventory_type"
+	CategoryRegion        = "region"
+	CategorySolarSystem   = "solar_system"
+	CategoryStation       = "station"
+	// IDs ESI cannot resolve, kept to not ask for them again before RetryAfter
+	CategoryUnknown = "unknown"
+)
+
+type Name struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+}
+
+// ImageType returns the image server type for the category, or "" when the
+// category has no image.
+func (n Name) ImageType() string {
+	switch n.Category {
+	case CategoryAlliance:
+		return "alliances"
+	case CategoryCharacter:
+		return "characters"
+	case CategoryCorporation:
+		return "corporations"
+	case CategoryInventoryType:
+		return "icons"
+	}
+	return ""
+}
+
+type Resolver struct {
+	byID       map[uint]Name
+	byCategory map[string][]Name
+	byName     map[string][]Name
+	history    map[uint][]NameHistory
+}
+
+func NewResolver(mappings []Mapping) *Resolver {
+	r := &Resolver{
+		byID:       make(map[uint]Name),
+		byCategory: make(map[string][]Name),
+		byName:     make(map[string][]Name),
+		history:    make(map[uint][]NameHistory),
+	}
+	for _, mapping := range mappings {
+		name := Name{ID: mapping.ID, Name: mapping.Name, Category: mapping.Category}
+		if current, ok := r.byID[name.ID]; ok {
+			fmt.Printf("ERROR ID %d mapped as both %s %q and %s %q, keeping the first one.\n", name.ID, current.Category, current.Name, name.Category, name.Name)
+			continue
+		}
+		r.byID[name.ID] = name
+		r.byCategory[name.Category] = append(r.byCategory[name.Category], name)
+		key := strings.ToLower(name.Name)
+		r.byName[key] = append(r.byName[key], name)
+	}
+	for _, names := range r.byCategory {
+		sort.Slice(names, func(i, j int) bool { return names[i].ID < names[j].ID })
+	}
+	return r
+}
+
+func GetResolver(db *gorm.DB) (*Resolver, error) {
+	mappings := []Mapping{}
+	err := db.Where("category <> ?", CategoryUnknown).Find(&mappings).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to load mappings: %w", err)
+	}
+	r := NewResolver(mappings)
+	history := []NameHistory{}
+	err = db.Order("until").Find(&history).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to load name history: %w", err)
+	}
+	for _, name := range history {
+		r.history[name.EntityID] = append(r.history[name.EntityID], name)
+	}
+	return r, nil
+}
+
+func (r *Resolver) Len() int {
+	return len(r.byID)
+}
+
+func (r *Resolver) Get(ID uint) (Name, bool) {
+	name, ok := r.byID[ID]
+	return name, ok
+}
+
+// GetCategory only resolves the ID when it is known under that category, so a
+// colliding ID never shows up as the wrong kind of entity.
+func (r *Resolver) GetCategory(ID uint, category string) (Name, bool) {
+	name, ok := r.byID[ID]
+	if !ok || name.Category != category {
+		return Name{}, false
+	}
+	return name, true
+}
+
+func (r *Resolver) NameOf(ID uint, category string) string {
+	name, _ := r.GetCategory(ID, category)
+	return name.Name
+}
+
+// NameAt returns the name the entity had at t, which is the current name
+// unless it was renamed since.
+func (r *Resolver) NameAt(ID uint, category string, t time.Time) string {
+	name, ok := r.GetCategory(ID, category)
+	if !ok {
+		return ""
+	}
+	for _, previous := range r.history[ID] {
+		if previous.Category == category && t.Before(previous.Until) {
+			return previous.Name
+		}
+	}
+	return name.Name
+}
+
+// Category returns the names of a category, ordered by ID.
+func (r *Resolver) Category(category string) []Name {
+	return r.byCategory[category]
+}
+
+// Lookup finds the names matching case-insensitively, restricted to a
+// category unless it is empty.
+func (r *Resolver) Lookup(name string, category string) []Name {
+	res := []Name{}
+	for _, candidate := range r.byName[strings.ToLower(strings.TrimSpace(name))] {
+		if category == "" || candidate.Category == category {
+			res = append(res, candidate)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Streams cannot have an overall timeout like the ESI client. The server
+// writes a keep-alive every 30 seconds, a stream silent for longer than
+// StreamIdleTimeout is dropped.
+var StreamIdleTimeout = 90 * time.Second
+
+var streamClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+}}
+
+// ReadKillmailStream follows a killmailsServer /killmails/stream, calling
+// handle with the event ID of each killmail, until the connection drops or
+// ctx is done. Passing the last handled ID resumes the stream after that
+// killmail.
+func ReadKillmailStream(ctx context.Context, url string, lastID string, handle func(ID string, km EnrichedKMShort)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating GET request: %w", err)
+	}
+	req.Header.Add("Accept", "text/event-stream")
+	req.Header.Set("User-Agent", ESI.UserAgent)
+	if lastID != "" {
+		req.Header.Add("Last-Event-ID", lastID)
+	}
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error executing GET request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request status error: %d", resp.StatusCode)
+	}
+	idle := time.AfterFunc(StreamIdleTimeout, func() { resp.Body.Close() })
+	defer idle.Stop()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	ID, data := "", ""
+	for scanner.Scan() {
+		if !idle.Stop() {
+			break
+		}
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data != "" {
+				km := EnrichedKMShort{}
+				if err := json.Unmarshal([]byte(data), &km); err != nil {
+					return fmt.Errorf("error decoding killmail: %w", err)
+				}
+				handle(ID, km)
+			}
+			ID, data = "", ""
+		case strings.HasPrefix(line, "id:"):
+			ID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+		idle.Reset(StreamIdleTimeout)
+	}
+	if !idle.Stop() {
+		return fmt.Errorf("stream idle for %s", StreamIdleTimeout)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading stream: %w", err)
+	}
+	return fmt.Errorf("stream closed")
+}
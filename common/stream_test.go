@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadKillmailStreamDropsIdleStream(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Last-Event-ID") != "1001" {
+			t.Errorf("Last-Event-ID = %q", r.Header.Get("Last-Event-ID"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\nid: 1002\ndata: {\"killmail_id\":1002}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	timeout := StreamIdleTimeout
+	StreamIdleTimeout = 200 * time.Millisecond
+	defer func() { StreamIdleTimeout = timeout }()
+
+	IDs := []string{}
+	start := time.Now()
+	err := ReadKillmailStream(context.Background(), server.URL, "1001", func(ID string, km EnrichedKMShort) {
+		IDs = append(IDs, fmt.Sprintf("%s:%d", ID, km.ID))
+	})
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("idle stream dropped after %s", time.Since(start))
+	}
+	if err == nil || !strings.Contains(err.Error(), "stream idle") {
+		t.Errorf("got %v, want an idle stream error", err)
+	}
+	if fmt.Sprint(IDs) != "[1002:1002]" {
+		t.Errorf("handled %v", IDs)
+	}
+}
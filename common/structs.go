@@ -8,9 +8,27 @@ import (
 
 type Mapping struct {
 	gorm.Model `json:"-"`
-	ID         uint   `json:"id"`
-	Category   string `json:"category"`
-	Name       string `json:"name"`
+	ID         uint       `json:"id"`
+	Category   string     `json:"category"`
+	Name       string     `json:"name"`
+	RetryAfter *time.Time `json:"-"`
+}
+
+type NameHistory struct {
+	gorm.Model
+	EntityID uint `gorm:"index"`
+	Category string
+	Name     string
+	// Last time the name was seen in use, it was replaced by the next one afterwards
+	Until time.Time
+}
+
+type Character struct {
+	Name           string  `json:"name"`
+	CorporationID  uint    `json:"corporation_id"`
+	AllianceID     uint    `json:"alliance_id"`
+	FactionID      uint    `json:"faction_id"`
+	SecurityStatus float64 `json:"security_status"`
 }
 
 type PreToken struct {
@@ -26,11 +44,41 @@ type Token struct {
 	RefreshToken string
 	Exp          uint
 	CorpID       uint
-	CharID       uint
+	// Tokens registered before the character was stored have none
+	CharID   uint `gorm:"uniqueIndex:idx_tokens_unique_char_id,where:char_id <> 0"`
+	CharName string
+	// Space separated scopes granted to the token
+	Scopes string
+	// Changes when the character is transferred to another account
+	Owner             string
+	Status            string
+	FailureCount      uint
+	InvalidGrantCount uint
+	LastError         string
+	LastRefreshAt     *time.Time
+	LastFailureAt     *time.Time
+	// Corporation killmails are only read by directors
+	Director       bool
+	RolesCheckedAt *time.Time
+}
+
+type CharacterAffiliation struct {
+	CharacterID   uint `json:"character_id"`
+	CorporationID uint `json:"corporation_id"`
+	AllianceID    uint `json:"alliance_id"`
+}
+
+type CharacterRoles struct {
+	Roles []string `json:"roles"`
+}
+
+type SSOError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 type Payload struct {
-	Scp   []string `json:"scp"`
+	Scp   Scopes   `json:"scp"`
 	Jti   string   `json:"jti"`
 	Kid   string   `json:"kid"`
 	Sub   string   `json:"sub"`
@@ -39,6 +87,7 @@ type Payload struct {
 	Owner string   `json:"owner"`
 	Exp   uint     `json:"exp"`
 	Iss   string   `json:"iss"`
+	Aud   Audience `json:"aud"`
 }
 
 type Killmail struct {
@@ -46,19 +95,19 @@ type Killmail struct {
 	Attackers     *[]Attacker `gorm:"constraint:OnDelete:CASCADE" json:"attackers"`
 	ID            uint        `json:"killmail_id"`
 	Hash          string      `json:"killmail_hash"`
-	KillmailTime  time.Time   `json:"killmail_time"`
+	KillmailTime  time.Time   `gorm:"index" json:"killmail_time"`
 	MoonID        uint        `json:"moon_id"`
-	SolarSystemID uint        `json:"solar_system_id"`
+	SolarSystemID uint        `gorm:"index" json:"solar_system_id"`
 	Victim        *Victim     `gorm:"constraint:OnDelete:CASCADE" json:"victim"`
 	WarID         uint        `json:"war_id"`
 }
 
 type Attacker struct {
 	gorm.Model     `json:"-"`
-	KillmailID     uint    `json:"-"`
-	AllianceID     uint    `json:"alliance_id"`
-	CharacterID    uint    `json:"character_id"`
-	CorporationID  uint    `json:"corporation_id"`
+	KillmailID     uint    `gorm:"index" json:"-"`
+	AllianceID     uint    `gorm:"index" json:"alliance_id"`
+	CharacterID    uint    `gorm:"index" json:"character_id"`
+	CorporationID  uint    `gorm:"index" json:"corporation_id"`
 	DamageDone     uint    `json:"damage_done"`
 	FactionID      uint    `json:"faction_id"`
 	FinalBlow      bool    `json:"final_blow"`
@@ -69,10 +118,10 @@ type Attacker struct {
 
 type Victim struct {
 	gorm.Model    `json:"-"`
-	KillmailID    uint      `json:"-"`
-	AllianceID    uint      `json:"alliance_id"`
-	CharacterID   uint      `json:"character_id"`
-	CorporationID uint      `json:"corporation_id"`
+	KillmailID    uint      `gorm:"index" json:"-"`
+	AllianceID    uint      `gorm:"index" json:"alliance_id"`
+	CharacterID   uint      `gorm:"index" json:"character_id"`
+	CorporationID uint      `gorm:"index" json:"corporation_id"`
 	DamageTaken   uint      `json:"damage_taken"`
 	FactionID     uint      `json:"faction_id"`
 	Items         *[]Item   `gorm:"constraint:OnDelete:CASCADE" json:"items"`
@@ -109,12 +158,112 @@ type Position struct {
 	Z          float64 `json:"z"`
 }
 
+// KillmailSource records which token found a killmail, a killmail found by
+// several tokens has one source each.
+type KillmailSource struct {
+	gorm.Model
+	KillmailID uint `gorm:"uniqueIndex:idx_killmail_sources_killmail_token"`
+	TokenID    uint `gorm:"uniqueIndex:idx_killmail_sources_killmail_token"`
+	CharID     uint
+	CorpID     uint `gorm:"index"`
+}
+
+// Tenant is a corporation with its own board, identified by its corporation ID
+type Tenant struct {
+	gorm.Model
+	ID   uint
+	Name string
+}
+
+// Webhook posts killmails of the server board, or of a tenant board, matching
+// its rules to a Discord or Slack channel.
+type Webhook struct {
+	gorm.Model
+	URL            string
+	Format         string
+	TenantID       uint
+	Kind           string
+	MinValue       float64
+	ShipGroupID    uint
+	ShipCategoryID uint
+	RegionID       uint
+}
+
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID     uint   `gorm:"uniqueIndex:idx_webhook_deliveries_webhook_killmail"`
+	KillmailID    uint   `gorm:"uniqueIndex:idx_webhook_deliveries_webhook_killmail"`
+	Status        string `gorm:"index"`
+	Payload       string
+	Attempts      uint
+	LastError     string
+	NextAttemptAt time.Time
+	SentAt        *time.Time
+}
+
+type PendingKillmail struct {
+	gorm.Model
+	ID            uint
+	Hash          string
+	Attempts      uint
+	LastError     string
+	NextAttemptAt time.Time `gorm:"index"`
+	// Feed killmails queued before their details were known
+	Unfiltered bool `gorm:"default:false"`
+}
+
+type Backfill struct {
+	gorm.Model
+	Source      string `gorm:"uniqueIndex"`
+	Path        string
+	Total       uint
+	Processed   uint
+	Stored      uint
+	Failed      uint
+	CompletedAt *time.Time
+}
+
 type SolarSystem struct {
-	gorm.Model     `json:"-"`
-	ID             uint    `json:"solar_system_id:"`
-	RegionID       uint    `json:"region_id:"`
-	SecurityStatus float64 `json:"security_status"`
-	Name           string  `json:"name"`
+	gorm.Model      `json:"-"`
+	ID              uint           `json:"solar_system_id:"`
+	RegionID        uint           `json:"region_id:"`
+	ConstellationID uint           `json:"constellation_id"`
+	SecurityStatus  float64        `json:"security_status"`
+	Name            string         `json:"name"`
+	Region          *Region        `gorm:"constraint:-" json:"-"`
+	Constellation   *Constellation `gorm:"constraint:-" json:"-"`
+}
+
+type SolarSystemJump struct {
+	gorm.Model
+	FromSolarSystemID uint `gorm:"uniqueIndex:idx_solar_system_jumps_from_to"`
+	ToSolarSystemID   uint `gorm:"uniqueIndex:idx_solar_system_jumps_from_to"`
+}
+
+type InventoryType struct {
+	gorm.Model
+	ID      uint
+	GroupID uint `gorm:"index"`
+}
+
+type InventoryGroup struct {
+	gorm.Model
+	ID         uint
+	CategoryID uint `gorm:"index"`
+	Name       string
+}
+
+type Region struct {
+	gorm.Model `json:"-"`
+	ID         uint   `json:"region_id"`
+	Name       string `json:"name"`
+}
+
+type Constellation struct {
+	gorm.Model `json:"-"`
+	ID         uint   `json:"constellation_id"`
+	RegionID   uint   `json:"region_id"`
+	Name       string `json:"name"`
 }
 
 type Asset struct {
@@ -124,26 +273,34 @@ type Asset struct {
 }
 
 type EnrichedKMShort struct {
-	Victim       EnrichedVictim   `json:"victim"`
-	Attacker     EnrichedAttacker `json:"attacker"`
-	SolarSystem  SolarSystem      `json:"solar_system"`
-	ID           uint             `json:"killmail_id"`
-	KillmailTime time.Time        `json:"killmail_time"`
-	MoonID       uint             `json:"moon_id"`
-	WarID        uint             `json:"war_id"`
-	Price        float64          `json:"price"`
+	Victim            EnrichedVictim   `json:"victim"`
+	Attacker          EnrichedAttacker `json:"attacker"`
+	SolarSystem       SolarSystem      `json:"solar_system"`
+	RegionName        string           `json:"region_name"`
+	ConstellationName string           `json:"constellation_name"`
+	ID                uint             `json:"killmail_id"`
+	KillmailTime      time.Time        `json:"killmail_time"`
+	MoonID            uint             `json:"moon_id"`
+	WarID             uint             `json:"war_id"`
+	Price             float64          `json:"price"`
+	PriceSource       string           `json:"price_source"`
+	Status            string           `json:"status"`
 }
 
 type EnrichedKM struct {
-	Victim       EnrichedVictim      `json:"victim"`
-	Attackers    *[]EnrichedAttacker `json:"attackers"`
-	SolarSystem  SolarSystem         `json:"solar_system"`
-	ID           uint                `json:"killmail_id"`
-	KillmailTime time.Time           `json:"killmail_time"`
-	MoonID       uint                `json:"moon_id"`
-	WarID        uint                `json:"war_id"`
-	Price        float64             `json:"price"`
-	ShipPrice    float64             `json:"ship_price"`
+	Victim            EnrichedVictim      `json:"victim"`
+	Attackers         *[]EnrichedAttacker `json:"attackers"`
+	SolarSystem       SolarSystem         `json:"solar_system"`
+	RegionName        string              `json:"region_name"`
+	ConstellationName string              `json:"constellation_name"`
+	ID                uint                `json:"killmail_id"`
+	KillmailTime      time.Time           `json:"killmail_time"`
+	MoonID            uint                `json:"moon_id"`
+	WarID             uint                `json:"war_id"`
+	Price             float64             `json:"price"`
+	ShipPrice         float64             `json:"ship_price"`
+	PriceSource       string              `json:"price_source"`
+	Status            string              `json:"status"`
 }
 
 type EnrichedVictim struct {
@@ -152,6 +309,9 @@ type EnrichedVictim struct {
 	CharacterPortrait string          `json:"character_portrait"`
 	CorporationName   string          `json:"corporation_name"`
 	CorporationLogo   string          `json:"corporation_logo"`
+	AllianceName      string          `json:"alliance_name"`
+	AllianceLogo      string          `json:"alliance_logo"`
+	FactionName       string          `json:"faction_name"`
 	ShipTypeName      string          `json:"ship_type_name"`
 	EnrichedItems     *[]EnrichedItem `json:"items"`
 	ShipTypeIcon      string          `json:"ship_type_icon"`
@@ -164,6 +324,9 @@ type EnrichedAttacker struct {
 	CharacterPortrait string `json:"character_portrait"`
 	CorporationName   string `json:"corporation_name"`
 	CorporationLogo   string `json:"corporation_logo"`
+	AllianceName      string `json:"alliance_name"`
+	AllianceLogo      string `json:"alliance_logo"`
+	FactionName       string `json:"faction_name"`
 	ShipTypeName      string `json:"ship_type_name"`
 	ShipTypeIcon      string `json:"ship_type_icon"`
 	WeaponTypeName    string `json:"weapon_type_name"`
@@ -190,6 +353,124 @@ type ItemPrice struct {
 	ItemTypeID    uint    `json:"type_id"`
 }
 
+type PriceSnapshot struct {
+	gorm.Model    `json:"-"`
+	Source        string    `gorm:"uniqueIndex:idx_price_snapshots_source_date_type;default:esi" json:"source"`
+	Date          time.Time `gorm:"uniqueIndex:idx_price_snapshots_source_date_type" json:"date"`
+	ItemTypeID    uint      `gorm:"uniqueIndex:idx_price_snapshots_source_date_type" json:"type_id"`
+	AdjustedPrice float64   `json:"adjusted_price"`
+	AveragePrice  float64   `json:"average_price"`
+	BuyPrice      float64   `json:"buy_price"`
+	SellPrice     float64   `json:"sell_price"`
+}
+
+// KillmailValue is the value of a killmail with the price snapshot closest to
+// it, kept by the server to filter killmails on their value
+type KillmailValue struct {
+	gorm.Model
+	KillmailID uint `gorm:"uniqueIndex"`
+	Source     string
+	Date       time.Time
+	Value      float64 `gorm:"index"`
+}
+
+type MarketOrder struct {
+	OrderID      uint64  `json:"order_id"`
+	ItemTypeID   uint    `json:"type_id"`
+	LocationID   uint64  `json:"location_id"`
+	IsBuyOrder   bool    `json:"is_buy_order"`
+	Price        float64 `json:"price"`
+	VolumeRemain uint    `json:"volume_remain"`
+}
+
+type Stats struct {
+	Since         time.Time     `json:"since"`
+	Until         time.Time     `json:"until"`
+	Kills         uint          `json:"kills"`
+	Losses        uint          `json:"losses"`
+	ISKDestroyed  float64       `json:"isk_destroyed"`
+	ISKLost       float64       `json:"isk_lost"`
+	Efficiency    float64       `json:"efficiency"`
+	SoloKills     uint          `json:"solo_kills"`
+	GangKills     uint          `json:"gang_kills"`
+	TopFinalBlows []PilotStats  `json:"top_final_blows,omitempty"`
+	TopDamage     []PilotStats  `json:"top_damage,omitempty"`
+	ShipsUsed     []ShipStats   `json:"ships_used,omitempty"`
+	ShipsLost     []ShipStats   `json:"ships_lost,omitempty"`
+	Systems       []SystemStats `json:"systems,omitempty"`
+}
+
+type Profile struct {
+	ID              uint              `json:"id"`
+	Category        string            `json:"category"`
+	Name            string            `json:"name"`
+	Image           string            `json:"image"`
+	CorporationID   uint              `json:"corporation_id,omitempty"`
+	CorporationName string            `json:"corporation_name,omitempty"`
+	CorporationLogo string            `json:"corporation_logo,omitempty"`
+	AllianceID      uint              `json:"alliance_id,omitempty"`
+	AllianceName    string            `json:"alliance_name,omitempty"`
+	AllianceLogo    string            `json:"alliance_logo,omitempty"`
+	Stats           Stats             `json:"stats"`
+	ShipsFlown      []ShipStats       `json:"ships_flown"`
+	RecentKills     []EnrichedKMShort `json:"recent_kills"`
+	RecentLosses    []EnrichedKMShort `json:"recent_losses"`
+}
+
+// Battle is identified by its first killmail ID
+type Battle struct {
+	ID           uint          `json:"battle_id"`
+	Start        time.Time     `json:"start"`
+	End          time.Time     `json:"end"`
+	Kills        uint          `json:"kills"`
+	ISKLost      float64       `json:"isk_lost"`
+	SolarSystems []SystemStats `json:"solar_systems"`
+	Sides        []BattleSide  `json:"sides"`
+	Timeline     []BattleKill  `json:"timeline,omitempty"`
+}
+
+// BattleSide groups the alliances (or corporations without alliance) that
+// shot the same targets and never each other.
+type BattleSide struct {
+	Groups    []Name      `json:"groups"`
+	Pilots    uint        `json:"pilots"`
+	Losses    uint        `json:"losses"`
+	ISKLost   float64     `json:"isk_lost"`
+	Ships     []ShipStats `json:"ships"`
+	ShipsLost []ShipStats `json:"ships_lost"`
+}
+
+type BattleKill struct {
+	EnrichedKMShort
+	VictimSide int `json:"victim_side"`
+}
+
+type PilotStats struct {
+	CharacterID       uint   `json:"character_id"`
+	CharacterName     string `json:"character_name"`
+	CharacterPortrait string `json:"character_portrait"`
+	Kills             uint   `json:"kills"`
+	FinalBlows        uint   `json:"final_blows"`
+	DamageDone        uint   `json:"damage_done"`
+}
+
+type ShipStats struct {
+	ShipTypeID   uint    `json:"ship_type_id"`
+	ShipTypeName string  `json:"ship_type_name"`
+	ShipTypeIcon string  `json:"ship_type_icon"`
+	Count        uint    `json:"count"`
+	Value        float64 `json:"value,omitempty"`
+}
+
+type SystemStats struct {
+	SolarSystemID   uint    `json:"solar_system_id"`
+	SolarSystemName string  `json:"solar_system_name"`
+	RegionName      string  `json:"region_name"`
+	SecurityStatus  float64 `json:"security_status"`
+	Kills           uint    `json:"kills"`
+	Losses          uint    `json:"losses"`
+}
+
 type ItemAggregated struct {
 	ItemName          string
 	QuantityDropped   uint
@@ -2,17 +2,134 @@ package common
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/square/go-jose"
 	"gorm.io/gorm"
 )
 
-const JWK = `{"alg":"RS256","e":"AQAB","kid":"JWT-Signature-Key","kty":"RSA","n":"nehPQ7FQ1YK-leKyIg-aACZaT-DbTL5V1XpXghtLX_bEC-fwxhdE_4yQKDF6cA-V4c-5kh8wMZbfYw5xxgM9DynhMkVrmQFyYB3QMZwydr922UWs3kLz-nO6vi0ldCn-ffM9odUPRHv9UbhM5bB4SZtCrpr9hWQgJ3FjzWO2KosGQ8acLxLtDQfU_lq0OGzoj_oWwUKaN_OVfu80zGTH7mxVeGMJqWXABKd52ByvYZn3wL_hG60DfDWGV_xfLlHMt_WoKZmrXT4V3BCBmbitJ6lda3oNdNeHUh486iqaL43bMR2K4TzrspGMRUYXcudUQ9TycBQBrUlT85NRY9TeOw","use":"sig"}`
+// Issuers of the SSO tokens, older tokens do not have the scheme
+var ssoIssuers = []string{"login.eveonline.com", "https://login.eveonline.com"}
+
+const ssoAudience = "EVE Online"
+
+// Clock skew tolerated on the token expiry
+const tokenLeeway = time.Minute
+
+const CorporationKillmailsScope = "esi-killmails.read_corporation_killmails.v1"
+const CorporationRolesScope = "esi-characters.read_corporation_roles.v1"
+
+const (
+	TokenActive      = "active"
+	TokenFailing     = "failing"
+	TokenRevoked     = "revoked"
+	TokenTransferred = "transferred"
+)
+
+// Tokens are disabled after this many invalid_grant refreshes in a row
+const MaxInvalidGrants = 3
+
+var ErrInvalidGrant = errors.New("invalid_grant")
+var ErrOwnerChanged = errors.New("character transferred to another account")
+
+// Scopes of a JWT, SSO sends a string instead of a list for a single scope
+type Scopes []string
+
+func (s *Scopes) UnmarshalJSON(data []byte) error {
+	var scope string
+	if err := json.Unmarshal(data, &scope); err == nil {
+		*s = Scopes{}
+		if scope != "" {
+			*s = Scopes{scope}
+		}
+		return nil
+	}
+	var scopes []string
+	if err := json.Unmarshal(data, &scopes); err != nil {
+		return err
+	}
+	*s = scopes
+	return nil
+}
+
+// Audience of a JWT, a string or a list like the scopes
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	return (*Scopes)(a).UnmarshalJSON(data)
+}
+
+func (a Audience) Contains(audience string) bool {
+	for _, value := range a {
+		if value == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Token) HasScope(scope string) bool {
+	for _, granted := range strings.Fields(t.Scopes) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens registered before scopes were recorded are assumed to have the
+// corporation scope when they have a corporation
+func (t *Token) ReadsCorporationKillmails() bool {
+	return t.CorpID != 0 && (t.Scopes == "" || t.HasScope(CorporationKillmailsScope))
+}
+
+// MigrateTokens migrates the tokens table. Databases from before the unique
+// character index may hold several tokens for a character: the newest one is
+// kept, preferring tokens not deleted, and the others removed so the index
+// can be created.
+func MigrateTokens(db *gorm.DB) error {
+	if db.Migrator().HasTable(&Token{}) {
+		err := removeDuplicateTokens(db)
+		if err != nil {
+			return err
+		}
+	}
+	err := db.AutoMigrate(&Token{})
+	if err != nil {
+		return fmt.Errorf("unable to migrate tokens: %w", err)
+	}
+	return nil
+}
+
+func removeDuplicateTokens(db *gorm.DB) error {
+	tokens := []Token{}
+	err := db.Unscoped().Select("id", "char_id", "deleted_at").Where("char_id <> 0").Order("char_id, deleted_at IS NOT NULL, id desc").Find(&tokens).Error
+	if err != nil {
+		return fmt.Errorf("unable to load tokens: %w", err)
+	}
+	duplicates := []uint{}
+	for i := 1; i < len(tokens); i++ {
+		if tokens[i].CharID == tokens[i-1].CharID {
+			duplicates = append(duplicates, tokens[i].ID)
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	err = db.Unscoped().Where("id IN ?", duplicates).Delete(&Token{}).Error
+	if err != nil {
+		return fmt.Errorf("unable to remove duplicate tokens: %w", err)
+	}
+	fmt.Printf("Removed %d older tokens of characters with several tokens\n", len(duplicates))
+	return nil
+}
 
 func GetTokens(db *gorm.DB) (*[]Token, error) {
 	tokens := &[]Token{}
@@ -20,9 +137,51 @@ func GetTokens(db *gorm.DB) (*[]Token, error) {
 	return tokens, nil
 }
 
+// GetActiveTokens leaves out revoked and transferred tokens, and the tokens
+// without a character until they are identified
+func GetActiveTokens(db *gorm.DB) (*[]Token, error) {
+	tokens := &[]Token{}
+	err := db.Where("COALESCE(status, '') NOT IN ? AND char_id <> 0", []string{TokenRevoked, TokenTransferred}).Find(tokens).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to load tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+func (t *Token) Disabled() bool {
+	return t.Status == TokenRevoked || t.Status == TokenTransferred
+}
+
+// RecordRefresh updates the health of the token after a refresh
+func (t *Token) RecordRefresh(err error) {
+	now := time.Now()
+	if err == nil {
+		t.Status = TokenActive
+		t.FailureCount = 0
+		t.InvalidGrantCount = 0
+		t.LastError = ""
+		t.LastRefreshAt = &now
+		return
+	}
+	t.FailureCount++
+	t.LastError = err.Error()
+	t.LastFailureAt = &now
+	switch {
+	case errors.Is(err, ErrOwnerChanged):
+		t.Status = TokenTransferred
+	case errors.Is(err, ErrInvalidGrant):
+		t.InvalidGrantCount++
+		t.Status = TokenFailing
+		if t.InvalidGrantCount >= MaxInvalidGrants {
+			t.Status = TokenRevoked
+		}
+	default:
+		t.Status = TokenFailing
+	}
+}
+
 func RefreshToken(token *Token, clientId, secretKey string) error {
 	fmt.Printf("Refreshing Token, expired at: %d.\n", token.Exp)
-	fmt.Println(token.Exp)
 	params := url.Values{}
 	params.Add("grant_type", "refresh_token")
 	params.Add("refresh_token", token.RefreshToken)
@@ -30,29 +189,48 @@ func RefreshToken(token *Token, clientId, secretKey string) error {
 	req.Header.Add("Host", "login.eveonline.com")
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.SetBasicAuth(clientId, secretKey)
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("User-Agent", ESI.UserAgent)
+	// Refresh tokens may be rotated by a post, which is never retried
+	resp, err := ESI.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != 200 {
 		fmt.Printf("Status code %d in body\n", resp.StatusCode)
+		ssoErr := SSOError{}
+		if json.Unmarshal(body, &ssoErr) == nil && ssoErr.Error == "invalid_grant" {
+			return fmt.Errorf("%w: %s", ErrInvalidGrant, ssoErr.ErrorDescription)
+		}
 		return fmt.Errorf("invalid Status Code: %d", resp.StatusCode)
 	}
 	token_ := PreToken{}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
 	err = json.Unmarshal(body, &token_)
 	if err != nil {
 		return err
 	}
-	fmt.Println(token_.AccessToken)
-	fmt.Println(token_.RefreshToken)
-	payload, err := GetTokenPayload(token_.AccessToken)
+	payload, err := GetTokenPayload(token_.AccessToken, clientId)
 	if err != nil {
 		return err
 	}
+	if token.Owner != "" && payload.Owner != token.Owner {
+		return ErrOwnerChanged
+	}
+	// Tokens registered before the character was stored get it from the JWT
+	if token.CharID == 0 {
+		charID, err := payload.CharacterID()
+		if err != nil {
+			return err
+		}
+		token.CharID = charID
+		token.CharName = payload.Name
+		token.Scopes = strings.Join(payload.Scp, " ")
+	}
+	token.Owner = payload.Owner
 	token.AccessToken = token_.AccessToken
 	token.RefreshToken = token_.RefreshToken
 	token.Exp = payload.Exp
@@ -60,18 +238,37 @@ func RefreshToken(token *Token, clientId, secretKey string) error {
 	return nil
 }
 
-func GetTokenPayload(tokenString string) (Payload, error) {
+// CharacterID is taken from the JWT sub, "CHARACTER:EVE:<id>"
+func (p *Payload) CharacterID() (uint, error) {
+	segments := strings.Split(p.Sub, ":")
+	if len(segments) < 3 {
+		errMsg := fmt.Sprintf("unable to extract CharID from %s", p.Sub)
+		return 0, errors.New(errMsg)
+	}
+	charIDint, err := strconv.Atoi(segments[2])
+	if err != nil {
+		return 0, err
+	}
+	return uint(charIDint), nil
+}
+
+// GetTokenPayload verifies the JWT against the SSO keys and checks it was
+// issued by SSO for the application.
+func GetTokenPayload(tokenString string, clientId string) (Payload, error) {
 	object, err := jose.ParseSigned(tokenString)
 	if err != nil {
 		fmt.Println("Error parsing token:", err)
 		return Payload{}, err
 	}
-	var d jose.JSONWebKey
-	if err := json.Unmarshal([]byte(JWK), &d); err != nil {
-		fmt.Println("Error umarshalling web key:", err)
+	if len(object.Signatures) != 1 {
+		return Payload{}, fmt.Errorf("expected one token signature, got %d", len(object.Signatures))
+	}
+	key, err := ssoKeys.get(object.Signatures[0].Header.KeyID)
+	if err != nil {
+		fmt.Println("Error getting web key:", err)
 		return Payload{}, err
 	}
-	output, err := object.Verify(d)
+	output, err := object.Verify(key)
 	if err != nil {
 		fmt.Println("Error verifying token:", err)
 		return Payload{}, err
@@ -81,5 +278,26 @@ func GetTokenPayload(tokenString string) (Payload, error) {
 		fmt.Println("Error unmarshalling payload:", err)
 		return Payload{}, err
 	}
+	if err := payload.validate(clientId); err != nil {
+		fmt.Println("Error validating token:", err)
+		return Payload{}, err
+	}
 	return payload, nil
 }
+
+func (p *Payload) validate(clientId string) error {
+	issued := false
+	for _, issuer := range ssoIssuers {
+		issued = issued || p.Iss == issuer
+	}
+	if !issued {
+		return fmt.Errorf("invalid token issuer %q", p.Iss)
+	}
+	if !p.Aud.Contains(ssoAudience) || (clientId != "" && !p.Aud.Contains(clientId)) {
+		return fmt.Errorf("invalid token audience %q", []string(p.Aud))
+	}
+	if time.Unix(int64(p.Exp), 0).Add(tokenLeeway).Before(time.Now()) {
+		return fmt.Errorf("token expired at %d", p.Exp)
+	}
+	return nil
+}
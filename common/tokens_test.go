@@ -0,0 +1,103 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// testTransport sends all the requests to the test server
+type testTransport struct {
+	target *url.URL
+}
+
+func (s testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = s.target.Scheme
+	req.URL.Host = s.target.Host
+	req.Host = ""
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRefreshTokenIsNotRetried(t *testing.T) {
+	stub := &stubESI{handlers: []http.HandlerFunc{status(http.StatusServiceUnavailable, nil)}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	esi := ESI
+	ESI = NewESIClient("EveGonline tests", 5*time.Second)
+	ESI.Backoff = 10 * time.Millisecond
+	ESI.HTTPClient.Transport = testTransport{target: target}
+	defer func() { ESI = esi }()
+
+	token := Token{RefreshToken: "refresh"}
+	err := RefreshToken(&token, testClientID, "secret")
+	if err == nil || errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("got %v, want a failed refresh", err)
+	}
+	if stub.count() != 1 {
+		t.Errorf("%d token requests, want 1 without retries", stub.count())
+	}
+	if agent := stub.requests[0].Header.Get("User-Agent"); agent != "EveGonline tests" {
+		t.Errorf("User-Agent = %q", agent)
+	}
+	if token.RefreshToken != "refresh" {
+		t.Error("the refresh token changed after a failed refresh")
+	}
+}
+
+func TestMigrateTokensRemovesDuplicates(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(t.TempDir()+"/test.db"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A database from before the unique character index
+	if err := db.AutoMigrate(&Token{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().DropIndex(&Token{}, "idx_tokens_unique_char_id"); err != nil {
+		t.Fatal(err)
+	}
+	tokens := []Token{
+		{CharID: 2112000001, RefreshToken: "old"},
+		{CharID: 2112000001, RefreshToken: "new"},
+		{CharID: 2112000002, RefreshToken: "kept"},
+		{CharID: 2112000002, RefreshToken: "deleted"},
+		{CharID: 2112000003, RefreshToken: "only"},
+		{RefreshToken: "legacy"},
+		{RefreshToken: "other legacy"},
+	}
+	if err := db.Create(&tokens).Error; err != nil {
+		t.Fatal(err)
+	}
+	db.Delete(&Token{}, tokens[3].ID)
+
+	// Twice, the second time with the index
+	for i := 0; i < 2; i++ {
+		if err := MigrateTokens(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remaining := []Token{}
+	db.Unscoped().Order("id").Find(&remaining)
+	got := []string{}
+	for _, token := range remaining {
+		got = append(got, fmt.Sprintf("%d:%s", token.CharID, token.RefreshToken))
+	}
+	if fmt.Sprint(got) != "[2112000001:new 2112000002:kept 2112000003:only 0:legacy 0:other legacy]" {
+		t.Errorf("remaining tokens %v", got)
+	}
+	if !db.Migrator().HasIndex(&Token{}, "idx_tokens_unique_char_id") {
+		t.Error("unique character index not created")
+	}
+	if err := db.Create(&Token{CharID: 2112000003}).Error; err == nil {
+		t.Error("second token created for a character")
+	}
+}
@@ -7,7 +7,15 @@ const EveApiJWKUrl = "https://login.eveonline.com/oauth/jwks"
 const EveApiKillmailCharAPIUrl = "https://esi.evetech.net/latest/characters/%d/killmails/recent"
 const EveApiKillmailCorpAPIUrl = "https://esi.evetech.net/latest/corporations/%d/killmails/recent"
 const EveApiKillmailDetailsAPIUrl = "https://esi.evetech.net/latest/killmails/%d/%s/"
+const EveApiCharacterAPIUrl = "https://esi.evetech.net/latest/characters/%d/"
+const EveApiAffiliationAPIUrl = "https://esi.evetech.net/latest/characters/affiliation/"
+const EveApiCharacterRolesAPIUrl = "https://esi.evetech.net/latest/characters/%d/roles/"
 const EveApiNamesAPIUrl = "https://esi.evetech.net/latest/universe/names/"
 const EvePricesAPIUrl = "https://esi.evetech.net/latest/markets/prices"
+const EveMarketOrdersAPIUrl = "https://esi.evetech.net/latest/markets/%d/orders/"
+
+const TheForgeRegionID = 10000002
+const JitaTradeHubID = 60003760
 
 const EveImagesUrl = "https://images.evetech.net/"
+const ZKillboardKillUrl = "https://zkillboard.com/kill/%d/"
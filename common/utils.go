@@ -9,7 +9,7 @@ import (
 func GetMappings(db *gorm.DB) (map[uint]string, error) {
 	res := make(map[uint]string)
 	mappings := []Mapping{}
-	db.Find(&mappings)
+	db.Where("category <> ?", CategoryUnknown).Find(&mappings)
 	for _, mapping := range mappings {
 		res[mapping.ID] = mapping.Name
 	}
@@ -18,10 +18,24 @@ func GetMappings(db *gorm.DB) (map[uint]string, error) {
 
 func GetSolarSystem(db *gorm.DB, solarSystemID uint) *SolarSystem {
 	solarSystem := SolarSystem{}
-	db.Where("id = ?", solarSystemID).Find(&solarSystem)
+	db.Preload("Region").Preload("Constellation").Where("id = ?", solarSystemID).Find(&solarSystem)
 	return &solarSystem
 }
 
+func (s *SolarSystem) RegionName() string {
+	if s.Region == nil {
+		return ""
+	}
+	return s.Region.Name
+}
+
+func (s *SolarSystem) ConstellationName() string {
+	if s.Constellation == nil {
+		return ""
+	}
+	return s.Constellation.Name
+}
+
 func FormatPrice(price float64) string {
 	if price >= 1000000000 {
 		price = price / 1000000000
@@ -18,12 +18,12 @@ import (
 
 var endpoint *string
 var debug *bool
-
-const PKID = 260635334
+var corp *uint
 
 func main() {
 	debug = flag.Bool("d", false, "debug")
 	endpoint = flag.String("e", "http://tortuga.judge-gregg.net:8000", "endpoint")
+	corp = flag.Uint("c", 0, "corporation board to show, on multi-corporation servers")
 	flag.Parse()
 	if *debug {
 		f, _ := os.OpenFile("file.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -31,12 +31,14 @@ func main() {
 		log.SetOutput(f)
 	}
 
-	kms, err := getKillmails()
+	go streamKillmails()
+	kms, cursor, err := getKillmails("")
 	if err != nil {
 		panic(err)
 	}
+	nextCursor = cursor
 	items := []list.Item{}
-	for _, km := range *kms {
+	for _, km := range kms {
 		items = append(items, item(km))
 	}
 
@@ -61,32 +63,45 @@ func main() {
 	}
 }
 
-func getKillmails() (*[]common.EnrichedKMShort, error) {
-	req, err := http.NewRequest("GET", *endpoint+"/killmails/", nil)
+// getKillmails returns one page of killmails and the cursor of the next one,
+// empty after the last page
+func getKillmails(cursor string) ([]common.EnrichedKMShort, string, error) {
+	url := fmt.Sprintf("%s/killmails/?limit=%d", getBaseURL(), pageSize)
+	if cursor != "" {
+		url += "&cursor=" + cursor
+	}
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error creating GET request: %w", err)
+		return nil, "", fmt.Errorf("error creating GET request: %w", err)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("User-Agent", common.ESI.UserAgent)
+	resp, err := common.ESI.HTTPClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error executing GET request: %w", err)
+		return nil, "", fmt.Errorf("error executing GET request: %w", err)
 	}
 	defer resp.Body.Close()
-	kms := []common.EnrichedKMShort{}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("request status error: %d", resp.StatusCode)
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading GET request body: %w", err)
+		return nil, "", fmt.Errorf("error reading GET request body: %w", err)
 	}
-	json.Unmarshal(body, &kms)
-	return &kms, nil
-
+	page := []common.EnrichedKMShort{}
+	err = json.Unmarshal(body, &page)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding killmails: %w", err)
+	}
+	return page, resp.Header.Get("X-Next-Cursor"), nil
 }
 
 func getKillmail(kmID string) (*common.EnrichedKM, error) {
-	req, err := http.NewRequest("GET", *endpoint+"/killmail/"+kmID, nil)
+	req, err := http.NewRequest("GET", getBaseURL()+"/killmail/"+kmID, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating GET request: %w", err)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("User-Agent", common.ESI.UserAgent)
+	resp, err := common.ESI.HTTPClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error executing GET request: %w", err)
 	}
@@ -103,8 +118,14 @@ func getKillmail(kmID string) (*common.EnrichedKM, error) {
 	return &km, nil
 }
 
+func getBaseURL() string {
+	if *corp != 0 {
+		return fmt.Sprintf("%s/corp/%d", *endpoint, *corp)
+	}
+	return *endpoint
+}
+
 func formatKillmailShort(km *common.EnrichedKMShort) string {
-	res := ""
 	kmDate := km.KillmailTime.Format("02/01/2006 15:04:05")
 	if km.Victim.CharacterID == 0 {
 		km.Victim.CharacterName = km.Victim.CorporationName
@@ -112,12 +133,8 @@ func formatKillmailShort(km *common.EnrichedKMShort) string {
 	if km.Attacker.CharacterID == 0 {
 		km.Attacker.CharacterName = km.Attacker.ShipTypeName
 	}
-	loss := getKillmailStatus(km)
-	if loss {
-		res = fmt.Sprintf("\033[31m \033[3m%15s %4.1f\033[23m %25s \033[1m%50s\033[22m %25s \033[1m%15s\033[22m \033[3m%25s\033[22m\033[0m", km.SolarSystem.Name, km.SolarSystem.SecurityStatus, km.Victim.CharacterName, km.Victim.ShipTypeName, km.Attacker.CharacterName, common.FormatPrice(km.Price), kmDate)
-	} else {
-		res = fmt.Sprintf("\033[32m \033[3m%15s %4.1f\033[23m %25s \033[1m%50s\033[22m %25s \033[1m%15s\033[22m \033[3m%25s\033[22m\033[0m", km.SolarSystem.Name, km.SolarSystem.SecurityStatus, km.Victim.CharacterName, km.Victim.ShipTypeName, km.Attacker.CharacterName, common.FormatPrice(km.Price), kmDate)
-	}
+	color := getKillmailStatusColor(km.Status)
+	res := fmt.Sprintf("\033[%dm \033[3m%15s %4.1f\033[23m %25s \033[1m%50s\033[22m %25s \033[1m%15s\033[22m \033[3m%25s\033[22m\033[0m", color, km.SolarSystem.Name, km.SolarSystem.SecurityStatus, km.Victim.CharacterName, km.Victim.ShipTypeName, km.Attacker.CharacterName, common.FormatPrice(km.Price), kmDate)
 	return res
 }
 
@@ -128,6 +145,7 @@ func formatKillmail(km *common.EnrichedKM) (string, error) {
 		finalBlow.CharacterName = finalBlow.ShipTypeName
 	}
 	res += fmt.Sprintf("\033[1m\033[31m%s\033[39m\033[22m lost a \033[1m%s\033[22m in \033[3m%s (%.1f)\033[23m. Final blow: \033[1m\033[32m%s\033[39m\033[22m\n", km.Victim.CharacterName, km.Victim.ShipTypeName, km.SolarSystem.Name, km.SolarSystem.SecurityStatus, finalBlow.CharacterName)
+	res += fmt.Sprintf("\033[3m%s\033[23m\n", formatAffiliation(km.Victim.CorporationName, km.Victim.AllianceName, km.Victim.FactionName))
 	res += "\n"
 	res += fmt.Sprintf("\033[1m\033[33mKill Value: %s\033[39m\033[22m\n", common.FormatPrice(km.Price))
 	res += "\n"
@@ -144,7 +162,7 @@ func formatKillmail(km *common.EnrichedKM) (string, error) {
 		if attacker.ShipTypeID == 0 {
 			attacker.ShipTypeName = "?"
 		}
-		res += fmt.Sprintf("\033[1m%50s\033[22m %50s \033[3m%50s %10d %5.1f%%\033[23m\n", attacker.CharacterName, attacker.ShipTypeName, attacker.WeaponTypeName, attacker.DamageDone, getDamagePercent(attacker.DamageDone, km.Victim.DamageTaken))
+		res += fmt.Sprintf("\033[1m%50s\033[22m %50s %50s \033[3m%50s %10d %5.1f%%\033[23m\n", attacker.CharacterName, formatAffiliation(attacker.CorporationName, attacker.AllianceName, attacker.FactionName), attacker.ShipTypeName, attacker.WeaponTypeName, attacker.DamageDone, getDamagePercent(attacker.DamageDone, km.Victim.DamageTaken))
 	}
 	res += "\n"
 	res += "\n"
@@ -161,6 +179,17 @@ func formatKillmail(km *common.EnrichedKM) (string, error) {
 	return res, nil
 }
 
+func formatAffiliation(corporation string, alliance string, faction string) string {
+	res := corporation
+	if alliance != "" {
+		res += " [" + alliance + "]"
+	}
+	if faction != "" {
+		res += " (" + faction + ")"
+	}
+	return res
+}
+
 func filterAttackers(attackers *[]common.EnrichedAttacker) *common.EnrichedAttacker {
 	for _, attacker := range *attackers {
 		if attacker.FinalBlow {
@@ -199,8 +228,14 @@ func filterItems(items *[]common.EnrichedItem) []common.ItemAggregated {
 	return res
 }
 
-func getKillmailStatus(km *common.EnrichedKMShort) bool {
-	return km.Victim.CorporationID == PKID
+func getKillmailStatusColor(status string) int {
+	switch status {
+	case common.StatusLoss:
+		return 31
+	case common.StatusKill:
+		return 32
+	}
+	return 33
 }
 
 func getDamagePercent(damageDone uint, damageTaken uint) float64 {
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const pageSize = 200
+
+// Older killmails are loaded a page at a time, when the selection gets close
+// to the end of the list. Only used from Update.
+var nextCursor string
+var loadingPage bool
+
+type pageMsg struct {
+	kms    []common.EnrichedKMShort
+	cursor string
+	err    error
+}
+
+func loadPage(cursor string) tea.Cmd {
+	return func() tea.Msg {
+		kms, next, err := getKillmails(cursor)
+		return pageMsg{kms: kms, cursor: next, err: err}
+	}
+}
+
+func loadMoreIfNeeded(l *list.Model) tea.Cmd {
+	if loadingPage || nextCursor == "" || l.FilterState() != list.Unfiltered {
+		return nil
+	}
+	if l.Index() < len(l.Items())-listHeight {
+		return nil
+	}
+	loadingPage = true
+	return loadPage(nextCursor)
+}
+
+// addPage appends the page to the list, a failed page is retried on the next move
+func addPage(l *list.Model, msg pageMsg) tea.Cmd {
+	loadingPage = false
+	if msg.err != nil {
+		if *debug {
+			log.Println("page:", msg.err)
+		}
+		return nil
+	}
+	nextCursor = msg.cursor
+	listed := make(map[uint]bool)
+	for _, listedItem := range l.Items() {
+		listed[listedItem.(item).ID] = true
+	}
+	cmds := []tea.Cmd{}
+	for _, km := range msg.kms {
+		if listed[km.ID] {
+			continue
+		}
+		cmds = append(cmds, l.InsertItem(len(l.Items()), item(km)))
+	}
+	return tea.Batch(cmds...)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const streamRetryDelay = 10 * time.Second
+
+// Killmails received from the server stream, read by the UI
+var liveKMs = make(chan common.EnrichedKMShort, 100)
+
+type killmailMsg common.EnrichedKMShort
+
+func waitForKillmail() tea.Msg {
+	return killmailMsg(<-liveKMs)
+}
+
+// streamKillmails follows the server stream, reconnecting after the last
+// received killmail when the connection drops.
+func streamKillmails() {
+	lastID := ""
+	for {
+		err := common.ReadKillmailStream(context.Background(), getBaseURL()+"/killmails/stream", lastID, func(ID string, km common.EnrichedKMShort) {
+			lastID = ID
+			liveKMs <- km
+		})
+		if *debug {
+			log.Println("stream:", err)
+		}
+		time.Sleep(streamRetryDelay)
+	}
+}
@@ -56,7 +56,7 @@ type model2 struct {
 }
 
 func (m model) Init() tea.Cmd {
-	return nil
+	return waitForKillmail
 }
 
 func (m model2) Init() tea.Cmd {
@@ -70,6 +70,12 @@ func (m model2) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	)
 	switch msg := msg.(type) {
 
+	case killmailMsg:
+		return m, addKillmail(&m.list, common.EnrichedKMShort(msg))
+
+	case pageMsg:
+		return m, addPage(&m.list, msg)
+
 	case tea.KeyMsg:
 		switch keypress := msg.String(); keypress {
 		case "b":
@@ -112,6 +118,12 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	switch msg := msg.(type) {
 
+	case killmailMsg:
+		return m, addKillmail(&m.list, common.EnrichedKMShort(msg))
+
+	case pageMsg:
+		return m, addPage(&m.list, msg)
+
 	case tea.KeyMsg:
 		if m.list.FilterState() == list.Filtering {
 			break
@@ -176,7 +188,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	var cmd tea.Cmd
 	m.list, cmd = m.list.Update(msg)
-	return m, cmd
+	return m, tea.Batch(cmd, loadMoreIfNeeded(&m.list))
 }
 
 func (m model) View() string {
@@ -186,11 +198,22 @@ func (m model) View() string {
 	return "\n" + m.list.View()
 }
 
+// New killmails go on top of the list, the ones already listed are skipped
+func addKillmail(l *list.Model, km common.EnrichedKMShort) tea.Cmd {
+	for _, listed := range l.Items() {
+		if listed.(item).ID == km.ID {
+			return waitForKillmail
+		}
+	}
+	return tea.Batch(l.InsertItem(0, item(km)), waitForKillmail)
+}
+
 type item common.EnrichedKMShort
 
 func (i item) FilterValue() string {
 	km := common.EnrichedKMShort(i)
 	res := formatKillmailShort(&km)
+	res += " " + km.Victim.AllianceName + " " + km.Attacker.AllianceName
 	return res
 }
 
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const maxAffiliationsPerRequest = 1000
+
+const directorRole = "Director"
+
+// refreshAffiliations updates the corporation of the characters of the tokens,
+// the Director role is checked again for those which changed.
+func refreshAffiliations(db *gorm.DB) error {
+	tokens, err := common.GetActiveTokens(db)
+	if err != nil {
+		return err
+	}
+	corporations := make(map[uint]uint)
+	IDs := []uint{}
+	for _, token := range *tokens {
+		if token.CharID == 0 {
+			continue
+		}
+		if _, ok := corporations[token.CharID]; !ok {
+			IDs = append(IDs, token.CharID)
+		}
+		corporations[token.CharID] = token.CorpID
+	}
+	for start := 0; start < len(IDs); start += maxAffiliationsPerRequest {
+		end := start + maxAffiliationsPerRequest
+		if end > len(IDs) {
+			end = len(IDs)
+		}
+		affiliations, err := getAffiliations(IDs[start:end])
+		if err != nil {
+			return err
+		}
+		for _, affiliation := range affiliations {
+			if affiliation.CorporationID == 0 || corporations[affiliation.CharacterID] == affiliation.CorporationID {
+				continue
+			}
+			fmt.Printf("Character %d moved from corporation %d to %d.\n", affiliation.CharacterID, corporations[affiliation.CharacterID], affiliation.CorporationID)
+			dbLock.Lock()
+			err := db.Model(&common.Token{}).Where("char_id = ?", affiliation.CharacterID).Updates(map[string]interface{}{"corp_id": affiliation.CorporationID, "director": false, "roles_checked_at": nil}).Error
+			dbLock.Unlock()
+			if err != nil {
+				return fmt.Errorf("unable to update corporation of character %d: %w", affiliation.CharacterID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func getAffiliations(IDs []uint) ([]common.CharacterAffiliation, error) {
+	IDsList, err := json.Marshal(IDs)
+	if err != nil {
+		return nil, err
+	}
+	limiter.Wait()
+	req, err := http.NewRequest("POST", common.EveApiAffiliationAPIUrl, bytes.NewReader(IDsList))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	resp, err := common.ESI.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid Status Code: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	affiliations := []common.CharacterAffiliation{}
+	err = json.Unmarshal(body, &affiliations)
+	if err != nil {
+		return nil, err
+	}
+	return affiliations, nil
+}
+
+// usesCorporationEndpoint tells whether the corporation killmails can be read
+// with the token, characters without the Director role only read their own.
+func usesCorporationEndpoint(db *gorm.DB, token *common.Token) (bool, error) {
+	if !token.ReadsCorporationKillmails() {
+		return false, nil
+	}
+	if token.RolesCheckedAt != nil && time.Since(*token.RolesCheckedAt) < rolesMaxAge {
+		return token.Director, nil
+	}
+	director := false
+	// Tokens registered before scopes were stored may still hold the scope
+	if token.Scopes == "" || token.HasScope(common.CorporationRolesScope) {
+		err := refreshExpiredToken(db, token)
+		if err != nil {
+			return false, err
+		}
+		director, err = getDirectorRole(token)
+		if err != nil {
+			// Checked again on the next round
+			fmt.Printf("Error while checking roles of char %d: %s\n", token.CharID, err)
+			return token.Director, nil
+		}
+	}
+	now := time.Now()
+	token.Director = director
+	token.RolesCheckedAt = &now
+	dbLock.Lock()
+	err := db.Save(token).Error
+	dbLock.Unlock()
+	if err != nil {
+		// Checked again on the next round
+		fmt.Printf("Error while saving roles of char %d: %s\n", token.CharID, err)
+	}
+	if !director {
+		fmt.Printf("Char %d is not a director of corporation %d, reading its own killmails.\n", token.CharID, token.CorpID)
+	}
+	return director, nil
+}
+
+func getDirectorRole(token *common.Token) (bool, error) {
+	limiter.Wait()
+	req, err := http.NewRequest("GET", fmt.Sprintf(common.EveApiCharacterRolesAPIUrl, token.CharID), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token.AccessToken)
+	resp, err := common.ESI.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("invalid Status Code: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	roles := common.CharacterRoles{}
+	err = json.Unmarshal(body, &roles)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles.Roles {
+		if role == directorRole {
+			return true, nil
+		}
+	}
+	return false, nil
+}
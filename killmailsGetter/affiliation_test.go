@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+func TestCorporationForbidden(t *testing.T) {
+	db := inTestDir(t)
+	db.AutoMigrate(&common.Token{})
+	maxAge := rolesMaxAge
+	rolesMaxAge = time.Hour
+	t.Cleanup(func() { rolesMaxAge = maxAge })
+	checked := time.Now()
+	token := common.Token{
+		AccessToken:    "access",
+		Exp:            uint(time.Now().Add(time.Hour).Unix()),
+		CharID:         2112000001,
+		CorpID:         homeCorporationID,
+		Scopes:         common.CorporationKillmailsScope + " " + common.CorporationRolesScope,
+		Director:       true,
+		RolesCheckedAt: &checked,
+	}
+	db.Create(&token)
+
+	requests := []string{}
+	useStubESI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer access" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		switch r.URL.Path {
+		case fmt.Sprintf("/latest/corporations/%d/killmails/recent", homeCorporationID):
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":"Character does not have required role(s)"}`)
+		case "/latest/characters/2112000001/killmails/recent":
+			fmt.Fprint(w, `[{"killmail_id":1001,"killmail_hash":"hash1001"}]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	kms, err := getKillmailIDsWithToken(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kms) != 1 || kms[0].ID != 1001 || kms[0].Hash != "hash1001" {
+		t.Errorf("got %+v, want the killmails of the character", kms)
+	}
+	if len(requests) != 2 {
+		t.Errorf("requests %v, want the corporation then the character killmails", requests)
+	}
+	saved := common.Token{}
+	db.First(&saved, token.ID)
+	if saved.Director || saved.RolesCheckedAt != nil {
+		t.Errorf("Director %t checked at %v, want the role to be checked again", saved.Director, saved.RolesCheckedAt)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const backfillBatchSize = 500
+
+func runBackfill(db *gorm.DB, path string, detailJobs chan<- detailJob) error {
+	content, err := readBackfillFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	source := hex.EncodeToString(sum[:])
+	kms, err := parseBackfillFile(content)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	backfill := common.Backfill{}
+	db.Where("source = ?", source).Find(&backfill)
+	if backfill.ID == 0 {
+		backfill = common.Backfill{Source: source, Path: path, Total: uint(len(kms))}
+		if err := db.Create(&backfill).Error; err != nil {
+			return fmt.Errorf("unable to record backfill: %w", err)
+		}
+	}
+	if backfill.CompletedAt != nil {
+		fmt.Printf("Backfill of %s already completed on %s.\n", path, backfill.CompletedAt.Format(time.RFC3339))
+		return nil
+	}
+	fmt.Printf("Backfilling %d killmails from %s, resuming at %d.\n", backfill.Total, path, backfill.Processed)
+	for backfill.Processed < backfill.Total {
+		end := backfill.Processed + backfillBatchSize
+		if end > backfill.Total {
+			end = backfill.Total
+		}
+		batch := filterStoredKms(db, kms[backfill.Processed:end])
+		_, err := enqueueKillmails(db, batch, false)
+		if err != nil {
+			return err
+		}
+		backfill.Processed = end
+		if err := db.Save(&backfill).Error; err != nil {
+			return fmt.Errorf("unable to record backfill progress: %w", err)
+		}
+		fmt.Printf("Backfill progress: %d/%d queued.\n", backfill.Processed, backfill.Total)
+	}
+	stored, failed := drainQueue(db, detailJobs, nil)
+	backfill.Stored += uint(stored)
+	backfill.Failed += uint(failed)
+	now := time.Now()
+	backfill.CompletedAt = &now
+	if err := db.Save(&backfill).Error; err != nil {
+		return fmt.Errorf("unable to record backfill completion: %w", err)
+	}
+	fmt.Printf("Backfill of %s done: %d stored, %d failed and left in the queue.\n", path, backfill.Stored, backfill.Failed)
+	return nil
+}
+
+func readBackfillFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	if len(content) > 2 && content[0] == 0x1f && content[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gzip %s: %w", path, err)
+		}
+		defer reader.Close()
+		content, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gzip %s: %w", path, err)
+		}
+	}
+	return content, nil
+}
+
+// Accepts zKillboard history dumps ({"id": "hash", ...}), lists of zKillboard
+// or ESI killmail references, and killmail_id,hash CSV files.
+func parseBackfillFile(content []byte) ([]common.Killmail, error) {
+	content = bytes.TrimSpace(content)
+	hashes := make(map[uint]string)
+	switch {
+	case len(content) == 0:
+	case content[0] == '{':
+		history := make(map[string]string)
+		if err := json.Unmarshal(content, &history); err != nil {
+			return nil, err
+		}
+		for idStr, hash := range history {
+			id, err := strconv.ParseUint(idStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid killmail ID %q", idStr)
+			}
+			hashes[uint(id)] = hash
+		}
+	case content[0] == '[':
+		refs := []struct {
+			KillmailID   uint   `json:"killmail_id"`
+			KillmailHash string `json:"killmail_hash"`
+			Zkb          struct {
+				Hash string `json:"hash"`
+			} `json:"zkb"`
+		}{}
+		if err := json.Unmarshal(content, &refs); err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			hash := ref.KillmailHash
+			if hash == "" {
+				hash = ref.Zkb.Hash
+			}
+			hashes[ref.KillmailID] = hash
+		}
+	default:
+		reader := csv.NewReader(bytes.NewReader(content))
+		reader.FieldsPerRecord = -1
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if len(record) < 2 {
+				return nil, fmt.Errorf("line %d: expected killmail_id,hash", i+1)
+			}
+			id, err := strconv.ParseUint(strings.TrimSpace(record[0]), 10, 64)
+			if err != nil {
+				if i == 0 {
+					continue
+				}
+				return nil, fmt.Errorf("line %d: invalid killmail ID %q", i+1, record[0])
+			}
+			hashes[uint(id)] = strings.TrimSpace(record[1])
+		}
+	}
+	res := []common.Killmail{}
+	for id, hash := range hashes {
+		if id == 0 || hash == "" {
+			return nil, fmt.Errorf("invalid killmail reference %d,%q", id, hash)
+		}
+		res = append(res, common.Killmail{ID: id, Hash: hash})
+	}
+	// Resuming relies on a stable order
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
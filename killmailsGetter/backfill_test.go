@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+func TestParseBackfillFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		err     bool
+	}{
+		{"empty", "  \n", "[]", false},
+		{"zKillboard history", `{"1002": "hash1002", "1001": "hash1001"}`, "[{1001 hash1001} {1002 hash1002}]", false},
+		{"zKillboard list", `[{"killmail_id": 1001, "zkb": {"hash": "hash1001"}}]`, "[{1001 hash1001}]", false},
+		{"ESI list", `[{"killmail_id": 1001, "killmail_hash": "hash1001"}]`, "[{1001 hash1001}]", false},
+		{"CSV with header", "killmail_id,hash\n1002, hash1002\n1001,hash1001\n", "[{1001 hash1001} {1002 hash1002}]", false},
+		{"CSV without header", "1001,hash1001\n", "[{1001 hash1001}]", false},
+		{"duplicate references", "1001,hash1001\n1001,hash1001\n", "[{1001 hash1001}]", false},
+		{"history with an invalid ID", `{"kill": "hash1001"}`, "", true},
+		{"CSV without hash", "1001\n", "", true},
+		{"CSV with an invalid ID", "1001,hash1001\nkill,hash1002\n", "", true},
+		{"zero ID", `[{"killmail_id": 0, "killmail_hash": "hash0"}]`, "", true},
+		{"empty hash", "1001,\n", "", true},
+		{"broken JSON", `[{"killmail_id": 1001`, "", true},
+	}
+	for _, test := range tests {
+		kms, err := parseBackfillFile([]byte(test.content))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: parsed %v, want an error", test.name, kms)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		refs := []string{}
+		for _, km := range kms {
+			refs = append(refs, fmt.Sprintf("{%d %s}", km.ID, km.Hash))
+		}
+		if got := fmt.Sprint(refs); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadBackfillArchive(t *testing.T) {
+	inTestDir(t)
+	content := []byte("1001,hash1001\n")
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(content)
+	writer.Close()
+	for path, data := range map[string][]byte{"refs.csv": content, "refs.csv.gz": compressed.Bytes()} {
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		read, err := readBackfillFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, content) {
+			t.Errorf("%s: read %q", path, read)
+		}
+	}
+	if _, err := readBackfillFile("missing.csv"); err == nil {
+		t.Error("a missing file was read")
+	}
+}
+
+func TestRunBackfillResumes(t *testing.T) {
+	db, feed, _ := newTestFeed(t)
+	db.AutoMigrate(&common.Backfill{})
+	for ID := uint(1001); ID <= 1004; ID++ {
+		feed.killmails[ID] = newTestKillmail(ID, jitaSystemID, 98000002, homeCorporationID)
+	}
+	content := []byte("killmail_id,hash\n1001,hash1001\n1002,hash1002\n1003,hash1003\n1004,hash1004\n")
+	if err := ioutil.WriteFile("refs.csv", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The first killmail was queued before an interruption, the third one
+	// was stored since by a token
+	sum := sha256.Sum256(content)
+	db.Create(&common.Backfill{Source: hex.EncodeToString(sum[:]), Path: "refs.csv", Total: 4, Processed: 1})
+	if _, err := enqueueKillmails(db, []common.Killmail{{ID: 1001, Hash: "hash1001"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeKillmails(db, []common.Killmail{feed.killmails[1003]}); err != nil {
+		t.Fatal(err)
+	}
+
+	detailJobs := make(chan detailJob)
+	defer close(detailJobs)
+	go detailWorker(detailJobs)
+	if err := runBackfill(db, "refs.csv", detailJobs); err != nil {
+		t.Fatal(err)
+	}
+	if IDs := getStoredIDs(db); fmt.Sprint(IDs) != "[1001 1002 1003 1004]" {
+		t.Errorf("stored %v", IDs)
+	}
+	if feed.fetched[1003] != 0 {
+		t.Error("the details of a stored killmail were fetched again")
+	}
+	backfill := common.Backfill{}
+	db.First(&backfill)
+	if backfill.Processed != 4 || backfill.Stored != 3 || backfill.Failed != 0 || backfill.CompletedAt == nil {
+		t.Errorf("backfill %+v, want 3 stored and completed", backfill)
+	}
+
+	// A completed file is not read again, under another name too
+	if err := ioutil.WriteFile("copy.csv", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBackfill(db, "copy.csv", detailJobs); err != nil {
+		t.Fatal(err)
+	}
+	for ID := uint(1001); ID <= 1004; ID++ {
+		if feed.fetched[ID] > 1 {
+			t.Errorf("killmail %d fetched %d times", ID, feed.fetched[ID])
+		}
+	}
+	var backfills int64
+	db.Model(&common.Backfill{}).Count(&backfills)
+	if backfills != 1 {
+		t.Errorf("%d backfills recorded, want 1", backfills)
+	}
+}
@@ -4,115 +4,264 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Pragmatic-Kernel/EveGonline/common"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+const maxNamesPerRequest = 1000
+
+// IDs ESI cannot resolve are asked again after this delay
+const unknownRetryDelay = 24 * time.Hour
+
+var errForbidden = errors.New("forbidden")
+
 var ClientId string
 var SecretKey string
+var limiter *rateLimiter
+var dbLock sync.Mutex
+var rolesMaxAge time.Duration
+
+type detailJob struct {
+	km     common.Killmail
+	result chan<- detailResult
+}
+
+type detailResult struct {
+	km  common.Killmail
+	err error
+}
 
 func main() {
+	backfill := flag.String("backfill", "", "import the killmail_id,hash pairs (or zKillboard JSON dump) from this file, then exit")
+	tokenWorkers := flag.Int("token-workers", 4, "number of tokens processed concurrently")
+	detailWorkers := flag.Int("detail-workers", 8, "number of killmail details fetched concurrently")
+	rate := flag.Int("rate", 10, "maximum ESI requests per second, shared by all workers")
+	rolesMaxAgeFlag := flag.Duration("roles-max-age", 24*time.Hour, "check again the Director role of corporation tokens older than this")
+	interval := flag.Duration("interval", 60*time.Minute, "time to wait between two rounds over all tokens")
+	namesMaxAge := flag.Duration("names-max-age", 7*24*time.Hour, "refresh character, corporation and alliance names older than this, 0 disables the refresh")
+	namesInterval := flag.Duration("names-interval", 60*time.Minute, "time to wait between two names refreshes")
+	redisqURL := flag.String("redisq-url", "", "RedisQ feed to follow in addition to the tokens, empty to disable")
+	redisqCharacters := flag.String("redisq-characters", "", "comma separated character IDs of the feed killmails to keep")
+	redisqCorporations := flag.String("redisq-corporations", "", "comma separated corporation IDs of the feed killmails to keep")
+	redisqAlliances := flag.String("redisq-alliances", "", "comma separated alliance IDs of the feed killmails to keep")
+	redisqRegions := flag.String("redisq-regions", "", "comma separated region IDs of the feed killmails to keep")
+	flag.Parse()
 	ClientId = os.Getenv("CLIENT_ID")
 	SecretKey = os.Getenv("SECRET_KEY")
 	if ClientId == "" || SecretKey == "" {
 		panic("Missing CLIENT_ID or SECRET_KEY env variable")
 	}
-	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
-	db.AutoMigrate(&common.Mapping{}, &common.Token{}, &common.Killmail{}, &common.Attacker{}, &common.Victim{}, &common.Item{}, &common.SubItem{}, &common.Position{}, &common.SolarSystem{}, &common.Asset{})
-	db.Exec("PRAGMA foreign_keys = ON")
+	if *tokenWorkers < 1 || *detailWorkers < 1 || *rate < 1 {
+		panic("token-workers, detail-workers and rate must be positive")
+	}
+	rolesMaxAge = *rolesMaxAgeFlag
+	db, err := gorm.Open(sqlite.Open("test.db?_foreign_keys=on&_busy_timeout=5000"), &gorm.Config{})
 	if err != nil {
 		panic(err)
 	}
+	if err := common.MigrateTokens(db); err != nil {
+		panic(err)
+	}
+	db.AutoMigrate(&common.Mapping{}, &common.Killmail{}, &common.Attacker{}, &common.Victim{}, &common.Item{}, &common.SubItem{}, &common.Position{}, &common.SolarSystem{}, &common.Region{}, &common.Constellation{}, &common.Asset{}, &common.Backfill{}, &common.PendingKillmail{}, &common.NameHistory{}, &common.KillmailSource{})
+	limiter = newRateLimiter(*rate, *rate)
+	detailJobs := make(chan detailJob)
+	for i := 0; i < *detailWorkers; i++ {
+		go detailWorker(detailJobs)
+	}
+	if *backfill != "" {
+		err := runBackfill(db, *backfill, detailJobs)
+		if err != nil {
+			fmt.Println("ERROR during backfill:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	var feed *feedFilter
+	if *redisqURL != "" {
+		feed, err = getFeedFilter(db, *redisqCharacters, *redisqCorporations, *redisqAlliances, *redisqRegions)
+		if err != nil {
+			panic(err)
+		}
+		go followRedisQ(db, *redisqURL, feed)
+	}
+	if *namesMaxAge > 0 {
+		go scheduleNamesRefresh(db, *namesMaxAge, *namesInterval)
+	}
 	for {
-		tokens, err := common.GetTokens(db)
-		fmt.Printf("Found %d tokens\n", len(*tokens))
+		identifyLegacyTokens(db)
+		err := refreshAffiliations(db)
+		if err != nil {
+			fmt.Println("ERROR refreshing affiliations:", err)
+		}
+		tokens, err := common.GetActiveTokens(db)
 		if err != nil {
 			panic(err)
 		}
+		fmt.Printf("Found %d tokens\n", len(*tokens))
+		tokenJobs := make(chan common.Token)
+		wg := sync.WaitGroup{}
+		for i := 0; i < *tokenWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for token := range tokenJobs {
+					processToken(db, token)
+				}
+			}()
+		}
 		for _, token := range *tokens {
-			mappings, err := common.GetMappings(db)
-			fmt.Printf("Found %d mappings\n", len(mappings))
-			if err != nil {
-				panic(err)
-			}
-			unknownIDs := []uint{}
-			existingKms := []common.Killmail{}
-			db.Select("id").Find(&existingKms)
-			existingKmIds := getExistingKmIds(&existingKms)
-			fmt.Printf("Found %d Killmails\n", len(existingKmIds))
-			fmt.Printf("Retrieving KM IDs for token: %d\n", token.ID)
-			newKms, err := getKillmailIDsWithToken(db, token)
+			tokenJobs <- token
+		}
+		close(tokenJobs)
+		wg.Wait()
+		stored, failed := drainQueue(db, detailJobs, feed)
+		fmt.Printf("Queue drained: %d killmails stored, %d failed.\n", stored, failed)
+		fmt.Printf("All tokens done. Sleeping for %s.\n", *interval)
+		time.Sleep(*interval)
+	}
+}
+
+func detailWorker(jobs <-chan detailJob) {
+	for job := range jobs {
+		err := getKillmailDetails(&job.km)
+		job.result <- detailResult{km: job.km, err: err}
+	}
+}
+
+func processToken(db *gorm.DB, token common.Token) {
+	existingKms := []common.Killmail{}
+	db.Select("id").Find(&existingKms)
+	existingKmIds := getExistingKmIds(&existingKms)
+	fmt.Printf("Found %d Killmails\n", len(existingKmIds))
+	fmt.Printf("Retrieving KM IDs for token: %d\n", token.ID)
+	newKms, err := getKillmailIDsWithToken(db, token)
+	if err != nil {
+		fmt.Println("Error while retrieving KM IDs:", err)
+		return
+	}
+	err = recordKillmailSources(db, token, newKms)
+	if err != nil {
+		fmt.Println("Error while recording KM sources:", err)
+	}
+	filteredKms := []common.Killmail{}
+	for _, km := range newKms {
+		if _, ok := existingKmIds[km.ID]; ok {
+			continue
+		} else {
+			filteredKms = append(filteredKms, km)
+		}
+	}
+	fmt.Printf("Killmails post filtering: %d\n", len(filteredKms))
+	queued, err := enqueueKillmails(db, filteredKms, false)
+	if err != nil {
+		fmt.Println("Error while queuing killmails:", err)
+		return
+	}
+	fmt.Printf("Token %d done, %d killmails queued.\n", token.ID, queued)
+}
+
+func fetchKillmailDetails(kms []common.Killmail, detailJobs chan<- detailJob) ([]common.Killmail, map[uint]error) {
+	results := make(chan detailResult, len(kms))
+	go func() {
+		for _, km := range kms {
+			detailJobs <- detailJob{km: km, result: results}
+		}
+	}()
+	res := []common.Killmail{}
+	failures := make(map[uint]error)
+	for range kms {
+		result := <-results
+		if result.err != nil {
+			fmt.Println("Error while retrieving KM Details:", result.err)
+			failures[result.km.ID] = result.err
+			continue
+		}
+		res = append(res, result.km)
+	}
+	return res, failures
+}
+
+func storeKillmails(db *gorm.DB, KMsToCreate []common.Killmail) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	// Another worker may have stored the same killmails in the meantime
+	KMsToCreate = filterStoredKms(db, KMsToCreate)
+	mappings, err := common.GetMappings(db)
+	fmt.Printf("Found %d mappings\n", len(mappings))
+	if err != nil {
+		return err
+	}
+	unknownIDs := []uint{}
+	for _, km := range KMsToCreate {
+		unknownIDs = append(unknownIDs, getUnknownIDs(&km, mappings)...)
+	}
+	unknownIDs = filterUnknownIDs(unknownIDs, getUnresolvableIDs(db))
+	if len(unknownIDs) > 0 {
+		IDsmappings, unresolvable, err := retrieveUnknownIDs(unknownIDs)
+		if err != nil {
+			return fmt.Errorf("error while retrieving unknownIDs: %w", err)
+		}
+		retryAfter := time.Now().Add(unknownRetryDelay)
+		for _, ID := range unresolvable {
+			*IDsmappings = append(*IDsmappings, common.Mapping{ID: ID, Category: common.CategoryUnknown, RetryAfter: &retryAfter})
+		}
+		if len(*IDsmappings) > 0 {
+			// IDs soft-deleted by the SDE importer are known again under the category ESI reports
+			err = db.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"name", "category", "retry_after", "updated_at", "deleted_at"}),
+			}).CreateInBatches(IDsmappings, 500).Error
 			if err != nil {
-				fmt.Println("Error while retrieving KM IDs:", err)
-				continue
-			}
-			filteredKms := []common.Killmail{}
-			for _, km := range newKms {
-				if _, ok := existingKmIds[km.ID]; ok {
-					continue
-				} else {
-					filteredKms = append(filteredKms, km)
-				}
-			}
-			fmt.Printf("Killmails post filtering: %d\n", len(filteredKms))
-			if len(filteredKms) > 10 {
-				filteredKms = filteredKms[:10]
-			}
-			KMsToCreate := []common.Killmail{}
-			for _, km := range filteredKms {
-				err := getKillmailDetails(&km)
-				if err != nil {
-					fmt.Println("Error while retrieving KM Details:", err)
-					continue
-				}
-				KMsToCreate = append(KMsToCreate, km)
-				unknownIDsKM := getUnknownIDs(&km, mappings)
-				unknownIDs = append(unknownIDs, unknownIDsKM...)
-				if len(unknownIDs) > 100 {
-					fmt.Printf("We have %d unkown items to retrieve, breaking loop.\n", len(unknownIDs))
-					break
-				}
-			}
-			if len(unknownIDs) > 0 {
-				IDsmappings, err := retrieveUnknownIDs(unknownIDs)
-				if err != nil {
-					fmt.Printf("Error while retrieving unknownIDs, skipping.\n")
-					// Ignore currently fetched KMs, and try again later
-					continue
-				} else {
-					db.Create(IDsmappings)
-				}
-			}
-			if len(KMsToCreate) > 0 {
-				db.Create(&KMsToCreate)
-			} else {
-				fmt.Println("No killmails to save, skipping.")
+				return fmt.Errorf("error while saving mappings: %w", err)
 			}
-			fmt.Printf("Token %d done. Sleeping for %d minute.\n", token.ID, 1)
-			time.Sleep(1 * time.Minute)
 		}
-		fmt.Printf("All tokens done. Sleeping for %d minutes.\n", 60)
-		time.Sleep(60 * time.Minute)
 	}
+	if len(KMsToCreate) > 0 {
+		err = db.Create(&KMsToCreate).Error
+		if err != nil {
+			return fmt.Errorf("error while saving killmails: %w", err)
+		}
+	} else {
+		fmt.Println("No killmails to save, skipping.")
+	}
+	return nil
 }
 
 func getKillmailIDsWithToken(db *gorm.DB, token common.Token) ([]common.Killmail, error) {
-	res := []common.Killmail{}
-	var url string
-	if token.CorpID != 0 {
-		url = fmt.Sprintf(common.EveApiKillmailCorpAPIUrl, token.CorpID)
-		fmt.Println(url)
-	} else {
-		url = fmt.Sprintf(common.EveApiKillmailCharAPIUrl, token.CharID)
-		fmt.Println(url)
+	corporation, err := usesCorporationEndpoint(db, &token)
+	if err != nil {
+		return nil, err
 	}
+	if corporation {
+		res, err := getRecentKillmails(db, &token, fmt.Sprintf(common.EveApiKillmailCorpAPIUrl, token.CorpID))
+		if !errors.Is(err, errForbidden) {
+			return res, err
+		}
+		// The Director role was lost since it was checked
+		fmt.Printf("Char %d can no longer read the killmails of corporation %d, reading its own.\n", token.CharID, token.CorpID)
+		token.Director = false
+		token.RolesCheckedAt = nil
+		dbLock.Lock()
+		db.Save(&token)
+		dbLock.Unlock()
+	}
+	return getRecentKillmails(db, &token, fmt.Sprintf(common.EveApiKillmailCharAPIUrl, token.CharID))
+}
+
+func getRecentKillmails(db *gorm.DB, token *common.Token, url string) ([]common.Killmail, error) {
+	res := []common.Killmail{}
+	fmt.Println(url)
 	body, err := common.GetCache(url, "recent", 86400)
 	if err != nil {
 		if err == common.ErrCacheExpired {
@@ -131,26 +280,24 @@ func getKillmailIDsWithToken(db *gorm.DB, token common.Token) ([]common.Killmail
 		}
 		return res, nil
 	}
-	if int64(token.Exp) < time.Now().Unix() {
-		err := common.RefreshToken(&token, ClientId, SecretKey)
-		if err != nil {
-			fmt.Println("Error while refreshing token:", err)
-			fmt.Println("WARNING: Potentially revoked token for char: ", token.CharID)
-			return nil, err
-		}
-		db.Save(&token)
+	err = refreshExpiredToken(db, token)
+	if err != nil {
+		return nil, err
 	}
+	limiter.Wait()
 	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", "Bearer "+token.AccessToken)
-	req.Header.Add("User-Agent", "CharName: Laszlo Bariani")
 	if err != nil {
 		return res, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Add("Authorization", "Bearer "+token.AccessToken)
+	resp, err := common.ESI.Do(req)
 	if err != nil {
 		return res, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden {
+		return res, fmt.Errorf("%w: %s", errForbidden, resp.Status)
+	}
 	if resp.StatusCode != 200 {
 		return res, fmt.Errorf("invalid Status Code: %s", resp.Status)
 	}
@@ -168,6 +315,58 @@ func getKillmailIDsWithToken(db *gorm.DB, token common.Token) ([]common.Killmail
 	return res, nil
 }
 
+func refreshExpiredToken(db *gorm.DB, token *common.Token) error {
+	if int64(token.Exp) >= time.Now().Unix() {
+		return nil
+	}
+	limiter.Wait()
+	err := common.RefreshToken(token, ClientId, SecretKey)
+	token.RecordRefresh(err)
+	dbLock.Lock()
+	db.Save(token)
+	dbLock.Unlock()
+	if err != nil {
+		fmt.Println("Error while refreshing token:", err)
+		if token.Disabled() {
+			fmt.Printf("WARNING: Token %d of char %d disabled, %s.\n", token.ID, token.CharID, token.Status)
+		}
+		return err
+	}
+	return nil
+}
+
+// identifyLegacyTokens refreshes the tokens registered without their
+// character, which takes it from the JWT. A character already registered
+// keeps its newer token.
+func identifyLegacyTokens(db *gorm.DB) {
+	tokens := []common.Token{}
+	db.Where("char_id = 0 AND COALESCE(status, '') NOT IN ?", []string{common.TokenRevoked, common.TokenTransferred}).Find(&tokens)
+	for _, token := range tokens {
+		limiter.Wait()
+		err := common.RefreshToken(&token, ClientId, SecretKey)
+		token.RecordRefresh(err)
+		dbLock.Lock()
+		if err != nil {
+			fmt.Printf("Error while identifying token %d: %s\n", token.ID, err)
+			db.Save(&token)
+			dbLock.Unlock()
+			continue
+		}
+		var registered int64
+		db.Model(&common.Token{}).Where("char_id = ?", token.CharID).Count(&registered)
+		if registered > 0 {
+			fmt.Printf("Token %d of char %d is already registered, removing it.\n", token.ID, token.CharID)
+			db.Delete(&common.Token{}, token.ID)
+		} else {
+			fmt.Printf("Token %d belongs to char %d.\n", token.ID, token.CharID)
+			if err := db.Save(&token).Error; err != nil {
+				fmt.Printf("Error while saving token %d: %s\n", token.ID, err)
+			}
+		}
+		dbLock.Unlock()
+	}
+}
+
 func getExistingKmIds(kms *[]common.Killmail) map[uint]bool {
 	res := make(map[uint]bool)
 	for _, km := range *kms {
@@ -176,6 +375,26 @@ func getExistingKmIds(kms *[]common.Killmail) map[uint]bool {
 	return res
 }
 
+func filterStoredKms(db *gorm.DB, kms []common.Killmail) []common.Killmail {
+	ids := []uint{}
+	for _, km := range kms {
+		ids = append(ids, km.ID)
+	}
+	if len(ids) == 0 {
+		return kms
+	}
+	storedKms := []common.Killmail{}
+	db.Select("id").Where("id IN ?", ids).Find(&storedKms)
+	storedKmIds := getExistingKmIds(&storedKms)
+	res := []common.Killmail{}
+	for _, km := range kms {
+		if !storedKmIds[km.ID] {
+			res = append(res, km)
+		}
+	}
+	return res
+}
+
 func getKillmailDetails(km *common.Killmail) error {
 	id := km.ID
 	hash := km.Hash
@@ -190,13 +409,12 @@ func getKillmailDetails(km *common.Killmail) error {
 		}
 		return nil
 	}
-
+	limiter.Wait()
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Add("User-Agent", "CharName: Laszlo Bariani")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := common.ESI.Do(req)
 	if err != nil {
 		return err
 	}
@@ -216,8 +434,7 @@ func getKillmailDetails(km *common.Killmail) error {
 	if err := json.Unmarshal(body, km); err != nil {
 		return err
 	}
-	fmt.Printf("KM %d done. Sleeping for %d seconds.\n", km.ID, 10)
-	time.Sleep(10 * time.Second)
+	fmt.Printf("KM %d done.\n", km.ID)
 	return nil
 }
 
@@ -230,6 +447,12 @@ func getUnknownIDs(km *common.Killmail, mapping map[uint]string) []uint {
 		if _, ok := mapping[attacker.CorporationID]; !ok {
 			res = append(res, attacker.CorporationID)
 		}
+		if _, ok := mapping[attacker.AllianceID]; !ok {
+			res = append(res, attacker.AllianceID)
+		}
+		if _, ok := mapping[attacker.FactionID]; !ok {
+			res = append(res, attacker.FactionID)
+		}
 		if _, ok := mapping[attacker.ShipTypeID]; !ok {
 			res = append(res, attacker.ShipTypeID)
 		}
@@ -243,6 +466,15 @@ func getUnknownIDs(km *common.Killmail, mapping map[uint]string) []uint {
 	if _, ok := mapping[km.Victim.CorporationID]; !ok {
 		res = append(res, km.Victim.CorporationID)
 	}
+	if _, ok := mapping[km.Victim.AllianceID]; !ok {
+		res = append(res, km.Victim.AllianceID)
+	}
+	if _, ok := mapping[km.Victim.FactionID]; !ok {
+		res = append(res, km.Victim.FactionID)
+	}
+	if _, ok := mapping[km.Victim.ShipTypeID]; !ok {
+		res = append(res, km.Victim.ShipTypeID)
+	}
 	if km.Victim.Items != nil {
 		for _, item := range *km.Victim.Items {
 			if _, ok := mapping[item.ItemTypeID]; !ok {
@@ -257,65 +489,114 @@ func getUnknownIDs(km *common.Killmail, mapping map[uint]string) []uint {
 			}
 		}
 	}
-	res = filterUnknownIDs(res)
+	res = filterUnknownIDs(res, nil)
 	return res
 }
 
-func retrieveUnknownIDs(unknownIDs []uint) (*[]common.Mapping, error) {
+// retrieveUnknownIDs returns the names of the IDs, and the IDs ESI cannot
+// resolve
+func retrieveUnknownIDs(unknownIDs []uint) (*[]common.Mapping, []uint, error) {
 	mappings := []common.Mapping{}
+	unresolvable := []uint{}
 	fmt.Printf("Need to retrieve %d IDs.\n", len(unknownIDs))
-	unknownIDs = filterUnknownIDs(unknownIDs)
-	fmt.Printf("Need to retrieve %d filtered IDs.\n", len(unknownIDs))
-	if len(unknownIDs) > 200 {
-		return nil, errors.New("too many IDs, skipping")
+	IDs := []uint{}
+	for _, ID := range filterUnknownIDs(unknownIDs, nil) {
+		// ESI only takes 32 bit IDs, a larger one would fail the whole request
+		if ID > math.MaxInt32 {
+			fmt.Printf("ID %d is out of range, skipping.\n", ID)
+			unresolvable = append(unresolvable, ID)
+			continue
+		}
+		IDs = append(IDs, ID)
+	}
+	fmt.Printf("Need to retrieve %d filtered IDs.\n", len(IDs))
+	for start := 0; start < len(IDs); start += maxNamesPerRequest {
+		end := start + maxNamesPerRequest
+		if end > len(IDs) {
+			end = len(IDs)
+		}
+		chunk, skipped, err := retrieveNames(IDs[start:end])
+		if err != nil {
+			return nil, nil, err
+		}
+		mappings = append(mappings, chunk...)
+		unresolvable = append(unresolvable, skipped...)
 	}
-	IDsList, err := json.Marshal(unknownIDs)
+	return &mappings, unresolvable, nil
+}
+
+// ESI rejects the whole request when one ID is invalid, the chunk is split
+// until the invalid IDs are isolated and returned apart.
+func retrieveNames(IDs []uint) ([]common.Mapping, []uint, error) {
+	mappings := []common.Mapping{}
+	IDsList, err := json.Marshal(IDs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	fmt.Println("To retrieve:", string(IDsList))
+	fmt.Printf("Retrieving %d names.\n", len(IDs))
+	limiter.Wait()
 	req, err := http.NewRequest("POST", common.EveApiNamesAPIUrl, bytes.NewReader(IDsList))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	req.Header.Add("User-Agent", "CharName: Laszlo Bariani")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := common.ESI.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		if len(IDs) == 1 {
+			fmt.Printf("ID %d cannot be resolved, skipping.\n", IDs[0])
+			return mappings, IDs, nil
+		}
+		left, leftSkipped, err := retrieveNames(IDs[:len(IDs)/2])
+		if err != nil {
+			return nil, nil, err
+		}
+		right, rightSkipped, err := retrieveNames(IDs[len(IDs)/2:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return append(left, right...), append(leftSkipped, rightSkipped...), nil
 	}
 	if resp.StatusCode != 200 {
 		fmt.Printf("Status code %d in body\n", resp.StatusCode)
-		return nil, errors.New("invalid Status Code")
+		return nil, nil, errors.New("invalid Status Code")
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	err = json.Unmarshal(body, &mappings)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &mappings, nil
+	return mappings, []uint{}, nil
 }
 
-func filterUnknownIDs(unknownIDs []uint) []uint {
+// getUnresolvableIDs returns the IDs ESI could not resolve, until they are
+// due for another try
+func getUnresolvableIDs(db *gorm.DB) map[uint]bool {
+	res := make(map[uint]bool)
+	IDs := []uint{}
+	db.Model(&common.Mapping{}).Where("category = ? AND retry_after > ?", common.CategoryUnknown, time.Now()).Pluck("id", &IDs)
+	for _, ID := range IDs {
+		res[ID] = true
+	}
+	return res
+}
+
+func filterUnknownIDs(unknownIDs []uint, unresolvable map[uint]bool) []uint {
 	res := []uint{}
+	seen := make(map[uint]bool)
 	for _, elem := range unknownIDs {
-		if elem == 0 || contains(elem, res) {
+		if elem == 0 || seen[elem] || unresolvable[elem] {
 			continue
 		}
+		seen[elem] = true
 		res = append(res, elem)
 	}
 	return res
 }
-
-func contains(id uint, ids []uint) bool {
-	for _, elem2 := range ids {
-		if id == elem2 {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+func TestConcurrentTokens(t *testing.T) {
+	db, feed, _ := newTestFeed(t)
+	db.AutoMigrate(&common.Token{}, &common.KillmailSource{})
+	// Pilots of the same fleets report the same killmails
+	for ID := uint(1001); ID <= 1010; ID++ {
+		feed.killmails[ID] = newTestKillmail(ID, jitaSystemID, 98000002, homeCorporationID)
+	}
+	tokens := []common.Token{}
+	for i := uint(0); i < 6; i++ {
+		token := common.Token{
+			AccessToken: "access",
+			Exp:         uint(time.Now().Add(time.Hour).Unix()),
+			CharID:      2112000001 + i,
+			CorpID:      homeCorporationID,
+			Scopes:      "esi-killmails.read_killmails.v1",
+		}
+		db.Create(&token)
+		tokens = append(tokens, token)
+		for ID := 1001 + i; ID <= 1005+i; ID++ {
+			feed.recent[token.CharID] = append(feed.recent[token.CharID], ID)
+		}
+	}
+
+	tokenJobs := make(chan common.Token)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for token := range tokenJobs {
+				processToken(db, token)
+			}
+		}()
+	}
+	for _, token := range tokens {
+		tokenJobs <- token
+	}
+	close(tokenJobs)
+	wg.Wait()
+	var queued int64
+	db.Model(&common.PendingKillmail{}).Count(&queued)
+	if queued != 10 {
+		t.Errorf("%d killmails queued, want 10", queued)
+	}
+	var sources int64
+	db.Model(&common.KillmailSource{}).Count(&sources)
+	if sources != 30 {
+		t.Errorf("%d killmail sources, want 5 per token", sources)
+	}
+
+	// Workers storing the same details at once store each killmail once
+	detailJobs := make(chan detailJob)
+	defer close(detailJobs)
+	go detailWorker(detailJobs)
+	kms := []common.Killmail{}
+	for ID := uint(1001); ID <= 1010; ID++ {
+		kms = append(kms, common.Killmail{ID: ID, Hash: fmt.Sprintf("hash%d", ID)})
+	}
+	details, failures := fetchKillmailDetails(kms, detailJobs)
+	if len(failures) != 0 {
+		t.Fatalf("%d failed details", len(failures))
+	}
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- storeKillmails(db, details)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	stored, failed := drainQueue(db, detailJobs, nil)
+	if stored != 10 || failed != 0 {
+		t.Errorf("drained %d stored %d failed, want the queue emptied", stored, failed)
+	}
+	var victims int64
+	db.Model(&common.Victim{}).Count(&victims)
+	if IDs := getStoredIDs(db); len(IDs) != 10 || victims != 10 {
+		t.Errorf("stored %v with %d victims, want each killmail once", IDs, victims)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const namesRefreshBatchSize = 1000
+
+var refreshedCategories = []string{common.CategoryCharacter, common.CategoryCorporation, common.CategoryAlliance}
+
+func scheduleNamesRefresh(db *gorm.DB, maxAge time.Duration, interval time.Duration) {
+	for {
+		checked, renamed, err := refreshNames(db, maxAge)
+		if err != nil {
+			fmt.Println("ERROR refreshing names:", err)
+		} else if checked > 0 {
+			fmt.Printf("Names refreshed: %d checked, %d renamed.\n", checked, renamed)
+		}
+		// Keep going while the backlog of stale names is not cleared
+		if checked < namesRefreshBatchSize || err != nil {
+			time.Sleep(interval)
+		}
+	}
+}
+
+func refreshNames(db *gorm.DB, maxAge time.Duration) (int, int, error) {
+	stale := []common.Mapping{}
+	err := db.Where("category IN ? AND updated_at < ?", refreshedCategories, time.Now().Add(-maxAge)).Order("updated_at").Limit(namesRefreshBatchSize).Find(&stale).Error
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to get stale names: %w", err)
+	}
+	if len(stale) == 0 {
+		return 0, 0, nil
+	}
+	IDs := []uint{}
+	for _, mapping := range stale {
+		IDs = append(IDs, mapping.ID)
+	}
+	resolved, _, err := retrieveUnknownIDs(IDs)
+	if err != nil {
+		return 0, 0, err
+	}
+	current := make(map[uint]common.Mapping)
+	for _, mapping := range *resolved {
+		current[mapping.ID] = mapping
+	}
+	for _, mapping := range stale {
+		if _, ok := current[mapping.ID]; ok || mapping.Category != common.CategoryCharacter {
+			continue
+		}
+		// Names cannot resolve some characters, their public info still can
+		limiter.Wait()
+		character, err := common.GetCharacter(mapping.ID)
+		if err != nil {
+			fmt.Printf("Character %d cannot be resolved: %s\n", mapping.ID, err)
+			continue
+		}
+		current[mapping.ID] = common.Mapping{ID: mapping.ID, Category: common.CategoryCharacter, Name: character.Name}
+	}
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	renamed := 0
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, mapping := range stale {
+			latest, ok := current[mapping.ID]
+			if !ok || latest.Name == "" || latest.Name == mapping.Name {
+				continue
+			}
+			if latest.Category != mapping.Category {
+				fmt.Printf("ERROR ID %d is mapped as %s but ESI reports a %s, skipping.\n", mapping.ID, mapping.Category, latest.Category)
+				continue
+			}
+			history := common.NameHistory{EntityID: mapping.ID, Category: mapping.Category, Name: mapping.Name, Until: now}
+			if err := tx.Create(&history).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&mapping).Update("name", latest.Name).Error; err != nil {
+				return err
+			}
+			fmt.Printf("%s %d renamed from %q to %q.\n", mapping.Category, mapping.ID, mapping.Name, latest.Name)
+			renamed++
+		}
+		// Unresolved names are checked again after maxAge as well
+		return tx.Model(&common.Mapping{}).Where("id IN ?", IDs).Update("updated_at", now).Error
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to save refreshed names: %w", err)
+	}
+	return len(stale), renamed, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+// stubNames resolves the IDs of a request unless one of them is invalid
+type stubNames struct {
+	lock     sync.Mutex
+	invalid  map[uint]bool
+	requests [][]uint
+}
+
+func (s *stubNames) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	IDs := []uint{}
+	if err := json.NewDecoder(r.Body).Decode(&IDs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, IDs)
+	names := []common.Mapping{}
+	for _, ID := range IDs {
+		if s.invalid[ID] || ID > 2147483647 {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"Ensure all IDs are valid before resolving."}`)
+			return
+		}
+		names = append(names, common.Mapping{ID: ID, Category: common.CategoryCharacter, Name: fmt.Sprintf("Pilot %d", ID)})
+	}
+	json.NewEncoder(w).Encode(names)
+}
+
+// asked returns the IDs sent since the last call
+func (s *stubNames) asked() []uint {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	IDs := []uint{}
+	for _, request := range s.requests {
+		IDs = append(IDs, request...)
+	}
+	s.requests = nil
+	sort.Slice(IDs, func(i, j int) bool { return IDs[i] < IDs[j] })
+	return IDs
+}
+
+func TestRetrieveNamesBisection(t *testing.T) {
+	stub := &stubNames{invalid: map[uint]bool{2112000003: true, 2112000006: true}}
+	useStubESI(t, stub)
+	IDs := []uint{}
+	for ID := uint(2112000001); ID <= 2112000008; ID++ {
+		IDs = append(IDs, ID)
+	}
+	mappings, unresolvable, err := retrieveUnknownIDs(append(IDs, 4294967296, 0, 2112000001))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*mappings) != 6 {
+		t.Errorf("resolved %v, want 6 names", *mappings)
+	}
+	sort.Slice(unresolvable, func(i, j int) bool { return unresolvable[i] < unresolvable[j] })
+	if fmt.Sprint(unresolvable) != "[2112000003 2112000006 4294967296]" {
+		t.Errorf("unresolvable %v", unresolvable)
+	}
+	stub.lock.Lock()
+	requests := len(stub.requests)
+	for _, request := range stub.requests {
+		for _, ID := range request {
+			if ID > 2147483647 {
+				t.Errorf("out of range ID %d posted", ID)
+			}
+		}
+	}
+	stub.lock.Unlock()
+	// 8, 4 and 4, then 2 and 2 on each side, then 1 and 1 on each side
+	if requests != 11 {
+		t.Errorf("%d requests, want 11", requests)
+	}
+}
+
+func TestStoreKillmailsRemembersUnknownIDs(t *testing.T) {
+	db := inTestDir(t)
+	db.AutoMigrate(&common.Mapping{}, &common.Killmail{}, &common.Attacker{}, &common.Victim{}, &common.Item{}, &common.SubItem{}, &common.Position{})
+	stub := &stubNames{invalid: map[uint]bool{2112000003: true}}
+	useStubESI(t, stub)
+	for ID := uint(587); ID <= 620; ID += 33 {
+		db.Create(&common.Mapping{ID: ID, Category: common.CategoryInventoryType, Name: fmt.Sprintf("Type %d", ID)})
+	}
+	db.Create(&common.Mapping{ID: 98000002, Category: common.CategoryCorporation, Name: "Corp"})
+	db.Create(&common.Mapping{ID: homeCorporationID, Category: common.CategoryCorporation, Name: "Home"})
+
+	km := newTestKillmail(1001, jitaSystemID, 98000002, homeCorporationID)
+	km.Victim.CharacterID = 2112000001
+	(*km.Attackers)[0].CharacterID = 2112000003
+	if err := storeKillmails(db, []common.Killmail{km}); err != nil {
+		t.Fatal(err)
+	}
+	if asked := stub.asked(); fmt.Sprint(asked) != "[2112000001 2112000001 2112000003 2112000003]" {
+		t.Errorf("asked %v, want both IDs, then each of them", asked)
+	}
+	unknown := common.Mapping{}
+	db.First(&unknown, 2112000003)
+	if unknown.Category != common.CategoryUnknown || unknown.RetryAfter == nil || unknown.RetryAfter.Before(time.Now().Add(unknownRetryDelay-time.Minute)) {
+		t.Errorf("unresolvable ID stored as %+v", unknown)
+	}
+	if mappings, _ := common.GetMappings(db); mappings[2112000001] != "Pilot 2112000001" {
+		t.Errorf("mappings %v", mappings)
+	}
+
+	// The unresolvable ID is not asked again before its retry time
+	km = newTestKillmail(1002, jitaSystemID, 98000002, homeCorporationID)
+	km.Victim.CharacterID = 2112000001
+	(*km.Attackers)[0].CharacterID = 2112000003
+	if err := storeKillmails(db, []common.Killmail{km}); err != nil {
+		t.Fatal(err)
+	}
+	if asked := stub.asked(); len(asked) != 0 {
+		t.Errorf("asked %v, want nothing", asked)
+	}
+
+	// Once resolvable, it gets its name
+	db.Model(&common.Mapping{}).Where("id = ?", 2112000003).Update("retry_after", time.Now().Add(-time.Minute))
+	stub.lock.Lock()
+	stub.invalid = nil
+	stub.lock.Unlock()
+	km = newTestKillmail(1003, jitaSystemID, 98000002, homeCorporationID)
+	(*km.Attackers)[0].CharacterID = 2112000003
+	if err := storeKillmails(db, []common.Killmail{km}); err != nil {
+		t.Fatal(err)
+	}
+	if asked := stub.asked(); fmt.Sprint(asked) != "[2112000003]" {
+		t.Errorf("asked %v, want the unresolvable ID again", asked)
+	}
+	db.First(&unknown, 2112000003)
+	if unknown.Category != common.CategoryCharacter || unknown.Name != "Pilot 2112000003" || unknown.RetryAfter != nil {
+		t.Errorf("resolved ID stored as %+v", unknown)
+	}
+}
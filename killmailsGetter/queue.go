@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const queueBatchSize = 100
+const maxQueueBackoff = 24 * time.Hour
+
+func enqueueKillmails(db *gorm.DB, kms []common.Killmail, unfiltered bool) (int, error) {
+	if len(kms) == 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	pending := []common.PendingKillmail{}
+	for _, km := range kms {
+		pending = append(pending, common.PendingKillmail{ID: km.ID, Hash: km.Hash, NextAttemptAt: now, Unfiltered: unfiltered})
+	}
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&pending, 500)
+	if result.Error != nil {
+		return 0, fmt.Errorf("unable to queue killmails: %w", result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+func recordKillmailSources(db *gorm.DB, token common.Token, kms []common.Killmail) error {
+	if len(kms) == 0 {
+		return nil
+	}
+	sources := []common.KillmailSource{}
+	for _, km := range kms {
+		sources = append(sources, common.KillmailSource{KillmailID: km.ID, TokenID: token.ID, CharID: token.CharID, CorpID: token.CorpID})
+	}
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	err := db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&sources, 500).Error
+	if err != nil {
+		return fmt.Errorf("unable to record killmail sources: %w", err)
+	}
+	return nil
+}
+
+// Unfiltered feed killmails are only drained while the feed is followed, the
+// ones its filter does not keep are dropped once their details are known.
+func drainQueue(db *gorm.DB, detailJobs chan<- detailJob, feed *feedFilter) (int, int) {
+	stored := 0
+	failed := 0
+	for {
+		pending := []common.PendingKillmail{}
+		query := db.Where("next_attempt_at <= ?", time.Now())
+		if feed == nil {
+			query = query.Where("unfiltered = ?", false)
+		}
+		query.Order("id").Limit(queueBatchSize).Find(&pending)
+		if len(pending) == 0 {
+			return stored, failed
+		}
+		fmt.Printf("Processing %d queued killmails.\n", len(pending))
+		kms := []common.Killmail{}
+		unfiltered := make(map[uint]bool)
+		for _, p := range pending {
+			kms = append(kms, common.Killmail{ID: p.ID, Hash: p.Hash})
+			unfiltered[p.ID] = p.Unfiltered
+		}
+		fetched, failures := fetchKillmailDetails(kms, detailJobs)
+		details := []common.Killmail{}
+		dropped := 0
+		for _, km := range fetched {
+			if unfiltered[km.ID] && !feed.matches(db, &km) {
+				dropped++
+				continue
+			}
+			details = append(details, km)
+		}
+		err := storeKillmails(db, details)
+		if err != nil {
+			fmt.Println("Error while storing killmails:", err)
+			for _, km := range details {
+				failures[km.ID] = err
+			}
+		}
+		done := []uint{}
+		for _, p := range pending {
+			if failErr, ok := failures[p.ID]; ok {
+				markQueueFailure(db, p, failErr)
+				failed++
+				continue
+			}
+			done = append(done, p.ID)
+		}
+		if len(done) > 0 {
+			dbLock.Lock()
+			db.Unscoped().Where("id IN ?", done).Delete(&common.PendingKillmail{})
+			dbLock.Unlock()
+			stored += len(done) - dropped
+		}
+	}
+}
+
+func markQueueFailure(db *gorm.DB, pending common.PendingKillmail, err error) {
+	backoff := time.Minute * time.Duration(1<<pending.Attempts)
+	if pending.Attempts > 10 || backoff > maxQueueBackoff {
+		backoff = maxQueueBackoff
+	}
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db.Model(&common.PendingKillmail{}).Where("id = ?", pending.ID).Updates(map[string]interface{}{
+		"attempts":        pending.Attempts + 1,
+		"last_error":      err.Error(),
+		"next_attempt_at": time.Now().Add(backoff),
+	})
+}
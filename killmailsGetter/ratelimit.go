@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+)
+
+type rateLimiter struct {
+	tokens chan struct{}
+}
+
+func newRateLimiter(perSecond int, burst int) *rateLimiter {
+	limiter := &rateLimiter{tokens: make(chan struct{}, burst)}
+	for i := 0; i < burst; i++ {
+		limiter.tokens <- struct{}{}
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second / time.Duration(perSecond))
+		defer ticker.Stop()
+		for range ticker.C {
+			select {
+			case limiter.tokens <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return limiter
+}
+
+func (r *rateLimiter) Wait() {
+	<-r.tokens
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const redisqRetryDelay = 10 * time.Second
+
+type redisqResponse struct {
+	Package *redisqPackage `json:"package"`
+}
+
+// Packages hold the ESI killmail, or only its ID and hash in the newer format
+type redisqPackage struct {
+	KillID   uint             `json:"killID"`
+	Killmail *common.Killmail `json:"killmail"`
+	Zkb      struct {
+		Hash string `json:"hash"`
+	} `json:"zkb"`
+}
+
+// feedFilter keeps the killmails involving one of the entities, or in one of
+// the regions.
+type feedFilter struct {
+	entities *common.HomeEntities
+	regions  map[uint]bool
+}
+
+func newFeedFilter(entities *common.HomeEntities, regions []uint) *feedFilter {
+	f := &feedFilter{entities: entities, regions: make(map[uint]bool)}
+	for _, ID := range regions {
+		f.regions[ID] = true
+	}
+	return f
+}
+
+// Without entities or regions, the killmails involving the registered tokens
+// are kept
+func getFeedFilter(db *gorm.DB, characters string, corporations string, alliances string, regions string) (*feedFilter, error) {
+	IDs := [][]uint{}
+	for _, value := range []string{characters, corporations, alliances, regions} {
+		parsed, err := common.ParseIDs(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RedisQ filter: %w", err)
+		}
+		IDs = append(IDs, parsed)
+	}
+	filter := newFeedFilter(common.NewHomeEntities(IDs[0], IDs[1], IDs[2]), IDs[3])
+	if !filter.entities.Empty() || len(filter.regions) > 0 {
+		return filter, nil
+	}
+	entities, err := common.GetTokensHomeEntities(db)
+	if err != nil {
+		return nil, err
+	}
+	if entities.Empty() {
+		return nil, fmt.Errorf("RedisQ feed needs entities or regions to keep killmails of")
+	}
+	filter.entities = entities
+	return filter, nil
+}
+
+func (f *feedFilter) matches(db *gorm.DB, km *common.Killmail) bool {
+	if f.entities.Classify(km) != common.StatusInvolved {
+		return true
+	}
+	if len(f.regions) == 0 {
+		return false
+	}
+	return f.regions[common.GetSolarSystem(db, km.SolarSystemID).RegionID]
+}
+
+// followRedisQ long-polls a RedisQ feed forever
+func followRedisQ(db *gorm.DB, url string, filter *feedFilter) {
+	fmt.Printf("Following RedisQ feed %s\n", url)
+	for {
+		pkg, err := pollRedisQ(url)
+		if err != nil {
+			fmt.Println("Error while polling RedisQ:", err)
+			time.Sleep(redisqRetryDelay)
+			continue
+		}
+		if pkg == nil {
+			continue
+		}
+		err = handleRedisQPackage(db, pkg, filter)
+		if err != nil {
+			fmt.Printf("Error while handling RedisQ killmail %d: %s\n", pkg.KillID, err)
+		}
+	}
+}
+
+// A nil package means no killmail came in before the feed timeout. The poll
+// goes through the shared client for its timeout, which is above the 10
+// seconds RedisQ holds a poll, without the ESI retries: followRedisQ polls again.
+func pollRedisQ(url string) (*redisqPackage, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GET request: %w", err)
+	}
+	req.Header.Set("User-Agent", common.ESI.UserAgent)
+	resp, err := common.ESI.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error executing GET request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid Status Code: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	res := redisqResponse{}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	return res.Package, nil
+}
+
+// Killmails kept are fetched from ESI like the ones found by tokens, so the
+// feed is only trusted for the ID and hash. Storage failures are left to the
+// queue, which filters the killmails whose details were not known yet.
+func handleRedisQPackage(db *gorm.DB, pkg *redisqPackage, filter *feedFilter) error {
+	if pkg.KillID == 0 || pkg.Zkb.Hash == "" {
+		return fmt.Errorf("invalid killmail reference %d,%q", pkg.KillID, pkg.Zkb.Hash)
+	}
+	if len(filterStoredKms(db, []common.Killmail{{ID: pkg.KillID}})) == 0 {
+		return nil
+	}
+	matched := false
+	if pkg.Killmail != nil && pkg.Killmail.ID == pkg.KillID {
+		if !filter.matches(db, pkg.Killmail) {
+			return nil
+		}
+		matched = true
+	}
+	km := common.Killmail{ID: pkg.KillID, Hash: pkg.Zkb.Hash}
+	err := getKillmailDetails(&km)
+	if err == nil {
+		if !filter.matches(db, &km) {
+			return nil
+		}
+		matched = true
+		err = storeKillmails(db, []common.Killmail{km})
+	}
+	if err != nil {
+		if _, queueErr := enqueueKillmails(db, []common.Killmail{{ID: pkg.KillID, Hash: pkg.Zkb.Hash}}, !matched); queueErr != nil {
+			return queueErr
+		}
+		return fmt.Errorf("queued for retry: %w", err)
+	}
+	fmt.Printf("RedisQ killmail %d stored.\n", km.ID)
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const (
+	homeCorporationID = 98000001
+	jitaSystemID      = 30000142
+	amarrSystemID     = 30002187
+)
+
+// stubFeed serves the RedisQ packages in turn, then empty polls, and answers
+// the ESI requests as if it were esi.evetech.net
+type stubFeed struct {
+	lock      sync.Mutex
+	packages  []string
+	killmails map[uint]common.Killmail
+	// Recent killmails of the characters
+	recent  map[uint][]uint
+	failing map[uint]bool
+	fetched map[uint]int
+}
+
+func (s *stubFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case r.URL.Path == "/listen.php":
+		if len(s.packages) == 0 {
+			fmt.Fprint(w, `{"package":null}`)
+			return
+		}
+		fmt.Fprint(w, s.packages[0])
+		s.packages = s.packages[1:]
+	case r.URL.Path == "/latest/universe/names/":
+		fmt.Fprint(w, `[]`)
+	case strings.HasPrefix(r.URL.Path, "/latest/characters/"):
+		var charID uint
+		fmt.Sscanf(r.URL.Path, "/latest/characters/%d/killmails/recent", &charID)
+		recent := []common.Killmail{}
+		for _, ID := range s.recent[charID] {
+			recent = append(recent, common.Killmail{ID: ID, Hash: s.killmails[ID].Hash})
+		}
+		json.NewEncoder(w).Encode(recent)
+	case strings.HasPrefix(r.URL.Path, "/latest/killmails/"):
+		var ID uint
+		var hash string
+		fmt.Sscanf(strings.ReplaceAll(r.URL.Path, "/", " "), " latest killmails %d %s", &ID, &hash)
+		s.fetched[ID]++
+		km, ok := s.killmails[ID]
+		if !ok || km.Hash != hash {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		if s.failing[ID] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(km)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *stubFeed) addPackage(ID uint, embedded bool) {
+	pkg := redisqPackage{KillID: ID}
+	pkg.Zkb.Hash = s.killmails[ID].Hash
+	if embedded {
+		km := s.killmails[ID]
+		pkg.Killmail = &km
+	}
+	body, _ := json.Marshal(redisqResponse{Package: &pkg})
+	s.packages = append(s.packages, string(body))
+}
+
+func (s *stubFeed) setFailing(ID uint, failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing[ID] = failing
+}
+
+// stubTransport sends all the requests to the stub server
+type stubTransport struct {
+	target *url.URL
+}
+
+func (s stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = s.target.Scheme
+	req.URL.Host = s.target.Host
+	req.Host = ""
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestKillmail(ID uint, systemID uint, victimCorporationID uint, attackerCorporationID uint) common.Killmail {
+	return common.Killmail{
+		ID:            ID,
+		Hash:          fmt.Sprintf("hash%d", ID),
+		KillmailTime:  time.Date(2021, 12, 1, 20, 30, 0, 0, time.UTC),
+		SolarSystemID: systemID,
+		Victim:        &common.Victim{CorporationID: victimCorporationID, ShipTypeID: 587},
+		Attackers:     &[]common.Attacker{{CorporationID: attackerCorporationID, ShipTypeID: 620, FinalBlow: true}},
+	}
+}
+
+// inTestDir runs the test in a temporary directory, for the database and the
+// cache
+func inTestDir(t *testing.T) *gorm.DB {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	for _, cache := range []string{"killmails", "recent"} {
+		if err := os.MkdirAll(filepath.Join("cache", cache), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := gorm.Open(sqlite.Open("test.db?_foreign_keys=on&_busy_timeout=5000"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// useStubESI sends all the ESI requests to the handler, without retries
+func useStubESI(t *testing.T, handler http.Handler) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+	esi := common.ESI
+	common.ESI = common.NewESIClient("EveGonline tests", 5*time.Second)
+	common.ESI.MaxRetries = 0
+	common.ESI.HTTPClient.Transport = stubTransport{target: target}
+	previous := limiter
+	limiter = newRateLimiter(100, 100)
+	t.Cleanup(func() {
+		common.ESI = esi
+		limiter = previous
+	})
+}
+
+func newTestFeed(t *testing.T) (*gorm.DB, *stubFeed, string) {
+	db := inTestDir(t)
+	db.AutoMigrate(&common.Mapping{}, &common.Killmail{}, &common.Attacker{}, &common.Victim{}, &common.Item{}, &common.SubItem{}, &common.Position{}, &common.SolarSystem{}, &common.Region{}, &common.Constellation{}, &common.PendingKillmail{})
+	db.Create(&common.SolarSystem{ID: jitaSystemID, RegionID: common.TheForgeRegionID, Name: "Jita"})
+	db.Create(&common.SolarSystem{ID: amarrSystemID, RegionID: 10000043, Name: "Amarr"})
+	feed := &stubFeed{killmails: make(map[uint]common.Killmail), recent: make(map[uint][]uint), failing: make(map[uint]bool), fetched: make(map[uint]int)}
+	useStubESI(t, feed)
+	return db, feed, "https://zkillboard.com/listen.php"
+}
+
+func getStoredIDs(db *gorm.DB) []uint {
+	IDs := []uint{}
+	db.Model(&common.Killmail{}).Order("id").Pluck("id", &IDs)
+	return IDs
+}
+
+func TestFollowRedisQFeed(t *testing.T) {
+	db, feed, feedURL := newTestFeed(t)
+	kms := []common.Killmail{
+		newTestKillmail(1001, amarrSystemID, homeCorporationID, 98000002),
+		newTestKillmail(1002, jitaSystemID, 98000002, 98000003),
+		newTestKillmail(1003, amarrSystemID, 98000002, 98000003),
+		newTestKillmail(1004, amarrSystemID, 98000002, 98000003),
+		newTestKillmail(1005, amarrSystemID, 98000002, 98000003),
+		newTestKillmail(1006, amarrSystemID, 98000002, homeCorporationID),
+	}
+	for _, km := range kms {
+		feed.killmails[km.ID] = km
+	}
+	feed.failing[1005] = true
+	feed.failing[1006] = true
+	for _, ID := range []uint{1001, 1002, 1003, 1005, 1006} {
+		feed.addPackage(ID, false)
+	}
+	feed.addPackage(1004, true)
+	filter := newFeedFilter(common.NewHomeEntities(nil, []uint{homeCorporationID}, nil), []uint{common.TheForgeRegionID})
+
+	for {
+		pkg, err := pollRedisQ(feedURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg == nil {
+			break
+		}
+		err = handleRedisQPackage(db, pkg, filter)
+		if err != nil && pkg.KillID != 1005 && pkg.KillID != 1006 {
+			t.Errorf("killmail %d: %s", pkg.KillID, err)
+		}
+	}
+	if IDs := getStoredIDs(db); fmt.Sprint(IDs) != "[1001 1002]" {
+		t.Errorf("stored %v, want the loss and the killmail in The Forge", IDs)
+	}
+	if feed.fetched[1004] != 0 {
+		t.Error("the details of a feed killmail out of the filter were fetched")
+	}
+	pending := []common.PendingKillmail{}
+	db.Order("id").Find(&pending)
+	if len(pending) != 2 || !pending[0].Unfiltered || !pending[1].Unfiltered {
+		t.Fatalf("queued %+v, want 1005 and 1006 unfiltered", pending)
+	}
+
+	detailJobs := make(chan detailJob)
+	defer close(detailJobs)
+	go detailWorker(detailJobs)
+	feed.setFailing(1005, false)
+	feed.setFailing(1006, false)
+	stored, failed := drainQueue(db, detailJobs, nil)
+	if stored != 0 || failed != 0 {
+		t.Errorf("drained %d stored %d failed without the feed, want nothing", stored, failed)
+	}
+	stored, failed = drainQueue(db, detailJobs, filter)
+	if stored != 1 || failed != 0 {
+		t.Errorf("drained %d stored %d failed, want 1 stored", stored, failed)
+	}
+	if IDs := getStoredIDs(db); fmt.Sprint(IDs) != "[1001 1002 1006]" {
+		t.Errorf("stored %v, want the kill of the home corporation only", IDs)
+	}
+	var left int64
+	db.Model(&common.PendingKillmail{}).Count(&left)
+	if left != 0 {
+		t.Errorf("%d killmails left in the queue", left)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const (
+	deliveryPending = "pending"
+	deliverySent    = "sent"
+	deliveryFailed  = "failed"
+	deliverySkipped = "skipped"
+)
+
+const deliveryRetryDelay = 1 * time.Minute
+const webhookTimeout = 10 * time.Second
+
+// A webhook which never answers would hold back all the deliveries
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// deliverer posts the pending deliveries, one at a time so a webhook rate
+// limit is not hit by concurrent posts.
+type deliverer struct {
+	db          *gorm.DB
+	maxAttempts uint
+	wakeup      chan struct{}
+}
+
+func newDeliverer(db *gorm.DB, maxAttempts uint) *deliverer {
+	return &deliverer{db: db, maxAttempts: maxAttempts, wakeup: make(chan struct{}, 1)}
+}
+
+func (d *deliverer) wake() {
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (d *deliverer) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := d.deliverPending()
+		if err != nil {
+			fmt.Println("ERROR delivering webhooks:", err)
+		}
+		select {
+		case <-d.wakeup:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *deliverer) deliverPending() error {
+	deliveries := []common.WebhookDelivery{}
+	err := d.db.Where("status = ? AND next_attempt_at <= ?", deliveryPending, time.Now()).Order("id").Find(&deliveries).Error
+	if err != nil {
+		return fmt.Errorf("unable to load pending deliveries: %w", err)
+	}
+	for _, delivery := range deliveries {
+		webhook := common.Webhook{}
+		d.db.Where("id = ?", delivery.WebhookID).Find(&webhook)
+		if webhook.ID == 0 {
+			delivery.Status = deliveryFailed
+			delivery.LastError = "webhook removed"
+		} else {
+			d.attempt(&webhook, &delivery)
+		}
+		if err := d.db.Save(&delivery).Error; err != nil {
+			return fmt.Errorf("unable to save delivery %d: %w", delivery.ID, err)
+		}
+	}
+	return nil
+}
+
+// Failed posts are retried with an exponential backoff, or after the delay
+// asked by a rate limited webhook
+func (d *deliverer) attempt(webhook *common.Webhook, delivery *common.WebhookDelivery) {
+	delivery.Attempts++
+	retryAfter, err := postWebhook(webhook.URL, delivery.Payload)
+	if err == nil {
+		now := time.Now()
+		delivery.Status = deliverySent
+		delivery.SentAt = &now
+		delivery.LastError = ""
+		fmt.Printf("Killmail %d posted to webhook %d\n", delivery.KillmailID, webhook.ID)
+		return
+	}
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= d.maxAttempts {
+		delivery.Status = deliveryFailed
+		fmt.Printf("ERROR giving up posting killmail %d to webhook %d: %s\n", delivery.KillmailID, webhook.ID, err)
+		return
+	}
+	delay := deliveryRetryDelay * time.Duration(1<<(delivery.Attempts-1))
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	delivery.NextAttemptAt = time.Now().Add(delay)
+	fmt.Printf("ERROR posting killmail %d to webhook %d, retrying in %s: %s\n", delivery.KillmailID, webhook.ID, delay, err)
+}
+
+func postWebhook(url string, payload string) (time.Duration, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(payload))
+	if err != nil {
+		return 0, fmt.Errorf("error creating POST request: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return 0, fmt.Errorf("no answer after %s", webhookClient.Timeout)
+		}
+		return 0, fmt.Errorf("error executing POST request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	var retryAfter time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests {
+		seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64)
+		if err == nil {
+			retryAfter = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	return retryAfter, fmt.Errorf("request status error: %d %s", resp.StatusCode, bytes.TrimSpace(body))
+}
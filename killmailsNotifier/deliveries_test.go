@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+// newStubWebhook answers the posts with the given statuses in turn, the last
+// one answers all the following posts
+func newStubWebhook(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *[]string) {
+	payloads := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payloads = append(payloads, string(body))
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+		}
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		status := statuses[len(statuses)-1]
+		if len(payloads) <= len(statuses) {
+			status = statuses[len(payloads)-1]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &payloads
+}
+
+func assertDelay(t *testing.T, delivery *common.WebhookDelivery, start time.Time, want time.Duration) {
+	t.Helper()
+	delay := delivery.NextAttemptAt.Sub(start)
+	if delay < want || delay > want+5*time.Second {
+		t.Errorf("next attempt in %s, want %s", delay, want)
+	}
+}
+
+func TestAttemptSent(t *testing.T) {
+	server, payloads := newStubWebhook(t, nil, http.StatusNoContent)
+	d := newDeliverer(nil, 5)
+	delivery := common.WebhookDelivery{Status: deliveryPending, Payload: `{"text":"kill"}`, LastError: "old error"}
+	d.attempt(&common.Webhook{URL: server.URL}, &delivery)
+	if delivery.Status != deliverySent || delivery.SentAt == nil || delivery.LastError != "" {
+		t.Errorf("delivery = %+v, want sent", delivery)
+	}
+	if delivery.Attempts != 1 {
+		t.Errorf("attempts = %d, want 1", delivery.Attempts)
+	}
+	if len(*payloads) != 1 || (*payloads)[0] != `{"text":"kill"}` {
+		t.Errorf("payloads = %q", *payloads)
+	}
+}
+
+func TestAttemptBackoff(t *testing.T) {
+	server, _ := newStubWebhook(t, nil, http.StatusInternalServerError)
+	d := newDeliverer(nil, 3)
+	webhook := common.Webhook{URL: server.URL}
+	delivery := common.WebhookDelivery{Status: deliveryPending}
+
+	start := time.Now()
+	d.attempt(&webhook, &delivery)
+	if delivery.Status != deliveryPending {
+		t.Fatalf("status = %q after the first failure, want pending", delivery.Status)
+	}
+	assertDelay(t, &delivery, start, deliveryRetryDelay)
+	if !strings.Contains(delivery.LastError, "500") {
+		t.Errorf("last error = %q", delivery.LastError)
+	}
+
+	start = time.Now()
+	d.attempt(&webhook, &delivery)
+	assertDelay(t, &delivery, start, 2*deliveryRetryDelay)
+
+	d.attempt(&webhook, &delivery)
+	if delivery.Status != deliveryFailed || delivery.Attempts != 3 {
+		t.Errorf("delivery = %+v, want failed after 3 attempts", delivery)
+	}
+}
+
+func TestAttemptRetryAfter(t *testing.T) {
+	header := http.Header{"Retry-After": []string{"300"}}
+	server, _ := newStubWebhook(t, header, http.StatusTooManyRequests)
+	d := newDeliverer(nil, 5)
+	delivery := common.WebhookDelivery{Status: deliveryPending}
+	start := time.Now()
+	d.attempt(&common.Webhook{URL: server.URL}, &delivery)
+	assertDelay(t, &delivery, start, 5*time.Minute)
+
+	// A shorter Retry-After does not cut the backoff
+	header = http.Header{"Retry-After": []string{"1.5"}}
+	server, _ = newStubWebhook(t, header, http.StatusTooManyRequests)
+	delivery = common.WebhookDelivery{Status: deliveryPending}
+	start = time.Now()
+	d.attempt(&common.Webhook{URL: server.URL}, &delivery)
+	assertDelay(t, &delivery, start, deliveryRetryDelay)
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	timeout := webhookClient.Timeout
+	webhookClient.Timeout = 100 * time.Millisecond
+	defer func() { webhookClient.Timeout = timeout }()
+
+	d := newDeliverer(nil, 5)
+	delivery := common.WebhookDelivery{Status: deliveryPending}
+	start := time.Now()
+	d.attempt(&common.Webhook{URL: server.URL}, &delivery)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("attempt took %s", time.Since(start))
+	}
+	if delivery.Status != deliveryPending || delivery.Attempts != 1 {
+		t.Errorf("delivery = %+v, want a failed attempt", delivery)
+	}
+	if delivery.LastError != "no answer after 100ms" {
+		t.Errorf("last error = %q", delivery.LastError)
+	}
+	assertDelay(t, &delivery, start, deliveryRetryDelay)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const streamRetryDelay = 10 * time.Second
+const tenantsInterval = 1 * time.Minute
+
+var endpoint *string
+
+func main() {
+	endpoint = flag.String("e", "http://localhost:8000", "killmailsServer endpoint")
+	retryInterval := flag.Duration("retry-interval", 30*time.Second, "time to wait between two checks for deliveries to retry")
+	maxAttempts := flag.Uint("max-attempts", 5, "number of attempts before a delivery is given up")
+	flag.Parse()
+	if *maxAttempts < 1 {
+		panic("max-attempts must be positive")
+	}
+	db, err := gorm.Open(sqlite.Open("test.db?_busy_timeout=5000"), &gorm.Config{})
+	if err != nil {
+		panic(err)
+	}
+	db.AutoMigrate(&common.Webhook{}, &common.WebhookDelivery{}, &common.InventoryType{}, &common.InventoryGroup{})
+	d := newDeliverer(db, *maxAttempts)
+	go watchTenants(db, d, tenantsInterval)
+	d.run(*retryInterval)
+}
+
+// watchTenants follows the stream of every board with webhooks, boards
+// getting their first webhook are picked up without a restart and boards
+// left without webhooks are no longer followed.
+func watchTenants(db *gorm.DB, d *deliverer, interval time.Duration) {
+	followed := make(map[uint]context.CancelFunc)
+	follow := func(ctx context.Context, tenantID uint) {
+		go followStream(ctx, db, tenantID, d)
+	}
+	warned := false
+	for {
+		tenantIDs := []uint{}
+		err := db.Model(&common.Webhook{}).Distinct().Pluck("tenant_id", &tenantIDs).Error
+		if err != nil {
+			fmt.Println("ERROR loading webhooks:", err)
+		} else {
+			updateFollowed(followed, tenantIDs, follow)
+		}
+		if err == nil && len(tenantIDs) == 0 && !warned {
+			fmt.Println("No webhooks configured yet")
+			warned = true
+		}
+		time.Sleep(interval)
+	}
+}
+
+// updateFollowed starts following the new tenants and stops following the
+// ones missing from tenantIDs
+func updateFollowed(followed map[uint]context.CancelFunc, tenantIDs []uint, follow func(ctx context.Context, tenantID uint)) {
+	current := make(map[uint]bool)
+	for _, tenantID := range tenantIDs {
+		current[tenantID] = true
+		if followed[tenantID] != nil {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		followed[tenantID] = cancel
+		follow(ctx, tenantID)
+	}
+	for tenantID, cancel := range followed {
+		if current[tenantID] {
+			continue
+		}
+		fmt.Printf("No webhooks left for board %d, no longer following it\n", tenantID)
+		cancel()
+		delete(followed, tenantID)
+	}
+}
+
+// followStream queues the killmails of a board for the webhooks of that
+// board, resuming after the last killmail handled before a restart, until
+// ctx is done.
+func followStream(ctx context.Context, db *gorm.DB, tenantID uint, d *deliverer) {
+	url := *endpoint + "/killmails/stream"
+	if tenantID != 0 {
+		url = fmt.Sprintf("%s/corp/%d/killmails/stream", *endpoint, tenantID)
+	}
+	for {
+		lastID := getLastKillmailID(db, tenantID)
+		fmt.Printf("Following %s after killmail %s\n", url, lastID)
+		err := common.ReadKillmailStream(ctx, url, lastID, func(ID string, km common.EnrichedKMShort) {
+			err := queueDeliveries(db, tenantID, &km)
+			if err != nil {
+				fmt.Printf("ERROR queueing killmail %d: %s\n", km.ID, err)
+				return
+			}
+			d.wake()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("ERROR following %s: %s\n", url, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamRetryDelay):
+		}
+	}
+}
+
+func getLastKillmailID(db *gorm.DB, tenantID uint) string {
+	delivery := common.WebhookDelivery{}
+	db.Where("webhook_id IN (SELECT id FROM webhooks WHERE tenant_id = ?)", tenantID).Order("id desc").Limit(1).Find(&delivery)
+	if delivery.KillmailID == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(delivery.KillmailID), 10)
+}
+
+// Every killmail gets a delivery per webhook of its board, skipped when the
+// rules do not match, so it is never posted twice
+func queueDeliveries(db *gorm.DB, tenantID uint, km *common.EnrichedKMShort) error {
+	webhooks := []common.Webhook{}
+	err := db.Where("tenant_id = ?", tenantID).Find(&webhooks).Error
+	if err != nil {
+		return fmt.Errorf("unable to load webhooks: %w", err)
+	}
+	for _, webhook := range webhooks {
+		delivery := common.WebhookDelivery{WebhookID: webhook.ID, KillmailID: km.ID, Status: deliverySkipped}
+		if matchesRules(db, &webhook, km) {
+			// A misconfigured webhook must not hold back the other ones
+			payload, err := formatMessage(webhook.Format, km)
+			if err != nil {
+				fmt.Printf("ERROR formatting killmail %d for webhook %d: %s\n", km.ID, webhook.ID, err)
+				delivery.Status = deliveryFailed
+				delivery.LastError = err.Error()
+			} else {
+				delivery.Status = deliveryPending
+				delivery.Payload = string(payload)
+				delivery.NextAttemptAt = time.Now()
+			}
+		}
+		err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery).Error
+		if err != nil {
+			return fmt.Errorf("unable to queue delivery to webhook %d: %w", webhook.ID, err)
+		}
+	}
+	return nil
+}
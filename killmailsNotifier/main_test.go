@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestUpdateFollowed(t *testing.T) {
+	followed := make(map[uint]context.CancelFunc)
+	streams := make(map[uint]context.Context)
+	starts := 0
+	follow := func(ctx context.Context, tenantID uint) {
+		starts++
+		streams[tenantID] = ctx
+	}
+	followedIDs := func() string {
+		IDs := []int{}
+		for tenantID := range followed {
+			IDs = append(IDs, int(tenantID))
+		}
+		sort.Ints(IDs)
+		return fmt.Sprint(IDs)
+	}
+
+	updateFollowed(followed, []uint{0, 98000001}, follow)
+	updateFollowed(followed, []uint{0, 98000001}, follow)
+	if followedIDs() != "[0 98000001]" || starts != 2 {
+		t.Errorf("followed %s after %d starts, want [0 98000001] after 2", followedIDs(), starts)
+	}
+	// Tenant without webhooks anymore
+	updateFollowed(followed, []uint{0, 98000002}, follow)
+	if followedIDs() != "[0 98000002]" || starts != 3 {
+		t.Errorf("followed %s after %d starts, want [0 98000002] after 3", followedIDs(), starts)
+	}
+	if streams[98000001].Err() == nil {
+		t.Error("stream of a tenant without webhooks not stopped")
+	}
+	if streams[0].Err() != nil || streams[98000002].Err() != nil {
+		t.Error("stream of a tenant with webhooks stopped")
+	}
+	// Webhooks added back
+	updateFollowed(followed, []uint{98000001}, follow)
+	if followedIDs() != "[98000001]" || starts != 4 || streams[98000001].Err() != nil {
+		t.Errorf("followed %s after %d starts, want [98000001] after 4", followedIDs(), starts)
+	}
+}
+
+func TestFollowStreamStops(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(t.TempDir()+"/test.db"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&common.Webhook{}, &common.WebhookDelivery{})
+	connected := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		connected <- r.URL.Path
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	previous := endpoint
+	endpoint = &server.URL
+	defer func() { endpoint = previous }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		followStream(ctx, db, 98000001, newDeliverer(db, 5))
+		close(stopped)
+	}()
+	select {
+	case path := <-connected:
+		if path != "/corp/98000001/killmails/stream" {
+			t.Errorf("followed %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not followed")
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still followed after being stopped")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const (
+	formatDiscord = "discord"
+	formatSlack   = "slack"
+)
+
+const (
+	discordKillColor = 0x2ecc71
+	discordLossColor = 0xe74c3c
+)
+
+type discordMessage struct {
+	Username string         `json:"username"`
+	Embeds   []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	URL         string         `json:"url"`
+	Description string         `json:"description"`
+	Color       int            `json:"color"`
+	Timestamp   string         `json:"timestamp"`
+	Author      discordAuthor  `json:"author"`
+	Thumbnail   discordImage   `json:"thumbnail"`
+	Fields      []discordField `json:"fields"`
+	Footer      discordFooter  `json:"footer"`
+}
+
+type discordAuthor struct {
+	Name    string `json:"name"`
+	IconURL string `json:"icon_url"`
+}
+
+type discordImage struct {
+	URL string `json:"url"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordFooter struct {
+	Text    string `json:"text"`
+	IconURL string `json:"icon_url"`
+}
+
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type      string         `json:"type"`
+	Text      *slackElement  `json:"text,omitempty"`
+	Accessory *slackElement  `json:"accessory,omitempty"`
+	Elements  []slackElement `json:"elements,omitempty"`
+}
+
+type slackElement struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	AltText  string `json:"alt_text,omitempty"`
+}
+
+// Without a kind, both kills and losses are posted
+func matchesRules(db *gorm.DB, webhook *common.Webhook, km *common.EnrichedKMShort) bool {
+	if webhook.Kind == "" && km.Status != common.StatusKill && km.Status != common.StatusLoss {
+		return false
+	}
+	if webhook.Kind != "" && km.Status != webhook.Kind {
+		return false
+	}
+	if km.Price < webhook.MinValue {
+		return false
+	}
+	if webhook.RegionID != 0 && km.SolarSystem.RegionID != webhook.RegionID {
+		return false
+	}
+	if webhook.ShipGroupID != 0 || webhook.ShipCategoryID != 0 {
+		group := getShipGroup(db, km.Victim.ShipTypeID)
+		if webhook.ShipGroupID != 0 && group.ID != webhook.ShipGroupID {
+			return false
+		}
+		if webhook.ShipCategoryID != 0 && group.CategoryID != webhook.ShipCategoryID {
+			return false
+		}
+	}
+	return true
+}
+
+// Groups come from the SDE, unknown ships have an empty one
+func getShipGroup(db *gorm.DB, shipTypeID uint) common.InventoryGroup {
+	group := common.InventoryGroup{}
+	db.Where("id IN (SELECT group_id FROM inventory_types WHERE id = ? AND deleted_at IS NULL)", shipTypeID).Find(&group)
+	return group
+}
+
+func formatMessage(format string, km *common.EnrichedKMShort) ([]byte, error) {
+	switch format {
+	case formatDiscord:
+		return json.Marshal(formatDiscordMessage(km))
+	case formatSlack:
+		return json.Marshal(formatSlackMessage(km))
+	}
+	return nil, fmt.Errorf("unknown webhook format %q", format)
+}
+
+func formatDiscordMessage(km *common.EnrichedKMShort) discordMessage {
+	victim, finalBlow := getVictimName(km), getFinalBlowName(km)
+	embed := discordEmbed{
+		Title:       fmt.Sprintf("%s: %s", getKindTitle(km.Status), km.Victim.ShipTypeName),
+		URL:         fmt.Sprintf(common.ZKillboardKillUrl, km.ID),
+		Description: fmt.Sprintf("**%s** lost a **%s** in **%s**", victim, km.Victim.ShipTypeName, formatSystem(km)),
+		Color:       discordKillColor,
+		Timestamp:   km.KillmailTime.UTC().Format(time.RFC3339),
+		Author:      discordAuthor{Name: victim, IconURL: getVictimImageURL(km)},
+		Thumbnail:   discordImage{URL: getImageURL("types/%d/render?size=128", km.Victim.ShipTypeID)},
+		Fields: []discordField{
+			{Name: "Victim", Value: formatAffiliation(km.Victim.CorporationName, km.Victim.AllianceName), Inline: true},
+			{Name: "Value", Value: common.FormatPrice(km.Price), Inline: true},
+		},
+		Footer: discordFooter{Text: formatFinalBlow(km, finalBlow), IconURL: getImageURL("characters/%d/portrait?size=64", km.Attacker.CharacterID)},
+	}
+	if km.Status == common.StatusLoss {
+		embed.Color = discordLossColor
+	}
+	return discordMessage{Username: "EveGonline", Embeds: []discordEmbed{embed}}
+}
+
+func formatSlackMessage(km *common.EnrichedKMShort) slackMessage {
+	victim, finalBlow := getVictimName(km), getFinalBlowName(km)
+	summary := fmt.Sprintf("%s: %s lost a %s in %s (%s)", getKindTitle(km.Status), victim, km.Victim.ShipTypeName, formatSystem(km), common.FormatPrice(km.Price))
+	text := fmt.Sprintf("*<%s|%s: %s>*\n*%s* (%s) lost a *%s* in *%s*\nValue: *%s*",
+		fmt.Sprintf(common.ZKillboardKillUrl, km.ID), getKindTitle(km.Status), km.Victim.ShipTypeName,
+		victim, formatAffiliation(km.Victim.CorporationName, km.Victim.AllianceName), km.Victim.ShipTypeName, formatSystem(km), common.FormatPrice(km.Price))
+	return slackMessage{
+		Text: summary,
+		Blocks: []slackBlock{
+			{
+				Type:      "section",
+				Text:      &slackElement{Type: "mrkdwn", Text: text},
+				Accessory: &slackElement{Type: "image", ImageURL: getImageURL("types/%d/render?size=128", km.Victim.ShipTypeID), AltText: km.Victim.ShipTypeName},
+			},
+			{
+				Type: "context",
+				Elements: []slackElement{
+					{Type: "image", ImageURL: getImageURL("characters/%d/portrait?size=64", km.Attacker.CharacterID), AltText: "Final blow"},
+					{Type: "mrkdwn", Text: formatFinalBlow(km, finalBlow)},
+				},
+			},
+		},
+	}
+}
+
+func getKindTitle(status string) string {
+	if status == common.StatusLoss {
+		return "Loss"
+	}
+	return "Kill"
+}
+
+// Structures and NPCs have no character, their corporation or ship is shown instead
+func getVictimName(km *common.EnrichedKMShort) string {
+	if km.Victim.CharacterID == 0 {
+		return km.Victim.CorporationName
+	}
+	return km.Victim.CharacterName
+}
+
+func getFinalBlowName(km *common.EnrichedKMShort) string {
+	if km.Attacker.CharacterID == 0 {
+		return km.Attacker.ShipTypeName
+	}
+	return km.Attacker.CharacterName
+}
+
+func getVictimImageURL(km *common.EnrichedKMShort) string {
+	if km.Victim.CharacterID == 0 {
+		return getImageURL("corporations/%d/logo?size=64", km.Victim.CorporationID)
+	}
+	return getImageURL("characters/%d/portrait?size=64", km.Victim.CharacterID)
+}
+
+// Webhooks need public image URLs, they point to the EVE image server
+func getImageURL(path string, ID uint) string {
+	return common.EveImagesUrl + fmt.Sprintf(path, ID)
+}
+
+func formatSystem(km *common.EnrichedKMShort) string {
+	return fmt.Sprintf("%s (%.1f, %s)", km.SolarSystem.Name, km.SolarSystem.SecurityStatus, km.RegionName)
+}
+
+func formatFinalBlow(km *common.EnrichedKMShort, finalBlow string) string {
+	return fmt.Sprintf("Final blow: %s (%s) in a %s", finalBlow, formatAffiliation(km.Attacker.CorporationName, km.Attacker.AllianceName), km.Attacker.ShipTypeName)
+}
+
+// Discord refuses empty fields, names not resolved yet show as unknown
+func formatAffiliation(corporation string, alliance string) string {
+	if corporation == "" {
+		corporation = "Unknown"
+	}
+	if alliance != "" {
+		return corporation + " [" + alliance + "]"
+	}
+	return corporation
+}
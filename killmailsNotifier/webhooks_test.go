@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestDB opens an in memory database with a frigate (group 25, category 6)
+// and a cruiser (group 26, category 6)
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&common.InventoryType{}, &common.InventoryGroup{})
+	db.Create(&common.InventoryGroup{ID: 25, CategoryID: 6, Name: "Frigate"})
+	db.Create(&common.InventoryGroup{ID: 26, CategoryID: 6, Name: "Cruiser"})
+	db.Create(&common.InventoryType{ID: 587, GroupID: 25})
+	db.Create(&common.InventoryType{ID: 620, GroupID: 26})
+	return db
+}
+
+func newTestKillmail(status string) *common.EnrichedKMShort {
+	km := &common.EnrichedKMShort{
+		ID:           93000001,
+		KillmailTime: time.Date(2021, 12, 1, 20, 30, 0, 0, time.UTC),
+		Price:        25000000,
+		Status:       status,
+		RegionName:   "The Forge",
+		SolarSystem:  common.SolarSystem{ID: 30000142, RegionID: 10000002, Name: "Jita", SecurityStatus: 0.9},
+	}
+	km.Victim.CharacterID = 2112000001
+	km.Victim.CharacterName = "Victim Pilot"
+	km.Victim.CorporationName = "Victim Corp"
+	km.Victim.ShipTypeID = 587
+	km.Victim.ShipTypeName = "Rifter"
+	km.Attacker.CharacterID = 2112000002
+	km.Attacker.CharacterName = "Final Pilot"
+	km.Attacker.CorporationName = "Attacker Corp"
+	km.Attacker.AllianceName = "Attacker Alliance"
+	km.Attacker.ShipTypeName = "Thorax"
+	return km
+}
+
+func TestMatchesRules(t *testing.T) {
+	db := newTestDB(t)
+	tests := []struct {
+		name    string
+		webhook common.Webhook
+		status  string
+		shipID  uint
+		want    bool
+	}{
+		{"no rules kill", common.Webhook{}, common.StatusKill, 587, true},
+		{"no rules loss", common.Webhook{}, common.StatusLoss, 587, true},
+		{"no rules other", common.Webhook{}, "", 587, false},
+		{"kind matches", common.Webhook{Kind: common.StatusLoss}, common.StatusLoss, 587, true},
+		{"kind differs", common.Webhook{Kind: common.StatusLoss}, common.StatusKill, 587, false},
+		{"value reached", common.Webhook{MinValue: 25000000}, common.StatusKill, 587, true},
+		{"value too low", common.Webhook{MinValue: 25000001}, common.StatusKill, 587, false},
+		{"region matches", common.Webhook{RegionID: 10000002}, common.StatusKill, 587, true},
+		{"region differs", common.Webhook{RegionID: 10000043}, common.StatusKill, 587, false},
+		{"group matches", common.Webhook{ShipGroupID: 25}, common.StatusKill, 587, true},
+		{"group differs", common.Webhook{ShipGroupID: 25}, common.StatusKill, 620, false},
+		{"category matches", common.Webhook{ShipCategoryID: 6}, common.StatusKill, 620, true},
+		{"category differs", common.Webhook{ShipCategoryID: 65}, common.StatusKill, 620, false},
+		{"unknown ship", common.Webhook{ShipCategoryID: 6}, common.StatusKill, 670, false},
+	}
+	for _, test := range tests {
+		km := newTestKillmail(test.status)
+		km.Victim.ShipTypeID = test.shipID
+		if got := matchesRules(db, &test.webhook, km); got != test.want {
+			t.Errorf("%s: matchesRules = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormatDiscordMessage(t *testing.T) {
+	payload, err := formatMessage(formatDiscord, newTestKillmail(common.StatusLoss))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := discordMessage{}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Embeds) != 1 {
+		t.Fatalf("got %d embeds, want 1", len(message.Embeds))
+	}
+	embed := message.Embeds[0]
+	if embed.Title != "Loss: Rifter" {
+		t.Errorf("title = %q", embed.Title)
+	}
+	if embed.Color != discordLossColor {
+		t.Errorf("color = %#x, want %#x", embed.Color, discordLossColor)
+	}
+	if embed.URL != "https://zkillboard.com/kill/93000001/" {
+		t.Errorf("url = %q", embed.URL)
+	}
+	if embed.Timestamp != "2021-12-01T20:30:00Z" {
+		t.Errorf("timestamp = %q", embed.Timestamp)
+	}
+	if embed.Description != "**Victim Pilot** lost a **Rifter** in **Jita (0.9, The Forge)**" {
+		t.Errorf("description = %q", embed.Description)
+	}
+	if embed.Footer.Text != "Final blow: Final Pilot (Attacker Corp [Attacker Alliance]) in a Thorax" {
+		t.Errorf("footer = %q", embed.Footer.Text)
+	}
+	if !strings.HasSuffix(embed.Thumbnail.URL, "types/587/render?size=128") {
+		t.Errorf("thumbnail = %q", embed.Thumbnail.URL)
+	}
+}
+
+func TestFormatSlackMessage(t *testing.T) {
+	km := newTestKillmail(common.StatusKill)
+	km.Victim.CharacterID = 0
+	payload, err := formatMessage(formatSlack, km)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := slackMessage{}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(message.Text, "Kill: Victim Corp lost a Rifter in Jita (0.9, The Forge)") {
+		t.Errorf("text = %q", message.Text)
+	}
+	if len(message.Blocks) != 2 || message.Blocks[0].Text == nil || message.Blocks[0].Accessory == nil {
+		t.Fatalf("unexpected blocks: %+v", message.Blocks)
+	}
+	if !strings.Contains(message.Blocks[0].Text.Text, "<https://zkillboard.com/kill/93000001/|Kill: Rifter>") {
+		t.Errorf("section = %q", message.Blocks[0].Text.Text)
+	}
+}
+
+func TestFormatUnknownMessage(t *testing.T) {
+	_, err := formatMessage("teams", newTestKillmail(common.StatusKill))
+	if err == nil {
+		t.Fatal("an unknown format was accepted")
+	}
+}
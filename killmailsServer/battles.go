@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const defaultBattleGap = 15 * time.Minute
+const maxBattleGap = 6 * time.Hour
+const defaultBattleMinKills = 3
+const defaultBattlesPeriod = 7 * 24 * time.Hour
+
+// Killmails loaded around the requested one, longer battles are truncated
+const battleWindow = 12 * time.Hour
+
+// Serves /battles/
+func getBattles(db *gorm.DB, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseKMFilter(query, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	gap, minKills, err := parseBattleParams(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	if filter.Until.IsZero() {
+		filter.Until = time.Now().UTC()
+	}
+	if filter.Since.IsZero() {
+		filter.Since = filter.Until.Add(-defaultBattlesPeriod)
+	}
+	KMs, err := getBattleKillmails(db, filter)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	battles := []common.Battle{}
+	for _, cluster := range clusterKillmails(KMs, getNeighbours(db, KMs), gap) {
+		if len(cluster) < minKills {
+			continue
+		}
+		battles = append(battles, buildBattle(db, cluster, false))
+	}
+	// Latest battles first, like killmails
+	sort.Slice(battles, func(i, j int) bool { return battles[i].Start.After(battles[j].Start) })
+	body, err := json.Marshal(battles)
+	if err != nil {
+		fmt.Println("ERROR sending battles")
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Serves /battle/{killmail_id}, the battle the killmail is part of
+func getBattle(db *gorm.DB, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	kmID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	gap, _, err := parseBattleParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	km := common.Killmail{}
+	db.Select("id", "killmail_time").Where("id = ?", kmID).Find(&km)
+	if km.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	filter := kmFilter{Since: km.KillmailTime.Add(-battleWindow), Until: km.KillmailTime.Add(battleWindow)}
+	KMs, err := getBattleKillmails(db, filter)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, cluster := range clusterKillmails(KMs, getNeighbours(db, KMs), gap) {
+		for _, clustered := range cluster {
+			if clustered.ID != km.ID {
+				continue
+			}
+			body, err := json.Marshal(buildBattle(db, cluster, true))
+			if err != nil {
+				fmt.Println("ERROR sending battle")
+			}
+			w.Header().Add("Content-Type", "application/json")
+			w.Write(body)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func parseBattleParams(query url.Values) (time.Duration, int, error) {
+	gap := defaultBattleGap
+	if value := query.Get("gap"); value != "" {
+		var err error
+		gap, err = time.ParseDuration(value)
+		if err != nil || gap <= 0 || gap > maxBattleGap {
+			return 0, 0, fmt.Errorf("%w: gap must be a duration up to %s", ErrInvalidFilter, maxBattleGap)
+		}
+	}
+	minKills := defaultBattleMinKills
+	if value := query.Get("min_kills"); value != "" {
+		var err error
+		minKills, err = strconv.Atoi(value)
+		if err != nil || minKills <= 0 {
+			return 0, 0, fmt.Errorf("%w: min_kills must be a positive integer", ErrInvalidFilter)
+		}
+	}
+	return gap, minKills, nil
+}
+
+func getBattleKillmails(db *gorm.DB, filter kmFilter) ([]common.Killmail, error) {
+	KMs := []common.Killmail{}
+	err := filter.apply(db).Order("killmails.killmail_time").Order("killmails.id").Preload("Attackers").Preload("Victim.Items.SubItems").Find(&KMs).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to query killmails for battles: %w", err)
+	}
+	return KMs, nil
+}
+
+func getNeighbours(db *gorm.DB, KMs []common.Killmail) map[uint]map[uint]bool {
+	systems := []uint{}
+	seen := make(map[uint]bool)
+	for _, km := range KMs {
+		if !seen[km.SolarSystemID] {
+			seen[km.SolarSystemID] = true
+			systems = append(systems, km.SolarSystemID)
+		}
+	}
+	jumps := []common.SolarSystemJump{}
+	if len(systems) > 0 {
+		db.Where("from_solar_system_id IN ?", systems).Find(&jumps)
+	}
+	res := make(map[uint]map[uint]bool)
+	for _, jump := range jumps {
+		if res[jump.FromSolarSystemID] == nil {
+			res[jump.FromSolarSystemID] = make(map[uint]bool)
+		}
+		res[jump.FromSolarSystemID][jump.ToSolarSystemID] = true
+	}
+	return res
+}
+
+// Killmails must be sorted by time. Two killmails are in the same battle when
+// they are at most gap apart, in the same or neighbouring solar systems, or
+// linked through other killmails of the battle.
+func clusterKillmails(KMs []common.Killmail, neighbours map[uint]map[uint]bool, gap time.Duration) [][]*common.Killmail {
+	parent := make([]int, len(KMs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range KMs {
+		for j := i - 1; j >= 0 && KMs[i].KillmailTime.Sub(KMs[j].KillmailTime) <= gap; j-- {
+			if KMs[i].SolarSystemID == KMs[j].SolarSystemID || neighbours[KMs[i].SolarSystemID][KMs[j].SolarSystemID] {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+	clusters := make(map[int][]*common.Killmail)
+	roots := []int{}
+	for i := range KMs {
+		root := find(i)
+		if _, ok := clusters[root]; !ok {
+			roots = append(roots, root)
+		}
+		clusters[root] = append(clusters[root], &KMs[i])
+	}
+	res := [][]*common.Killmail{}
+	for _, root := range roots {
+		res = append(res, clusters[root])
+	}
+	return res
+}
+
+func buildBattle(db *gorm.DB, KMs []*common.Killmail, withTimeline bool) common.Battle {
+	battle := common.Battle{ID: KMs[0].ID, Start: KMs[0].KillmailTime, End: KMs[len(KMs)-1].KillmailTime, Kills: uint(len(KMs))}
+	sides := inferSides(KMs)
+	battle.Sides = make([]common.BattleSide, sides.count())
+	pilots := make([]map[uint]bool, sides.count())
+	ships := make([]map[uint]*common.ShipStats, sides.count())
+	shipsLost := make([]map[uint]*common.ShipStats, sides.count())
+	flown := make(map[[2]uint]bool)
+	for i := range battle.Sides {
+		pilots[i] = make(map[uint]bool)
+		ships[i] = make(map[uint]*common.ShipStats)
+		shipsLost[i] = make(map[uint]*common.ShipStats)
+	}
+	addPilot := func(side int, characterID uint, shipTypeID uint) {
+		if characterID != 0 {
+			pilots[side][characterID] = true
+		}
+		if shipTypeID == 0 || (characterID != 0 && flown[[2]uint{characterID, shipTypeID}]) {
+			return
+		}
+		flown[[2]uint{characterID, shipTypeID}] = true
+		getShipStats(ships[side], shipTypeID).Count++
+	}
+	systems := make(map[uint]*common.SystemStats)
+	systemIDs := []uint{}
+	for _, km := range KMs {
+		value := getKillmailValue(km)
+		battle.ISKLost += value
+		victimSide := sides.of(km.Victim.AllianceID, km.Victim.CorporationID)
+		battle.Sides[victimSide].Losses++
+		battle.Sides[victimSide].ISKLost += value
+		lost := getShipStats(shipsLost[victimSide], km.Victim.ShipTypeID)
+		lost.Count++
+		lost.Value += value
+		addPilot(victimSide, km.Victim.CharacterID, km.Victim.ShipTypeID)
+		for _, attacker := range *km.Attackers {
+			addPilot(sides.of(attacker.AllianceID, attacker.CorporationID), attacker.CharacterID, attacker.ShipTypeID)
+		}
+		system, ok := systems[km.SolarSystemID]
+		if !ok {
+			system = &common.SystemStats{SolarSystemID: km.SolarSystemID}
+			systems[km.SolarSystemID] = system
+			systemIDs = append(systemIDs, km.SolarSystemID)
+		}
+		system.Kills++
+		if withTimeline {
+			kill := common.BattleKill{EnrichedKMShort: getEnrichedKMShort(db, km, false, getRequestHome(nil)), VictimSide: victimSide}
+			battle.Timeline = append(battle.Timeline, kill)
+		}
+	}
+	for _, systemID := range systemIDs {
+		system := systems[systemID]
+		solarSystem := common.GetSolarSystem(db, systemID)
+		system.SolarSystemName = solarSystem.Name
+		system.RegionName = solarSystem.RegionName()
+		system.SecurityStatus = solarSystem.SecurityStatus
+		battle.SolarSystems = append(battle.SolarSystems, *system)
+	}
+	lock.RLock()
+	names := resolver
+	lock.RUnlock()
+	for i := range battle.Sides {
+		battle.Sides[i].Groups = sides.groups(i, names)
+		battle.Sides[i].Pilots = uint(len(pilots[i]))
+		battle.Sides[i].Ships = sortShipStats(ships[i], names, len(ships[i]))
+		battle.Sides[i].ShipsLost = sortShipStats(shipsLost[i], names, len(shipsLost[i]))
+	}
+	return battle
+}
+
+// battleSides splits the alliances, or corporations outside of an alliance,
+// into sides: groups attacking the same victims are allies unless they also
+// shot each other during the battle.
+type battleSides struct {
+	parent   map[uint]uint
+	enemies  map[uint]map[uint]bool
+	members  map[uint][]uint
+	index    map[uint]int
+	roots    []uint
+	alliance map[uint]bool
+}
+
+func getGroupID(allianceID uint, corporationID uint) uint {
+	if allianceID != 0 {
+		return allianceID
+	}
+	return corporationID
+}
+
+func inferSides(KMs []*common.Killmail) *battleSides {
+	s := &battleSides{
+		parent:   make(map[uint]uint),
+		enemies:  make(map[uint]map[uint]bool),
+		members:  make(map[uint][]uint),
+		index:    make(map[uint]int),
+		alliance: make(map[uint]bool),
+	}
+	for _, km := range KMs {
+		victim := s.add(km.Victim.AllianceID, km.Victim.CorporationID)
+		for _, attacker := range *km.Attackers {
+			group := s.add(attacker.AllianceID, attacker.CorporationID)
+			if group != victim {
+				s.enemies[victim][group] = true
+				s.enemies[group][victim] = true
+			}
+		}
+	}
+	for _, km := range KMs {
+		victim := getGroupID(km.Victim.AllianceID, km.Victim.CorporationID)
+		attackers := []uint{}
+		for _, attacker := range *km.Attackers {
+			group := getGroupID(attacker.AllianceID, attacker.CorporationID)
+			if group != victim {
+				attackers = append(attackers, group)
+			}
+		}
+		for i := 1; i < len(attackers); i++ {
+			s.union(attackers[0], attackers[i])
+		}
+	}
+	// Sides with the most groups first
+	for group := range s.parent {
+		if s.find(group) == group {
+			s.roots = append(s.roots, group)
+		}
+	}
+	sort.Slice(s.roots, func(i, j int) bool {
+		if len(s.members[s.roots[i]]) != len(s.members[s.roots[j]]) {
+			return len(s.members[s.roots[i]]) > len(s.members[s.roots[j]])
+		}
+		return s.roots[i] < s.roots[j]
+	})
+	for i, root := range s.roots {
+		s.index[root] = i
+	}
+	return s
+}
+
+func (s *battleSides) add(allianceID uint, corporationID uint) uint {
+	group := getGroupID(allianceID, corporationID)
+	if _, ok := s.parent[group]; !ok {
+		s.parent[group] = group
+		s.enemies[group] = make(map[uint]bool)
+		s.members[group] = []uint{group}
+		s.alliance[group] = allianceID != 0
+	}
+	return group
+}
+
+func (s *battleSides) find(group uint) uint {
+	if s.parent[group] != group {
+		s.parent[group] = s.find(s.parent[group])
+	}
+	return s.parent[group]
+}
+
+func (s *battleSides) union(a uint, b uint) {
+	rootA, rootB := s.find(a), s.find(b)
+	if rootA == rootB {
+		return
+	}
+	for _, member := range s.members[rootA] {
+		for enemy := range s.enemies[member] {
+			if s.find(enemy) == rootB {
+				return
+			}
+		}
+	}
+	s.parent[rootB] = rootA
+	s.members[rootA] = append(s.members[rootA], s.members[rootB]...)
+	delete(s.members, rootB)
+}
+
+func (s *battleSides) count() int {
+	return len(s.roots)
+}
+
+func (s *battleSides) of(allianceID uint, corporationID uint) int {
+	return s.index[s.find(getGroupID(allianceID, corporationID))]
+}
+
+func (s *battleSides) groups(side int, names *common.Resolver) []common.Name {
+	res := []common.Name{}
+	for _, group := range s.members[s.roots[side]] {
+		category := common.CategoryCorporation
+		if s.alliance[group] {
+			category = common.CategoryAlliance
+		}
+		res = append(res, common.Name{ID: group, Name: names.NameOf(group, category), Category: category})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+func TestClusterKillmails(t *testing.T) {
+	const jita, perimeter, amarr = 30000142, 30000144, 30002187
+	neighbours := map[uint]map[uint]bool{
+		jita:      {perimeter: true},
+		perimeter: {jita: true},
+	}
+	at := func(ID uint, minutes int, systemID uint) common.Killmail {
+		return common.Killmail{ID: ID, KillmailTime: testTime.Add(time.Duration(minutes) * time.Minute), SolarSystemID: systemID}
+	}
+	KMs := []common.Killmail{
+		at(1, 0, jita),
+		at(2, 10, jita),
+		// Next door, linked to the first ones
+		at(3, 12, perimeter),
+		// Close in time, but not a neighbour
+		at(4, 14, amarr),
+		// Only within gap of 3, through which it joins 1 and 2
+		at(5, 26, perimeter),
+		// More than gap after 5
+		at(6, 42, jita),
+		// Exactly gap after 6
+		at(7, 57, jita),
+	}
+	clusters := func(gap time.Duration) string {
+		res := [][]uint{}
+		for _, cluster := range clusterKillmails(KMs, neighbours, gap) {
+			IDs := []uint{}
+			for _, km := range cluster {
+				IDs = append(IDs, km.ID)
+			}
+			res = append(res, IDs)
+		}
+		return fmt.Sprint(res)
+	}
+	tests := []struct {
+		gap  time.Duration
+		want string
+	}{
+		{15 * time.Minute, "[[1 2 3 5] [4] [6 7]]"},
+		{16 * time.Minute, "[[1 2 3 5 6 7] [4]]"},
+		{time.Minute, "[[1] [2] [3] [4] [5] [6] [7]]"},
+	}
+	for _, test := range tests {
+		if got := clusters(test.gap); got != test.want {
+			t.Errorf("gap %s: got %s, want %s", test.gap, got, test.want)
+		}
+	}
+	if got := clusterKillmails(nil, neighbours, defaultBattleGap); len(got) != 0 {
+		t.Errorf("clusters without killmails: %v", got)
+	}
+}
+
+func TestInferSides(t *testing.T) {
+	kill := func(victimAlliance uint, victimCorporation uint, attackers ...[2]uint) *common.Killmail {
+		km := &common.Killmail{Victim: &common.Victim{AllianceID: victimAlliance, CorporationID: victimCorporation}, Attackers: &[]common.Attacker{}}
+		for _, attacker := range attackers {
+			*km.Attackers = append(*km.Attackers, common.Attacker{AllianceID: attacker[0], CorporationID: attacker[1]})
+		}
+		return km
+	}
+	KMs := []*common.Killmail{
+		// Alliance 200 and corporation 3 shoot alliance 100 together
+		kill(100, 1, [2]uint{200, 2}, [2]uint{0, 3}),
+		// Alliance 100 and corporation 4 shoot corporation 3 together
+		kill(0, 3, [2]uint{100, 1}, [2]uint{0, 4}),
+		// 100 already shot 200's side, they stay enemies on a shared victim
+		kill(0, 8, [2]uint{200, 2}, [2]uint{100, 1}),
+		// Shooting a member of its own alliance doesn't make it an enemy
+		kill(200, 2, [2]uint{200, 5}),
+		// Fights of their own
+		kill(0, 7, [2]uint{0, 6}),
+	}
+	sides := inferSides(KMs)
+	if sides.count() != 5 {
+		t.Fatalf("%d sides, want 5", sides.count())
+	}
+	names := common.NewResolver(nil)
+	got := []string{}
+	for i := 0; i < sides.count(); i++ {
+		groups := []string{}
+		for _, group := range sides.groups(i, names) {
+			groups = append(groups, fmt.Sprintf("%s:%d", group.Category, group.ID))
+		}
+		got = append(got, fmt.Sprint(groups))
+	}
+	want := "[[corporation:4 alliance:100] [corporation:3 alliance:200] [corporation:6] [corporation:7] [corporation:8]]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+	tests := []struct {
+		allianceID    uint
+		corporationID uint
+		side          int
+	}{
+		{100, 1, 0},
+		{100, 9, 0},
+		{0, 4, 0},
+		{200, 5, 1},
+		{0, 3, 1},
+		{0, 6, 2},
+		{0, 7, 3},
+		{0, 8, 4},
+	}
+	for _, test := range tests {
+		if side := sides.of(test.allianceID, test.corporationID); side != test.side {
+			t.Errorf("%d/%d: side %d, want %d", test.allianceID, test.corporationID, side, test.side)
+		}
+	}
+}
+
+func TestGetBattle(t *testing.T) {
+	db := newTestDB(t)
+	useTestGlobals(t, db, common.NewHomeEntities(nil, []uint{homeCorporationID}, nil))
+	const perimeterSystemID, amarrSystemID = 30000144, 30002187
+	db.Create(&[]common.SolarSystemJump{
+		{FromSolarSystemID: jitaSystemID, ToSolarSystemID: perimeterSystemID},
+		{FromSolarSystemID: perimeterSystemID, ToSolarSystemID: jitaSystemID},
+	})
+	newTestKillmail(t, db, 3001, 0, jitaSystemID, 98000002, homeCorporationID)
+	newTestKillmail(t, db, 3002, 5, perimeterSystemID, homeCorporationID, 98000002)
+	newTestKillmail(t, db, 3003, 10, jitaSystemID, 98000002, homeCorporationID)
+	newTestKillmail(t, db, 3004, 12, amarrSystemID, 98000003, homeCorporationID)
+	newTestKillmail(t, db, 3005, 60, jitaSystemID, 98000002, homeCorporationID)
+
+	tests := []struct {
+		path   string
+		status int
+		kills  string
+	}{
+		{"/battle/3002", http.StatusOK, "[3001 3002 3003]"},
+		{"/battle/3004", http.StatusOK, "[3004]"},
+		{"/battle/3005?gap=1h", http.StatusOK, "[3001 3002 3003 3005]"},
+		{"/battle/3006", http.StatusNotFound, ""},
+		{"/battle/first", http.StatusNotFound, ""},
+		{"/battle/3001?gap=forever", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		getBattle(db, rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.path, rec.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		battle := common.Battle{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &battle); err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		IDs := []uint{}
+		for _, kill := range battle.Timeline {
+			IDs = append(IDs, kill.ID)
+		}
+		if fmt.Sprint(IDs) != test.kills {
+			t.Errorf("%s: got %v, want %s", test.path, IDs, test.kills)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	getBattle(db, rec, httptest.NewRequest("GET", "/battle/3001", nil))
+	battle := common.Battle{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &battle); err != nil {
+		t.Fatal(err)
+	}
+	if battle.ID != 3001 || battle.Kills != 3 || len(battle.SolarSystems) != 2 || len(battle.Sides) != 2 {
+		t.Fatalf("battle %+v", battle)
+	}
+	// Sides of a single group are ordered by ID
+	for i, want := range []struct {
+		group  uint
+		losses uint
+		pilots uint
+	}{{homeCorporationID, 1, 3}, {98000002, 2, 3}} {
+		side := battle.Sides[i]
+		if len(side.Groups) != 1 || side.Groups[0].ID != want.group || side.Losses != want.losses || side.Pilots != want.pilots {
+			t.Errorf("side %d: %+v", i, side)
+		}
+	}
+	for _, kill := range battle.Timeline {
+		if victimSide := battle.Sides[kill.VictimSide].Groups[0].ID; victimSide != kill.Victim.CorporationID {
+			t.Errorf("killmail %d: victim on the side of %d", kill.ID, victimSide)
+		}
+	}
+}
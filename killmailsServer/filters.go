@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const defaultKMLimit = 100
+const maxKMLimit = 1000
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+type kmFilter struct {
+	Since         time.Time
+	Until         time.Time
+	SolarSystemID uint
+	RegionID      uint
+	CharacterID   uint
+	CorporationID uint
+	AllianceID    uint
+	ShipTypeID    uint
+	MinValue      float64
+	MaxValue      float64
+	Kind          string
+	Sort          string
+	Order         string
+	Limit         int
+	Cursor        uint
+	// Show names as they were at the time of the kill instead of the current ones
+	HistoricalNames bool
+	// Used by type when no entity is given
+	Home *common.HomeEntities
+	// Restricts killmails to the ones of a tenant
+	TenantID uint
+}
+
+func parseKMFilter(query url.Values, home *common.HomeEntities) (kmFilter, error) {
+	filter := kmFilter{Sort: "time", Order: "desc", Limit: defaultKMLimit, Home: home}
+	var err error
+	if filter.Since, err = parseTimeParam(query, "since"); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = parseTimeParam(query, "until"); err != nil {
+		return filter, err
+	}
+	uintParams := map[string]*uint{
+		"solar_system_id": &filter.SolarSystemID,
+		"region_id":       &filter.RegionID,
+		"character_id":    &filter.CharacterID,
+		"corporation_id":  &filter.CorporationID,
+		"alliance_id":     &filter.AllianceID,
+		"ship_type_id":    &filter.ShipTypeID,
+		"cursor":          &filter.Cursor,
+	}
+	for name, value := range uintParams {
+		if *value, err = parseUintParam(query, name); err != nil {
+			return filter, err
+		}
+	}
+	if filter.MinValue, err = parseFloatParam(query, "min_value"); err != nil {
+		return filter, err
+	}
+	if filter.MaxValue, err = parseFloatParam(query, "max_value"); err != nil {
+		return filter, err
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxKMLimit {
+			return filter, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidFilter, maxKMLimit)
+		}
+	}
+	filter.Kind = query.Get("type")
+	if filter.Kind != "" && filter.Kind != "kill" && filter.Kind != "loss" {
+		return filter, fmt.Errorf("%w: type must be kill or loss", ErrInvalidFilter)
+	}
+	if filter.Kind != "" && !filter.hasEntity() && (home == nil || home.Empty()) {
+		return filter, fmt.Errorf("%w: type requires character_id, corporation_id, alliance_id or home entities", ErrInvalidFilter)
+	}
+	if sort := query.Get("sort"); sort != "" {
+		if sort != "time" && sort != "id" {
+			return filter, fmt.Errorf("%w: sort must be time or id", ErrInvalidFilter)
+		}
+		filter.Sort = sort
+	}
+	if order := query.Get("order"); order != "" {
+		if order != "asc" && order != "desc" {
+			return filter, fmt.Errorf("%w: order must be asc or desc", ErrInvalidFilter)
+		}
+		filter.Order = order
+	}
+	if filter.HistoricalNames, err = parseNamesParam(query); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func parseNamesParam(query url.Values) (bool, error) {
+	switch query.Get("names") {
+	case "", "current":
+		return false, nil
+	case "kill":
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: names must be current or kill", ErrInvalidFilter)
+}
+
+func parseTimeParam(query url.Values, name string) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s must be a RFC3339 date", ErrInvalidFilter, name)
+	}
+	return t.UTC(), nil
+}
+
+func parseUintParam(query url.Values, name string) (uint, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	res, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be a positive integer", ErrInvalidFilter, name)
+	}
+	return uint(res), nil
+}
+
+func parseFloatParam(query url.Values, name string) (float64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	res, err := strconv.ParseFloat(value, 64)
+	if err != nil || res < 0 {
+		return 0, fmt.Errorf("%w: %s must be a positive number", ErrInvalidFilter, name)
+	}
+	return res, nil
+}
+
+func (f kmFilter) hasEntity() bool {
+	return f.CharacterID != 0 || f.CorporationID != 0 || f.AllianceID != 0
+}
+
+func (f kmFilter) hasValue() bool {
+	return f.MinValue != 0 || f.MaxValue != 0
+}
+
+func (f kmFilter) apply(db *gorm.DB) *gorm.DB {
+	query := db.Model(&common.Killmail{})
+	if !f.Since.IsZero() {
+		query = query.Where("killmails.killmail_time >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		query = query.Where("killmails.killmail_time < ?", f.Until)
+	}
+	if f.SolarSystemID != 0 {
+		query = query.Where("killmails.solar_system_id = ?", f.SolarSystemID)
+	}
+	if f.RegionID != 0 {
+		query = query.Where("killmails.solar_system_id IN (SELECT id FROM solar_systems WHERE region_id = ?)", f.RegionID)
+	}
+	if f.TenantID != 0 {
+		query = query.Where(tenantCondition, f.TenantID, f.TenantID, f.TenantID)
+	}
+	// Values are stored in the background, killmails not valued yet are left out
+	if f.MinValue != 0 {
+		query = query.Where("killmails.id IN (SELECT killmail_id FROM killmail_values WHERE deleted_at IS NULL AND value >= ?)", f.MinValue)
+	}
+	if f.MaxValue != 0 {
+		query = query.Where("killmails.id IN (SELECT killmail_id FROM killmail_values WHERE deleted_at IS NULL AND value <= ?)", f.MaxValue)
+	}
+	if f.ShipTypeID != 0 {
+		query = query.Where("killmails.id IN (SELECT killmail_id FROM victims WHERE ship_type_id = ?)", f.ShipTypeID)
+	}
+	entities := map[string]uint{
+		"character_id":   f.CharacterID,
+		"corporation_id": f.CorporationID,
+		"alliance_id":    f.AllianceID,
+	}
+	for column, id := range entities {
+		if id == 0 {
+			continue
+		}
+		victim := "killmails.id IN (SELECT killmail_id FROM victims WHERE " + column + " = ?)"
+		attacker := "killmails.id IN (SELECT killmail_id FROM attackers WHERE " + column + " = ?)"
+		switch f.Kind {
+		case "loss":
+			query = query.Where(victim, id)
+		case "kill":
+			query = query.Where(attacker, id)
+		default:
+			query = query.Where(db.Where(victim, id).Or(attacker, id))
+		}
+	}
+	if f.Kind != "" && !f.hasEntity() {
+		characters, corporations, alliances := f.Home.IDs()
+		homeCondition := "character_id IN ? OR corporation_id IN ? OR alliance_id IN ?"
+		victim := "killmails.id IN (SELECT killmail_id FROM victims WHERE " + homeCondition + ")"
+		attacker := "killmails.id IN (SELECT killmail_id FROM attackers WHERE " + homeCondition + ")"
+		switch f.Kind {
+		case "loss":
+			query = query.Where(victim, characters, corporations, alliances)
+		case "kill":
+			query = query.Where(attacker, characters, corporations, alliances).Not(victim, characters, corporations, alliances)
+		}
+	}
+	return query
+}
+
+func (f kmFilter) page(db *gorm.DB, cursor uint, limit int) ([]common.Killmail, error) {
+	KMs := []common.Killmail{}
+	query := f.apply(db)
+	direction := "<"
+	if f.Order == "asc" {
+		direction = ">"
+	}
+	if cursor != 0 {
+		if f.Sort == "id" {
+			query = query.Where("killmails.id "+direction+" ?", cursor)
+		} else {
+			last := common.Killmail{}
+			db.Select("id", "killmail_time").Where("id = ?", cursor).Find(&last)
+			if last.ID == 0 {
+				return nil, fmt.Errorf("%w: unknown cursor %d", ErrInvalidFilter, cursor)
+			}
+			query = query.Where("(killmails.killmail_time "+direction+" ? OR (killmails.killmail_time = ? AND killmails.id "+direction+" ?))", last.KillmailTime, last.KillmailTime, last.ID)
+		}
+	}
+	if f.Sort == "time" {
+		query = query.Order("killmails.killmail_time " + f.Order)
+	}
+	query = query.Order("killmails.id " + f.Order)
+	err := query.Preload("Attackers").Preload("Victim.Items.SubItems").Limit(limit).Find(&KMs).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to query killmails: %w", err)
+	}
+	return KMs, nil
+}
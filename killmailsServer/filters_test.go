@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const (
+	homeCorporationID = 98000001
+	jitaSystemID      = 30000142
+)
+
+var testTime = time.Date(2021, 12, 1, 20, 0, 0, 0, time.UTC)
+
+// newTestDB opens an empty database in a temporary directory
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(t.TempDir()+"/test.db"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&common.Mapping{}, &common.Killmail{}, &common.Attacker{}, &common.Victim{}, &common.Item{}, &common.SubItem{}, &common.Position{},
+		&common.SolarSystem{}, &common.Region{}, &common.Constellation{}, &common.SolarSystemJump{}, &common.KillmailValue{}, &common.PriceSnapshot{}, &common.Tenant{}, &common.KillmailSource{}, &common.NameHistory{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// useTestGlobals sets the names, home entities and prices the handlers use
+func useTestGlobals(t *testing.T, db *gorm.DB, homeEntities *common.HomeEntities) {
+	history, err := newPriceHistory(db, &stubPriceSource{name: "stub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := common.GetResolver(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	previousResolver, previousHome, previousPrices := resolver, home, prices
+	resolver, home, prices = names, homeEntities, history
+	lock.Unlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		resolver, home, prices = previousResolver, previousHome, previousPrices
+		lock.Unlock()
+	})
+}
+
+// newTestKillmail stores a killmail minutes after testTime, with a victim and a
+// single attacker
+func newTestKillmail(t *testing.T, db *gorm.DB, ID uint, minutes int, systemID uint, victimCorporationID uint, attackerCorporationID uint) common.Killmail {
+	km := common.Killmail{
+		ID:            ID,
+		Hash:          fmt.Sprintf("hash%d", ID),
+		KillmailTime:  testTime.Add(time.Duration(minutes) * time.Minute),
+		SolarSystemID: systemID,
+		Victim:        &common.Victim{CharacterID: 2112000000 + ID, CorporationID: victimCorporationID, ShipTypeID: 587},
+		Attackers:     &[]common.Attacker{{CharacterID: 2113000000 + ID, CorporationID: attackerCorporationID, ShipTypeID: 620, FinalBlow: true}},
+	}
+	if err := db.Create(&km).Error; err != nil {
+		t.Fatal(err)
+	}
+	return km
+}
+
+func getIDs(KMs []common.Killmail) string {
+	IDs := []uint{}
+	for _, km := range KMs {
+		IDs = append(IDs, km.ID)
+	}
+	return fmt.Sprint(IDs)
+}
+
+func TestParseKMFilter(t *testing.T) {
+	home := common.NewHomeEntities(nil, []uint{homeCorporationID}, nil)
+	tests := []struct {
+		query string
+		home  *common.HomeEntities
+		err   bool
+	}{
+		{"", nil, false},
+		{"since=2021-12-01T00:00:00Z&until=2021-12-02T00:00:00%2B02:00", nil, false},
+		{"since=yesterday", nil, true},
+		{"solar_system_id=30000142&cursor=1001&limit=1000", nil, false},
+		{"solar_system_id=-1", nil, true},
+		{"limit=0", nil, true},
+		{"limit=1001", nil, true},
+		{"min_value=1e6&max_value=2.5e9", nil, false},
+		{"min_value=-1", nil, true},
+		{"type=kill&corporation_id=98000001", nil, false},
+		{"type=kill", home, false},
+		{"type=kill", nil, true},
+		{"type=solo", home, true},
+		{"sort=id&order=asc", nil, false},
+		{"sort=value", nil, true},
+		{"order=up", nil, true},
+		{"names=kill", nil, false},
+		{"names=old", nil, true},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		_, err := parseKMFilter(query, test.home)
+		if test.err && !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%q: got %v, want %v", test.query, err, ErrInvalidFilter)
+		}
+		if !test.err && err != nil {
+			t.Errorf("%q: %s", test.query, err)
+		}
+	}
+
+	query, _ := url.ParseQuery("until=2021-12-02T00:00:00%2B02:00&cursor=1001")
+	filter, err := parseKMFilter(query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Until.Equal(time.Date(2021, 12, 1, 22, 0, 0, 0, time.UTC)) || filter.Until.Location() != time.UTC {
+		t.Errorf("until %s, want it in UTC", filter.Until)
+	}
+	if filter.Cursor != 1001 || filter.Limit != defaultKMLimit || filter.Sort != "time" || filter.Order != "desc" {
+		t.Errorf("defaults %+v", filter)
+	}
+}
+
+func TestKMFilterApply(t *testing.T) {
+	db := newTestDB(t)
+	newTestKillmail(t, db, 1001, 0, jitaSystemID, homeCorporationID, 98000002)
+	newTestKillmail(t, db, 1002, 10, jitaSystemID, 98000002, homeCorporationID)
+	newTestKillmail(t, db, 1003, 20, 30000144, 98000002, 98000003)
+	newTestKillmail(t, db, 1004, 30, jitaSystemID, 98000003, 98000002)
+	db.Create(&common.KillmailValue{KillmailID: 1001, Value: 1000000})
+	db.Create(&common.KillmailValue{KillmailID: 1002, Value: 50000000})
+	home := common.NewHomeEntities(nil, []uint{homeCorporationID}, nil)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "[1004 1003 1002 1001]"},
+		{"order=asc", "[1001 1002 1003 1004]"},
+		{"since=2021-12-01T20:10:00Z&until=2021-12-01T20:30:00Z", "[1003 1002]"},
+		{"solar_system_id=30000144", "[1003]"},
+		{"type=loss", "[1001]"},
+		{"type=kill", "[1002]"},
+		{"corporation_id=98000002", "[1004 1003 1002 1001]"},
+		{"corporation_id=98000002&type=kill", "[1004 1001]"},
+		{"corporation_id=98000002&type=loss", "[1003 1002]"},
+		// Killmails not valued yet are left out
+		{"min_value=10000000", "[1002]"},
+		{"max_value=10000000", "[1001]"},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		filter, err := parseKMFilter(query, home)
+		if err != nil {
+			t.Fatal(err)
+		}
+		KMs, err := filter.page(db, 0, filter.Limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := getIDs(KMs); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestKMFilterPageCursor(t *testing.T) {
+	db := newTestDB(t)
+	// 1002 and 1003 share their time, 1001 is the latest killmail
+	newTestKillmail(t, db, 1001, 30, jitaSystemID, 98000002, 98000003)
+	newTestKillmail(t, db, 1002, 10, jitaSystemID, 98000002, 98000003)
+	newTestKillmail(t, db, 1003, 10, jitaSystemID, 98000002, 98000003)
+	newTestKillmail(t, db, 1004, 0, jitaSystemID, 98000002, 98000003)
+	newTestKillmail(t, db, 1005, 20, jitaSystemID, 98000002, 98000003)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "[1001 1005 1003 1002 1004]"},
+		{"order=asc", "[1004 1002 1003 1005 1001]"},
+		{"sort=id", "[1005 1004 1003 1002 1001]"},
+		{"sort=id&order=asc", "[1001 1002 1003 1004 1005]"},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		filter, err := parseKMFilter(query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Pages of 2 follow each other through the cursor of their last killmail
+		all := []common.Killmail{}
+		cursor := uint(0)
+		for i := 0; i < 5; i++ {
+			KMs, err := filter.page(db, cursor, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all = append(all, KMs...)
+			if len(KMs) < 2 {
+				break
+			}
+			cursor = KMs[len(KMs)-1].ID
+		}
+		if got := getIDs(all); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.query, got, test.want)
+		}
+	}
+
+	filter, _ := parseKMFilter(url.Values{}, nil)
+	if _, err := filter.page(db, 999, 2); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("unknown cursor: got %v, want %v", err, ErrInvalidFilter)
+	}
+}
@@ -22,7 +22,7 @@ func getImageTypeAndId(urlPath string) (string, uint, error) {
 		return "", 0, errors.New("invalid Path")
 	}
 	imageType := pathElements[2]
-	if imageType != "renders" && imageType != "characters" && imageType != "corporations" && imageType != "types" {
+	if imageType != "renders" && imageType != "characters" && imageType != "corporations" && imageType != "alliances" && imageType != "types" {
 		return "", 0, errors.New("invalid Image Type")
 	}
 	imageIdstr := pathElements[3]
@@ -140,7 +140,7 @@ func getImageFromEsi(url string, etag string) ([]byte, string, error) {
 	if err != nil {
 		return nil, "", fmt.Errorf("cannot create request for image: %w", err)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := common.ESI.Do(req)
 	if err != nil {
 		return nil, "", err
 	}
@@ -159,6 +159,8 @@ func buildImageURL(imageType string, imageId uint, size uint) (string, error) {
 	switch imageType {
 	case "corporations":
 		return imageType + "/" + fmt.Sprintf("%d", imageId) + "/logo?size=" + fmt.Sprintf("%d", size), nil
+	case "alliances":
+		return imageType + "/" + fmt.Sprintf("%d", imageId) + "/logo?size=" + fmt.Sprintf("%d", size), nil
 	case "characters":
 		return imageType + "/" + fmt.Sprintf("%d", imageId) + "/portrait?size=" + fmt.Sprintf("%d", size), nil
 	case "types":
@@ -173,6 +175,8 @@ func getExpiryFromType(imageType string) int {
 	switch imageType {
 	case "corporations":
 		return 86400 * 3
+	case "alliances":
+		return 86400 * 3
 	case "characters":
 		return 86400 * 3
 	case "types":
@@ -209,6 +213,10 @@ func getSizeFromUrl(url url.URL) (uint, error) {
 		if size != 32 && size != 64 && size != 128 && size != 256 {
 			return 0, fmt.Errorf("invalid size parameter, invalid size: %d for %s", size, imageType)
 		}
+	case "alliances":
+		if size != 32 && size != 64 && size != 128 {
+			return 0, fmt.Errorf("invalid size parameter, invalid size: %d for %s", size, imageType)
+		}
 	case "renders":
 		if size != 32 && size != 64 && size != 128 && size != 256 && size != 512 {
 			return 0, fmt.Errorf("invalid size parameter, invalid size: %d for %s", size, imageType)
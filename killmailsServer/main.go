@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,63 +18,106 @@ import (
 )
 
 var lock sync.RWMutex
-var mappings map[uint]string
+var resolver *common.Resolver
+var home *common.HomeEntities
+var prices *priceHistory
 
 type KMWithMap struct {
 	Killmail    common.Killmail    `json:"killmail"`
 	SolarSystem common.SolarSystem `json:"solar_system"`
 }
 
-func getKMs(db *gorm.DB, w http.ResponseWriter, _ *http.Request) {
-	EnrichedKMs := []common.EnrichedKMShort{}
-	KMs := []common.Killmail{}
-	priceMap, err := getPrices()
+func getKMs(db *gorm.DB, w http.ResponseWriter, r *http.Request, tenant *common.Tenant) {
+	homeEntities := getRequestHome(tenant)
+	filter, err := parseKMFilter(r.URL.Query(), homeEntities)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	if tenant != nil {
+		filter.TenantID = tenant.ID
+	}
+	KMs, err := filter.page(db, filter.Cursor, filter.Limit)
 	if err != nil {
-		fmt.Println("ERROR getting prices")
+		fmt.Println(err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidFilter) {
+			status = http.StatusBadRequest
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error() + "\n"))
+		return
 	}
-	db.Preload("Attackers").Preload("Victim.Items.SubItems").Order("killmail_time desc").Find(&KMs)
+	EnrichedKMs := []common.EnrichedKMShort{}
 	for _, km := range KMs {
-		mapping := getKMMapping(&km)
-		enrichedKM := common.EnrichedKMShort{}
-		enrichedKM.ID = km.ID
-		enrichedKM.KillmailTime = km.KillmailTime
-		enrichedKM.MoonID = km.MoonID
-		enrichedKM.WarID = km.WarID
-		enrichedKM.Victim = common.EnrichedVictim{Victim: *km.Victim}
-		attackers := *km.Attackers
-		attacker := filterAttackers(attackers)
-		enrichedKM.Attacker = common.EnrichedAttacker{Attacker: attacker}
-		enrichKMShort(&enrichedKM, mapping)
-		solarSystem := common.GetSolarSystem(db, km.SolarSystemID)
-		enrichedKM.SolarSystem = *solarSystem
-		getKMPriceShort(&enrichedKM, priceMap)
-		EnrichedKMs = append(EnrichedKMs, enrichedKM)
+		EnrichedKMs = append(EnrichedKMs, getEnrichedKMShort(db, &km, filter.HistoricalNames, homeEntities))
+	}
+	// A short page is the last one
+	cursor := uint(0)
+	if len(KMs) == filter.Limit {
+		cursor = KMs[len(KMs)-1].ID
 	}
 	body, err := json.Marshal(EnrichedKMs)
 	if err != nil {
 		fmt.Println("ERROR sending KMs")
 	}
+	if cursor != 0 {
+		w.Header().Add("X-Next-Cursor", fmt.Sprintf("%d", cursor))
+	}
 	w.Header().Add("Content-Type", "application/json")
 	w.Write(body)
 }
 
-func getKM(db *gorm.DB, w http.ResponseWriter, r *http.Request) {
-	priceMap, _ := getPrices()
-	kmIdstr := strings.Split(r.URL.Path, "/")[2]
+func getEnrichedKMShort(db *gorm.DB, km *common.Killmail, historicalNames bool, homeEntities *common.HomeEntities) common.EnrichedKMShort {
+	mapping := getKMMapping(km, historicalNames)
+	enrichedKM := common.EnrichedKMShort{}
+	enrichedKM.ID = km.ID
+	enrichedKM.KillmailTime = km.KillmailTime
+	enrichedKM.MoonID = km.MoonID
+	enrichedKM.WarID = km.WarID
+	enrichedKM.Victim = common.EnrichedVictim{Victim: *km.Victim}
+	attackers := *km.Attackers
+	attacker := filterAttackers(attackers)
+	enrichedKM.Attacker = common.EnrichedAttacker{Attacker: attacker}
+	enrichKMShort(&enrichedKM, mapping)
+	solarSystem := common.GetSolarSystem(db, km.SolarSystemID)
+	enrichedKM.SolarSystem = *solarSystem
+	enrichedKM.RegionName = solarSystem.RegionName()
+	enrichedKM.ConstellationName = solarSystem.ConstellationName()
+	getKMPriceShort(&enrichedKM, prices)
+	enrichedKM.Status = homeEntities.Classify(km)
+	return enrichedKM
+}
+
+func getKM(db *gorm.DB, w http.ResponseWriter, r *http.Request, kmIdstr string, tenant *common.Tenant) {
 	kmId, err := strconv.ParseUint(kmIdstr, 10, 64)
 	if err != nil {
 		fmt.Println("Cannot parse km ID")
 		return
 	}
+	historicalNames, err := parseNamesParam(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
 	km := common.Killmail{}
-	db.Where("id = ?", kmId).Preload("Attackers").Preload("Victim.Items.SubItems").Preload("Attackers").Find(&km)
+	query := db.Where("id = ?", kmId)
+	if tenant != nil {
+		query = query.Where(tenantCondition, tenant.ID, tenant.ID, tenant.ID)
+	}
+	query.Preload("Attackers").Preload("Victim.Items.SubItems").Preload("Attackers").Find(&km)
 	if km.ID == 0 {
 		w.WriteHeader(404)
 		return
 	}
 	solarSystem := common.GetSolarSystem(db, km.SolarSystemID)
-	mapping := getKMMapping(&km)
+	mapping := getKMMapping(&km, historicalNames)
 	ekm := common.EnrichedKM{SolarSystem: *solarSystem}
+	ekm.RegionName = solarSystem.RegionName()
+	ekm.ConstellationName = solarSystem.ConstellationName()
 	ekm.Victim = common.EnrichedVictim{Victim: *km.Victim}
 	items := []common.EnrichedItem{}
 	if km.Victim.Items != nil {
@@ -97,7 +143,8 @@ func getKM(db *gorm.DB, w http.ResponseWriter, r *http.Request) {
 	}
 	ekm.Attackers = &attackers
 	enrichKM(&ekm, mapping)
-	getKMPrice(&ekm, priceMap)
+	getKMPrice(&ekm, prices)
+	ekm.Status = getRequestHome(tenant).Classify(&km)
 
 	body, err := json.Marshal(ekm)
 	if err != nil {
@@ -107,26 +154,31 @@ func getKM(db *gorm.DB, w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
-func getKMMapping(km *common.Killmail) map[uint]string {
+func getKMMapping(km *common.Killmail, historical bool) map[uint]string {
 	lock.RLock()
-	globalMapping := mappings
+	resolver := resolver
 	lock.RUnlock()
+	names := kmNames{resolver: resolver, historical: historical, at: km.KillmailTime}
 	mapping := make(map[uint]string)
 	for _, attacker := range *km.Attackers {
-		mapping[attacker.CharacterID] = globalMapping[attacker.CharacterID]
-		mapping[attacker.CorporationID] = globalMapping[attacker.CorporationID]
-		mapping[attacker.ShipTypeID] = globalMapping[attacker.ShipTypeID]
-		mapping[attacker.WeaponTypeID] = globalMapping[attacker.WeaponTypeID]
-	}
-	mapping[km.Victim.CharacterID] = globalMapping[km.Victim.CharacterID]
-	mapping[km.Victim.CorporationID] = globalMapping[km.Victim.CorporationID]
-	mapping[km.Victim.ShipTypeID] = globalMapping[km.Victim.ShipTypeID]
+		mapping[attacker.CharacterID] = names.NameOf(attacker.CharacterID, common.CategoryCharacter)
+		mapping[attacker.CorporationID] = names.NameOf(attacker.CorporationID, common.CategoryCorporation)
+		mapping[attacker.AllianceID] = names.NameOf(attacker.AllianceID, common.CategoryAlliance)
+		mapping[attacker.FactionID] = names.NameOf(attacker.FactionID, common.CategoryFaction)
+		mapping[attacker.ShipTypeID] = names.NameOf(attacker.ShipTypeID, common.CategoryInventoryType)
+		mapping[attacker.WeaponTypeID] = names.NameOf(attacker.WeaponTypeID, common.CategoryInventoryType)
+	}
+	mapping[km.Victim.CharacterID] = names.NameOf(km.Victim.CharacterID, common.CategoryCharacter)
+	mapping[km.Victim.CorporationID] = names.NameOf(km.Victim.CorporationID, common.CategoryCorporation)
+	mapping[km.Victim.AllianceID] = names.NameOf(km.Victim.AllianceID, common.CategoryAlliance)
+	mapping[km.Victim.FactionID] = names.NameOf(km.Victim.FactionID, common.CategoryFaction)
+	mapping[km.Victim.ShipTypeID] = names.NameOf(km.Victim.ShipTypeID, common.CategoryInventoryType)
 	if km.Victim.Items != nil {
 		for _, item := range *km.Victim.Items {
-			mapping[item.ItemTypeID] = globalMapping[item.ItemTypeID]
+			mapping[item.ItemTypeID] = names.NameOf(item.ItemTypeID, common.CategoryInventoryType)
 			if item.SubItems != nil {
 				for _, subitem := range *item.SubItems {
-					mapping[subitem.ItemTypeID] = globalMapping[subitem.ItemTypeID]
+					mapping[subitem.ItemTypeID] = names.NameOf(subitem.ItemTypeID, common.CategoryInventoryType)
 				}
 			}
 		}
@@ -134,17 +186,32 @@ func getKMMapping(km *common.Killmail) map[uint]string {
 	return mapping
 }
 
+type kmNames struct {
+	resolver   *common.Resolver
+	historical bool
+	at         time.Time
+}
+
+func (n kmNames) NameOf(ID uint, category string) string {
+	if n.historical {
+		return n.resolver.NameAt(ID, category, n.at)
+	}
+	return n.resolver.NameOf(ID, category)
+}
+
 func enrichKMShort(km *common.EnrichedKMShort, mapping map[uint]string) {
 	km.Victim.CharacterName = mapping[km.Victim.CharacterID]
 	km.Victim.CharacterPortrait = getImageURLfromIDTypeSize(km.Victim.CharacterID, "characters", 64)
 	km.Victim.CorporationName = mapping[km.Victim.CorporationID]
 	km.Victim.CorporationLogo = getImageURLfromIDTypeSize(km.Victim.CorporationID, "corporations", 64)
+	enrichVictimAffiliation(&km.Victim, mapping)
 	km.Victim.ShipTypeName = mapping[km.Victim.ShipTypeID]
 	km.Victim.ShipTypeIcon = getImageURLfromIDTypeSize(km.Victim.ShipTypeID, "icons", 64)
 	km.Attacker.CharacterName = mapping[km.Attacker.CharacterID]
 	km.Attacker.CharacterPortrait = getImageURLfromIDTypeSize(km.Attacker.CharacterID, "characters", 64)
 	km.Attacker.CorporationName = mapping[km.Attacker.CorporationID]
 	km.Attacker.CorporationLogo = getImageURLfromIDTypeSize(km.Attacker.CorporationID, "corporations", 64)
+	enrichAttackerAffiliation(&km.Attacker, mapping)
 	km.Attacker.ShipTypeName = mapping[km.Attacker.ShipTypeID]
 	km.Attacker.ShipTypeIcon = getImageURLfromIDTypeSize(km.Attacker.ShipTypeID, "icons", 64)
 	km.Attacker.WeaponTypeName = mapping[km.Attacker.WeaponTypeID]
@@ -156,6 +223,7 @@ func enrichKM(km *common.EnrichedKM, mapping map[uint]string) {
 	km.Victim.CharacterPortrait = getImageURLfromIDTypeSize(km.Victim.CharacterID, "characters", 64)
 	km.Victim.CorporationName = mapping[km.Victim.CorporationID]
 	km.Victim.CorporationLogo = getImageURLfromIDTypeSize(km.Victim.CorporationID, "corporations", 64)
+	enrichVictimAffiliation(&km.Victim, mapping)
 	km.Victim.ShipTypeName = mapping[km.Victim.ShipTypeID]
 	km.Victim.ShipTypeIcon = getImageURLfromIDTypeSize(km.Victim.ShipTypeID, "icons", 64)
 	km.Victim.ShipTypeRender = getImageURLfromIDTypeSize(km.Victim.ShipTypeID, "renders", 128)
@@ -165,6 +233,7 @@ func enrichKM(km *common.EnrichedKM, mapping map[uint]string) {
 		attacker.CharacterPortrait = getImageURLfromIDTypeSize(attacker.CharacterID, "characters", 64)
 		attacker.CorporationName = mapping[attacker.CorporationID]
 		attacker.CorporationLogo = getImageURLfromIDTypeSize(attacker.CorporationID, "corporations", 64)
+		enrichAttackerAffiliation(&attacker, mapping)
 		attacker.ShipTypeName = mapping[attacker.ShipTypeID]
 		attacker.ShipTypeIcon = getImageURLfromIDTypeSize(attacker.ShipTypeID, "icons", 64)
 		attacker.WeaponTypeName = mapping[attacker.WeaponTypeID]
@@ -192,6 +261,26 @@ func enrichKM(km *common.EnrichedKM, mapping map[uint]string) {
 	}
 }
 
+func enrichVictimAffiliation(victim *common.EnrichedVictim, mapping map[uint]string) {
+	if victim.AllianceID != 0 {
+		victim.AllianceName = mapping[victim.AllianceID]
+		victim.AllianceLogo = getImageURLfromIDTypeSize(victim.AllianceID, "alliances", 64)
+	}
+	if victim.FactionID != 0 {
+		victim.FactionName = mapping[victim.FactionID]
+	}
+}
+
+func enrichAttackerAffiliation(attacker *common.EnrichedAttacker, mapping map[uint]string) {
+	if attacker.AllianceID != 0 {
+		attacker.AllianceName = mapping[attacker.AllianceID]
+		attacker.AllianceLogo = getImageURLfromIDTypeSize(attacker.AllianceID, "alliances", 64)
+	}
+	if attacker.FactionID != 0 {
+		attacker.FactionName = mapping[attacker.FactionID]
+	}
+}
+
 func filterAttackers(attackers []common.Attacker) common.Attacker {
 	for _, attacker := range attackers {
 		if attacker.FinalBlow {
@@ -211,38 +300,142 @@ func getImageURLfromIDTypeSize(ID uint, Type string, size uint) string {
 		return "/images/characters/" + fmt.Sprintf("%d", ID) + "/portrait?size=" + fmt.Sprintf("%d", size)
 	case "corporations":
 		return "/images/corporations/" + fmt.Sprintf("%d", ID) + "/logo?size=" + fmt.Sprintf("%d", size)
+	case "alliances":
+		return "/images/alliances/" + fmt.Sprintf("%d", ID) + "/logo?size=" + fmt.Sprintf("%d", size)
 	}
 	return ""
 }
 
+func parseHomeEntities(characters string, corporations string, alliances string) (*common.HomeEntities, error) {
+	characterIDs, err := common.ParseIDs(characters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home characters: %w", err)
+	}
+	corporationIDs, err := common.ParseIDs(corporations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home corporations: %w", err)
+	}
+	allianceIDs, err := common.ParseIDs(alliances)
+	if err != nil {
+		return nil, fmt.Errorf("invalid home alliances: %w", err)
+	}
+	return common.NewHomeEntities(characterIDs, corporationIDs, allianceIDs), nil
+}
+
+// Without configured home entities, the ones of the registered tokens are used
+func getHomeEntities(db *gorm.DB, configured *common.HomeEntities) (*common.HomeEntities, error) {
+	if !configured.Empty() {
+		return configured, nil
+	}
+	return common.GetTokensHomeEntities(db)
+}
+
 func main() {
+	priceSourceName := flag.String("prices", "esi", "price source used to value killmails: esi or jita")
+	homeCharacters := flag.String("home-characters", "", "comma separated character IDs killmails are classified for")
+	homeCorporations := flag.String("home-corporations", "", "comma separated corporation IDs killmails are classified for")
+	homeAlliances := flag.String("home-alliances", "", "comma separated alliance IDs killmails are classified for")
+	streamInterval := flag.Duration("stream-interval", defaultStreamInterval, "interval between polls for new killmails to stream")
+	addTenantID := flag.Uint("add-tenant", 0, "create the board of this corporation ID, or rename it, then exit")
+	tenantName := flag.String("tenant-name", "", "name of the board created with -add-tenant")
+	listTenantsFlag := flag.Bool("list-tenants", false, "list the corporation boards, then exit")
+	flag.Parse()
+	configuredHome, err := parseHomeEntities(*homeCharacters, *homeCorporations, *homeAlliances)
+	if err != nil {
+		panic(err)
+	}
 	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
 	if err != nil {
 		panic(err)
 	}
-	mappings, err = common.GetMappings(db)
+	db.AutoMigrate(&common.PriceSnapshot{}, &common.NameHistory{}, &common.KillmailSource{}, &common.Tenant{}, &common.KillmailValue{})
+	if *addTenantID != 0 || *listTenantsFlag {
+		if *addTenantID != 0 {
+			err = addTenant(db, *addTenantID, *tenantName)
+		}
+		if err == nil && *listTenantsFlag {
+			err = listTenants(db, os.Stdout)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	resolver, err = common.GetResolver(db)
+	if err != nil {
+		panic(err)
+	}
+	home, err = getHomeEntities(db, configuredHome)
+	if err != nil {
+		panic(err)
+	}
+	source, err := getPriceSource(*priceSourceName)
 	if err != nil {
 		panic(err)
 	}
+	prices, err = newPriceHistory(db, source)
+	if err != nil {
+		panic(err)
+	}
+	go prices.schedule(1 * time.Hour)
+	go prices.scheduleValues(valuesInterval)
+	feed, err := newKillmailFeed(db)
+	if err != nil {
+		panic(err)
+	}
+	go feed.poll(db, *streamInterval)
 	go func() {
 		for {
 			ticker := time.NewTicker(15 * time.Minute)
 			<-ticker.C
-			lock.Lock()
-			mappings, err = common.GetMappings(db)
+			names, err := common.GetResolver(db)
+			if err != nil {
+				fmt.Printf("ERROR refreshing mappings: %s\n", err)
+				continue
+			}
+			homeEntities, err := getHomeEntities(db, configuredHome)
 			if err != nil {
-				panic(err)
+				fmt.Printf("ERROR refreshing home entities: %s\n", err)
+				continue
 			}
+			lock.Lock()
+			resolver = names
+			home = homeEntities
 			lock.Unlock()
 		}
 	}()
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/killmails/", func(w http.ResponseWriter, r *http.Request) {
-		getKMs(db, w, r)
+		getKMs(db, w, r, nil)
+	})
+	mux.HandleFunc("/killmails/stream", func(w http.ResponseWriter, r *http.Request) {
+		streamKMs(db, feed, w, r, nil)
 	})
 	mux.HandleFunc("/killmail/", func(w http.ResponseWriter, r *http.Request) {
-		getKM(db, w, r)
+		getKM(db, w, r, strings.Split(r.URL.Path, "/")[2], nil)
+	})
+	mux.HandleFunc("/stats/", func(w http.ResponseWriter, r *http.Request) {
+		getStats(db, w, r, nil, strings.Trim(strings.TrimPrefix(r.URL.Path, "/stats"), "/"))
+	})
+	mux.HandleFunc("/character/", func(w http.ResponseWriter, r *http.Request) {
+		getProfile(db, w, r, common.CategoryCharacter)
+	})
+	mux.HandleFunc("/corporation/", func(w http.ResponseWriter, r *http.Request) {
+		getProfile(db, w, r, common.CategoryCorporation)
+	})
+	mux.HandleFunc("/battles/", func(w http.ResponseWriter, r *http.Request) {
+		getBattles(db, w, r)
+	})
+	mux.HandleFunc("/battle/", func(w http.ResponseWriter, r *http.Request) {
+		getBattle(db, w, r)
+	})
+	mux.HandleFunc("/corp/", func(w http.ResponseWriter, r *http.Request) {
+		getTenantRoute(db, feed, w, r)
+	})
+	mux.HandleFunc("/search/", func(w http.ResponseWriter, r *http.Request) {
+		search(w, r)
 	})
 	mux.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
 		getImage(db, w, r)
@@ -1,99 +1,162 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
 )
 
-func getPrices() (map[uint]float64, error) {
-	prices, err := getPricesFromCache()
+const maxCachedSnapshots = 32
+
+type priceHistory struct {
+	lock   sync.RWMutex
+	db     *gorm.DB
+	source priceSource
+	dates  []time.Time
+	maps   map[time.Time]map[uint]float64
+	// Held while killmail values are updated
+	valuesLock sync.Mutex
+}
+
+func newPriceHistory(db *gorm.DB, source priceSource) (*priceHistory, error) {
+	history := &priceHistory{db: db, source: source, maps: make(map[time.Time]map[uint]float64)}
+	err := history.loadDates()
 	if err != nil {
-		return nil, fmt.Errorf("unable to get prices from cache file: %w", err)
+		return nil, err
 	}
-	if prices != nil && len(*prices) != 0 {
-		pricesMap := getPricesMap(prices)
-		return pricesMap, nil
-	}
-	fmt.Println("Getting file from ESI.")
-	prices, err = getPricesFromESI()
+	return history, nil
+}
+
+func (h *priceHistory) loadDates() error {
+	dates := []time.Time{}
+	err := h.db.Model(&common.PriceSnapshot{}).Where("source = ?", h.source.Name()).Distinct("date").Order("date").Pluck("date", &dates).Error
 	if err != nil {
-		return nil, fmt.Errorf("unable to get prices from ESI: %w", err)
+		return fmt.Errorf("unable to load price snapshot dates: %w", err)
+	}
+	for i := range dates {
+		dates[i] = dates[i].UTC()
 	}
-	pricesMap := getPricesMap(prices)
-	return pricesMap, nil
+	h.lock.Lock()
+	h.dates = dates
+	h.lock.Unlock()
+	return nil
 }
 
-func getPricesFromCache() (*[]common.ItemPrice, error) {
-	payload, err := common.GetCache("prices", "market", 86400*3)
-	if err != nil {
-		if err == common.ErrCacheExpired {
-			fmt.Println("File too old, moving.")
-			common.MoveCacheFile("prices", "market")
-			return nil, nil
+func (h *priceHistory) has(date time.Time) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, d := range h.dates {
+		if d.Equal(date) {
+			return true
 		}
-		return nil, fmt.Errorf("unable to get cache file: %w", err)
 	}
-	prices := []common.ItemPrice{}
-	if payload != nil {
-		err := json.Unmarshal(payload, &prices)
-		if err != nil {
-			return nil, fmt.Errorf("unable to unmarshal cache file: %w", err)
-		}
+	return false
+}
+
+func (h *priceHistory) closestDate(t time.Time) (time.Time, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if len(h.dates) == 0 {
+		return time.Time{}, false
+	}
+	idx := sort.Search(len(h.dates), func(i int) bool {
+		return !h.dates[i].Before(t)
+	})
+	if idx == len(h.dates) {
+		return h.dates[idx-1], true
+	}
+	if idx == 0 {
+		return h.dates[0], true
+	}
+	if t.Sub(h.dates[idx-1]) <= h.dates[idx].Sub(t) {
+		return h.dates[idx-1], true
 	}
-	return &prices, nil
+	return h.dates[idx], true
 }
 
-func getPricesFromESI() (*[]common.ItemPrice, error) {
-	req, err := http.NewRequest("GET", common.EvePricesAPIUrl, nil)
+func (h *priceHistory) at(t time.Time) (map[uint]float64, bool) {
+	date, ok := h.closestDate(t)
+	if !ok {
+		return map[uint]float64{}, false
+	}
+	h.lock.RLock()
+	priceMap, ok := h.maps[date]
+	h.lock.RUnlock()
+	if ok {
+		return priceMap, true
+	}
+	snapshots := []common.PriceSnapshot{}
+	err := h.db.Where("source = ? AND date = ?", h.source.Name(), date).Find(&snapshots).Error
 	if err != nil {
-		return nil, fmt.Errorf("unable to create GET request for prices: %w", err)
+		fmt.Println("ERROR loading price snapshot:", err)
+		return map[uint]float64{}, false
+	}
+	priceMap = h.getPricesMap(snapshots)
+	h.lock.Lock()
+	if len(h.maps) >= maxCachedSnapshots {
+		for cached := range h.maps {
+			delete(h.maps, cached)
+			break
+		}
 	}
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("User-Agent", "CharName: Laszlo Bariani")
-	resp, err := http.DefaultClient.Do(req)
+	h.maps[date] = priceMap
+	h.lock.Unlock()
+	return priceMap, true
+}
+
+func (h *priceHistory) fetchSnapshot() error {
+	date := time.Now().UTC().Truncate(24 * time.Hour)
+	if h.has(date) {
+		return nil
+	}
+	fmt.Printf("Getting prices from %s source.\n", h.source.Name())
+	snapshots, err := h.source.Fetch(date)
 	if err != nil {
-		return nil, fmt.Errorf("unable to execute GET request for prices: %w", err)
+		return fmt.Errorf("unable to get prices from %s source: %w", h.source.Name(), err)
 	}
-	defer resp.Body.Close()
-	payload, err := ioutil.ReadAll(resp.Body)
+	if len(snapshots) == 0 {
+		return fmt.Errorf("no prices returned by %s source", h.source.Name())
+	}
+	err = h.db.CreateInBatches(&snapshots, 500).Error
 	if err != nil {
-		return nil, fmt.Errorf("unable to read GET request body for prices: %w", err)
+		return fmt.Errorf("unable to save price snapshot: %w", err)
 	}
-	prices := []common.ItemPrice{}
-	if payload != nil {
-		payload, err = common.SetCache("prices", "market", payload)
+	fmt.Printf("Saved %s price snapshot for %s: %d prices\n", h.source.Name(), date.Format("2006-01-02"), len(snapshots))
+	return h.loadDates()
+}
+
+func (h *priceHistory) schedule(interval time.Duration) {
+	for {
+		err := h.fetchSnapshot()
 		if err != nil {
-			return nil, fmt.Errorf("unable to set cache for prices: %w", err)
+			fmt.Println("ERROR fetching price snapshot:", err)
 		}
-		err := json.Unmarshal(payload, &prices)
+		// A new snapshot may be closer to the latest killmails
+		err = h.updateValues(true)
 		if err != nil {
-			return nil, fmt.Errorf("unable to unmarshal request body for prices: %w", err)
+			fmt.Println("ERROR updating killmail values:", err)
 		}
+		time.Sleep(interval)
 	}
-	return &prices, nil
 }
 
-func getPricesMap(itemPrices *[]common.ItemPrice) map[uint]float64 {
+func (h *priceHistory) getPricesMap(snapshots []common.PriceSnapshot) map[uint]float64 {
 	priceMap := make(map[uint]float64)
-	for _, itemPrice := range *itemPrices {
-		if itemPrice.AveragePrice == 0.0 {
-			priceMap[itemPrice.ItemTypeID] = itemPrice.AdjustedPrice
-		} else {
-			priceMap[itemPrice.ItemTypeID] = itemPrice.AveragePrice
-		}
+	for _, snapshot := range snapshots {
+		priceMap[snapshot.ItemTypeID] = h.source.Value(snapshot)
 	}
 	return priceMap
 }
 
-func pricesMapToJson(priceMap map[uint]float64) ([]byte, error) {
-	return json.Marshal(priceMap)
-}
-
-func getKMPrice(km *common.EnrichedKM, priceMap map[uint]float64) *common.EnrichedKM {
+func getKMPrice(km *common.EnrichedKM, history *priceHistory) *common.EnrichedKM {
+	priceMap, ok := history.at(km.KillmailTime)
+	if ok {
+		km.PriceSource = history.source.Name()
+	}
 	price := 0.0
 	price += priceMap[km.Victim.ShipTypeID]
 	km.ShipPrice = price
@@ -112,16 +175,11 @@ func getKMPrice(km *common.EnrichedKM, priceMap map[uint]float64) *common.Enrich
 	return km
 }
 
-func getKMPriceShort(km *common.EnrichedKMShort, priceMap map[uint]float64) *common.EnrichedKMShort {
-	price := 0.0
-	price += priceMap[km.Victim.ShipTypeID]
-	for _, item := range *km.Victim.Items {
-		itemPrice := priceMap[item.ItemTypeID]
-		priceDropped := itemPrice * float64(item.QuantityDropped)
-		priceDestroyed := itemPrice * float64(item.QuantityDestroyed)
-		price += priceDropped
-		price += priceDestroyed
+func getKMPriceShort(km *common.EnrichedKMShort, history *priceHistory) *common.EnrichedKMShort {
+	priceMap, ok := history.at(km.KillmailTime)
+	if ok {
+		km.PriceSource = history.source.Name()
 	}
-	km.Price = price
+	km.Price = getVictimValue(priceMap, &km.Victim.Victim)
 	return km
 }
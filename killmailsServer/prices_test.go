@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+// stubPriceSource returns its prices for any date, valued at their average
+type stubPriceSource struct {
+	name    string
+	prices  map[uint]float64
+	fetches int
+}
+
+func (s *stubPriceSource) Name() string {
+	return s.name
+}
+
+func (s *stubPriceSource) Fetch(date time.Time) ([]common.PriceSnapshot, error) {
+	s.fetches++
+	snapshots := []common.PriceSnapshot{}
+	for typeID, price := range s.prices {
+		snapshots = append(snapshots, common.PriceSnapshot{Source: s.name, Date: date, ItemTypeID: typeID, AveragePrice: price})
+	}
+	return snapshots, nil
+}
+
+func (s *stubPriceSource) Value(snapshot common.PriceSnapshot) float64 {
+	return snapshot.AveragePrice
+}
+
+func day(d int) time.Time {
+	return time.Date(2021, 12, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPriceSnapshotPersistence(t *testing.T) {
+	db := newTestDB(t)
+	source := &stubPriceSource{name: "stub", prices: map[uint]float64{587: 400000, 620: 9000000}}
+	history, err := newPriceHistory(db, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := history.fetchSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if source.fetches != 1 {
+		t.Errorf("%d fetches, want a single snapshot a day", source.fetches)
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if !history.has(today) {
+		t.Errorf("dates %v, want %s", history.dates, today)
+	}
+
+	// Snapshots are loaded again from the database, per source
+	db.Create(&common.PriceSnapshot{Source: "other", Date: day(1), ItemTypeID: 587, AveragePrice: 1})
+	reloaded, err := newPriceHistory(db, &stubPriceSource{name: "stub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.dates) != 1 || !reloaded.dates[0].Equal(today) {
+		t.Errorf("reloaded dates %v, want %s", reloaded.dates, today)
+	}
+	priceMap, ok := reloaded.at(today)
+	if !ok || priceMap[587] != 400000 || priceMap[620] != 9000000 {
+		t.Errorf("reloaded prices %v", priceMap)
+	}
+}
+
+func TestClosestDate(t *testing.T) {
+	db := newTestDB(t)
+	history, err := newPriceHistory(db, &stubPriceSource{name: "stub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := history.closestDate(day(1)); ok {
+		t.Error("a date was found without snapshots")
+	}
+	for _, d := range []int{3, 5, 10} {
+		db.Create(&common.PriceSnapshot{Source: "stub", Date: day(d), ItemTypeID: 587, AveragePrice: float64(d)})
+	}
+	if err := history.loadDates(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		at   time.Time
+		want int
+	}{
+		{"before the first snapshot", day(1), 3},
+		{"on the first snapshot", day(3), 3},
+		{"closer to the previous one", day(5).Add(50 * time.Hour), 5},
+		{"halfway keeps the previous one", day(4), 3},
+		{"closer to the next one", day(8), 10},
+		{"on the last snapshot", day(10), 10},
+		{"after the last snapshot", day(25), 10},
+	}
+	for _, test := range tests {
+		date, ok := history.closestDate(test.at)
+		if !ok || !date.Equal(day(test.want)) {
+			t.Errorf("%s: got %s, want %s", test.name, date, day(test.want))
+		}
+		priceMap, ok := history.at(test.at)
+		if !ok || priceMap[587] != float64(test.want) {
+			t.Errorf("%s: prices %v, want the ones of day %d", test.name, priceMap, test.want)
+		}
+	}
+}
+
+func TestUpdateValues(t *testing.T) {
+	db := newTestDB(t)
+	source := &stubPriceSource{name: "stub"}
+	db.Create(&common.PriceSnapshot{Source: "stub", Date: day(1), ItemTypeID: 587, AveragePrice: 400000})
+	history, err := newPriceHistory(db, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestKillmail(t, db, 1001, 0, jitaSystemID, 98000002, 98000003)
+	if err := history.updateValues(false); err != nil {
+		t.Fatal(err)
+	}
+	value := common.KillmailValue{}
+	db.First(&value, "killmail_id = ?", 1001)
+	if value.Value != 400000 || !value.Date.Equal(day(1)) {
+		t.Errorf("value %+v, want the one of the first snapshot", value)
+	}
+
+	// A closer snapshot values the killmail again on a full pass only
+	db.Create(&common.PriceSnapshot{Source: "stub", Date: day(2), ItemTypeID: 587, AveragePrice: 500000})
+	if err := history.loadDates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := history.updateValues(false); err != nil {
+		t.Fatal(err)
+	}
+	db.First(&value, "killmail_id = ?", 1001)
+	if value.Value != 400000 {
+		t.Errorf("value %f changed on a pass over the new killmails", value.Value)
+	}
+	if err := history.updateValues(true); err != nil {
+		t.Fatal(err)
+	}
+	db.First(&value, "killmail_id = ?", 1001)
+	if value.Value != 500000 || !value.Date.Equal(day(2)) {
+		t.Errorf("value %+v, want the one of the closest snapshot", value)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+const jitaPercentile = 0.05
+
+type priceSource interface {
+	Name() string
+	Fetch(date time.Time) ([]common.PriceSnapshot, error)
+	Value(snapshot common.PriceSnapshot) float64
+}
+
+func getPriceSource(name string) (priceSource, error) {
+	switch name {
+	case "esi":
+		return &esiPriceSource{url: common.EvePricesAPIUrl}, nil
+	case "jita":
+		return &jitaPriceSource{url: fmt.Sprintf(common.EveMarketOrdersAPIUrl, common.TheForgeRegionID), locationID: common.JitaTradeHubID}, nil
+	}
+	return nil, fmt.Errorf("unknown price source: %s", name)
+}
+
+type esiPriceSource struct {
+	url string
+}
+
+func (s *esiPriceSource) Name() string {
+	return "esi"
+}
+
+func (s *esiPriceSource) Fetch(date time.Time) ([]common.PriceSnapshot, error) {
+	payload, err := common.ESI.GetCached(s.url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get prices: %w", err)
+	}
+	prices := []common.ItemPrice{}
+	err = json.Unmarshal(payload, &prices)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal request body for prices: %w", err)
+	}
+	snapshots := []common.PriceSnapshot{}
+	for _, price := range prices {
+		snapshots = append(snapshots, common.PriceSnapshot{Source: s.Name(), Date: date, ItemTypeID: price.ItemTypeID, AdjustedPrice: price.AdjustedPrice, AveragePrice: price.AveragePrice})
+	}
+	return snapshots, nil
+}
+
+func (s *esiPriceSource) Value(snapshot common.PriceSnapshot) float64 {
+	if snapshot.AveragePrice == 0.0 {
+		return snapshot.AdjustedPrice
+	}
+	return snapshot.AveragePrice
+}
+
+type jitaPriceSource struct {
+	url        string
+	locationID uint64
+}
+
+func (s *jitaPriceSource) Name() string {
+	return "jita"
+}
+
+func (s *jitaPriceSource) Fetch(date time.Time) ([]common.PriceSnapshot, error) {
+	buyOrders := make(map[uint][]common.MarketOrder)
+	sellOrders := make(map[uint][]common.MarketOrder)
+	pages := 1
+	for page := 1; page <= pages; page++ {
+		orders, total, err := s.fetchPage(page)
+		if err != nil {
+			return nil, err
+		}
+		pages = total
+		for _, order := range orders {
+			if order.LocationID != s.locationID {
+				continue
+			}
+			if order.IsBuyOrder {
+				buyOrders[order.ItemTypeID] = append(buyOrders[order.ItemTypeID], order)
+			} else {
+				sellOrders[order.ItemTypeID] = append(sellOrders[order.ItemTypeID], order)
+			}
+		}
+	}
+	snapshots := make(map[uint]*common.PriceSnapshot)
+	for typeID, orders := range buyOrders {
+		sort.Slice(orders, func(i, j int) bool { return orders[i].Price > orders[j].Price })
+		snapshots[typeID] = &common.PriceSnapshot{Source: s.Name(), Date: date, ItemTypeID: typeID, BuyPrice: getOrdersPercentile(orders)}
+	}
+	for typeID, orders := range sellOrders {
+		sort.Slice(orders, func(i, j int) bool { return orders[i].Price < orders[j].Price })
+		snapshot, ok := snapshots[typeID]
+		if !ok {
+			snapshot = &common.PriceSnapshot{Source: s.Name(), Date: date, ItemTypeID: typeID}
+			snapshots[typeID] = snapshot
+		}
+		snapshot.SellPrice = getOrdersPercentile(orders)
+	}
+	res := []common.PriceSnapshot{}
+	for _, snapshot := range snapshots {
+		res = append(res, *snapshot)
+	}
+	return res, nil
+}
+
+func (s *jitaPriceSource) fetchPage(page int) ([]common.MarketOrder, int, error) {
+	url := s.url + "?order_type=all&page=" + strconv.Itoa(page)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to create GET request for market orders: %w", err)
+	}
+	req.Header.Add("Accept", "application/json")
+	resp, err := common.ESI.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to execute GET request for market orders: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("invalid Status Code for market orders page %d: %s", page, resp.Status)
+	}
+	pages := 1
+	if header := resp.Header.Get("X-Pages"); header != "" {
+		pages, err = strconv.Atoi(header)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid X-Pages header: %s", header)
+		}
+	}
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read GET request body for market orders: %w", err)
+	}
+	orders := []common.MarketOrder{}
+	err = json.Unmarshal(payload, &orders)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to unmarshal market orders: %w", err)
+	}
+	return orders, pages, nil
+}
+
+func (s *jitaPriceSource) Value(snapshot common.PriceSnapshot) float64 {
+	if snapshot.SellPrice == 0.0 {
+		return snapshot.BuyPrice
+	}
+	return snapshot.SellPrice
+}
+
+// Orders must be sorted best price first, the result is the price reached
+// once jitaPercentile of the total volume is filled, which ignores outliers.
+func getOrdersPercentile(orders []common.MarketOrder) float64 {
+	total := uint64(0)
+	for _, order := range orders {
+		total += uint64(order.VolumeRemain)
+	}
+	if total == 0 {
+		return 0
+	}
+	threshold := float64(total) * jitaPercentile
+	filled := 0.0
+	for _, order := range orders {
+		filled += float64(order.VolumeRemain)
+		if filled >= threshold {
+			return order.Price
+		}
+	}
+	return orders[len(orders)-1].Price
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+// newOrdersServer serves the order book fixtures as the pages of the ESI
+// market orders endpoint
+func newOrdersServer(t *testing.T, pages ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("order_type") != "all" {
+			t.Errorf("order_type = %q, want all", r.URL.Query().Get("order_type"))
+		}
+		var page int
+		if _, err := fmt.Sscan(r.URL.Query().Get("page"), &page); err != nil || page < 1 || page > len(pages) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := ioutil.ReadFile(pages[page-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("X-Pages", fmt.Sprint(len(pages)))
+		w.Write(body)
+	}))
+}
+
+func TestJitaPriceSourceFetch(t *testing.T) {
+	server := newOrdersServer(t, "testdata/jita_orders_1.json", "testdata/jita_orders_2.json")
+	defer server.Close()
+	source := &jitaPriceSource{url: server.URL, locationID: common.JitaTradeHubID}
+	date := time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)
+	snapshots, err := source.Fetch(date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byType := make(map[uint]common.PriceSnapshot)
+	for _, snapshot := range snapshots {
+		if snapshot.Source != "jita" || !snapshot.Date.Equal(date) {
+			t.Errorf("snapshot %d has source %q and date %s", snapshot.ItemTypeID, snapshot.Source, snapshot.Date)
+		}
+		byType[snapshot.ItemTypeID] = snapshot
+	}
+	tests := []struct {
+		name   string
+		typeID uint
+		buy    float64
+		sell   float64
+		value  float64
+	}{
+		// 5% of the 1101 units on sale are filled at 110, on the second page,
+		// the cheaper order outside of Jita is ignored
+		{"percentile across pages", 587, 80, 110, 110},
+		{"single order", 34, 0, 5.5, 5.5},
+		{"empty sell side", 2488, 50, 0, 50},
+	}
+	for _, test := range tests {
+		snapshot, ok := byType[test.typeID]
+		if !ok {
+			t.Errorf("%s: no snapshot for type %d", test.name, test.typeID)
+			continue
+		}
+		if snapshot.BuyPrice != test.buy || snapshot.SellPrice != test.sell {
+			t.Errorf("%s: buy %v sell %v, want buy %v sell %v", test.name, snapshot.BuyPrice, snapshot.SellPrice, test.buy, test.sell)
+		}
+		if value := source.Value(snapshot); value != test.value {
+			t.Errorf("%s: value %v, want %v", test.name, value, test.value)
+		}
+	}
+	if _, ok := byType[35]; ok {
+		t.Errorf("type 35 is only sold outside of Jita but has a snapshot")
+	}
+	if len(byType) != 3 {
+		t.Errorf("got %d snapshots, want 3", len(byType))
+	}
+}
+
+func TestJitaPriceSourceFetchError(t *testing.T) {
+	server := newOrdersServer(t)
+	defer server.Close()
+	source := &jitaPriceSource{url: server.URL, locationID: common.JitaTradeHubID}
+	if _, err := source.Fetch(time.Now()); err == nil {
+		t.Error("expected an error for a missing page")
+	}
+}
+
+func TestGetOrdersPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		orders []common.MarketOrder
+		want   float64
+	}{
+		{"no orders", nil, 0},
+		{"no volume", []common.MarketOrder{{Price: 10}}, 0},
+		{"single order", []common.MarketOrder{{Price: 10, VolumeRemain: 3}}, 10},
+		{"outlier skipped", []common.MarketOrder{{Price: 1, VolumeRemain: 1}, {Price: 10, VolumeRemain: 99}}, 10},
+		{"threshold reached exactly", []common.MarketOrder{{Price: 1, VolumeRemain: 5}, {Price: 10, VolumeRemain: 95}}, 1},
+	}
+	for _, test := range tests {
+		if got := getOrdersPercentile(test.orders); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
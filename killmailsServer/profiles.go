@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const profileRecentKMs = 10
+
+// Serves /character/{id} and /corporation/{id}
+func getProfile(db *gorm.DB, w http.ResponseWriter, r *http.Request, category string) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	lock.RLock()
+	names := resolver
+	lock.RUnlock()
+	profile := common.Profile{ID: uint(ID), Category: category, Name: names.NameOf(uint(ID), category)}
+	if profile.Name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var homeEntities *common.HomeEntities
+	if category == common.CategoryCharacter {
+		homeEntities = common.NewHomeEntities([]uint{profile.ID}, nil, nil)
+		profile.Image = getImageURLfromIDTypeSize(profile.ID, "characters", 128)
+	} else {
+		homeEntities = common.NewHomeEntities(nil, []uint{profile.ID}, nil)
+		profile.Image = getImageURLfromIDTypeSize(profile.ID, "corporations", 128)
+	}
+	filter, top, err := parseStatsParams(r, homeEntities)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	if category == common.CategoryCharacter {
+		filter.CharacterID = profile.ID
+	} else {
+		filter.CorporationID = profile.ID
+	}
+	builder := newStatsBuilder(homeEntities)
+	err = builder.load(db, filter)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	profile.Stats = builder.build(db, top)
+	profile.Stats.Since = filter.Since
+	profile.Stats.Until = filter.Until
+	profile.ShipsFlown = builder.shipsFlown(top)
+
+	recent := kmFilter{Sort: "time", Order: "desc", CharacterID: filter.CharacterID, CorporationID: filter.CorporationID}
+	recent.Kind = "kill"
+	kills, err := recent.page(db, 0, profileRecentKMs)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	recent.Kind = "loss"
+	losses, err := recent.page(db, 0, profileRecentKMs)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	profile.RecentKills = []common.EnrichedKMShort{}
+	for _, km := range kills {
+		profile.RecentKills = append(profile.RecentKills, getEnrichedKMShort(db, &km, false, homeEntities))
+	}
+	profile.RecentLosses = []common.EnrichedKMShort{}
+	for _, km := range losses {
+		profile.RecentLosses = append(profile.RecentLosses, getEnrichedKMShort(db, &km, false, homeEntities))
+	}
+	setProfileAffiliation(&profile, kills, losses, homeEntities)
+
+	body, err := json.Marshal(profile)
+	if err != nil {
+		fmt.Println("ERROR sending profile")
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// The affiliation is the one of the latest killmail the entity appears on
+func setProfileAffiliation(profile *common.Profile, kills []common.Killmail, losses []common.Killmail, homeEntities *common.HomeEntities) {
+	var latest *common.Killmail
+	if len(kills) > 0 {
+		latest = &kills[0]
+	}
+	if len(losses) > 0 && (latest == nil || losses[0].KillmailTime.After(latest.KillmailTime)) {
+		latest = &losses[0]
+	}
+	if latest == nil {
+		return
+	}
+	mapping := getKMMapping(latest, false)
+	if homeEntities.Matches(latest.Victim.CharacterID, latest.Victim.CorporationID, latest.Victim.AllianceID) {
+		victim := common.EnrichedVictim{Victim: *latest.Victim}
+		victim.CorporationName = mapping[victim.CorporationID]
+		victim.CorporationLogo = getImageURLfromIDTypeSize(victim.CorporationID, "corporations", 64)
+		enrichVictimAffiliation(&victim, mapping)
+		profile.CorporationID, profile.CorporationName, profile.CorporationLogo = victim.CorporationID, victim.CorporationName, victim.CorporationLogo
+		profile.AllianceID, profile.AllianceName, profile.AllianceLogo = victim.AllianceID, victim.AllianceName, victim.AllianceLogo
+		return
+	}
+	for _, attacker_ := range *latest.Attackers {
+		if !homeEntities.Matches(attacker_.CharacterID, attacker_.CorporationID, attacker_.AllianceID) {
+			continue
+		}
+		attacker := common.EnrichedAttacker{Attacker: attacker_}
+		attacker.CorporationName = mapping[attacker.CorporationID]
+		attacker.CorporationLogo = getImageURLfromIDTypeSize(attacker.CorporationID, "corporations", 64)
+		enrichAttackerAffiliation(&attacker, mapping)
+		profile.CorporationID, profile.CorporationName, profile.CorporationLogo = attacker.CorporationID, attacker.CorporationName, attacker.CorporationLogo
+		profile.AllianceID, profile.AllianceName, profile.AllianceLogo = attacker.AllianceID, attacker.AllianceName, attacker.AllianceLogo
+		return
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+const defaultSearchLimit = 100
+const maxSearchLimit = 1000
+
+type searchResult struct {
+	common.Name
+	Image string `json:"image,omitempty"`
+}
+
+func search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	category := query.Get("category")
+	if name == "" && category == "" {
+		http.Error(w, "name or category parameter required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxSearchLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	cursor, err := parseUintParam(query, "cursor")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lock.RLock()
+	names := resolver
+	lock.RUnlock()
+	var matches []common.Name
+	if name == "" {
+		matches = names.Category(category)
+	} else {
+		matches = names.Lookup(name, category)
+	}
+	matches, next := pageNames(matches, cursor, limit)
+	res := []searchResult{}
+	for _, match := range matches {
+		res = append(res, searchResult{Name: match, Image: getImageURLfromName(match, 64)})
+	}
+	body, err := json.Marshal(res)
+	if err != nil {
+		fmt.Println("ERROR sending search results")
+	}
+	if next != 0 {
+		w.Header().Add("X-Next-Cursor", fmt.Sprintf("%d", next))
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// pageNames returns up to limit names following the cursor ID in names
+// ordered by ID, and the cursor of the next page when it is full
+func pageNames(names []common.Name, cursor uint, limit int) ([]common.Name, uint) {
+	start := sort.Search(len(names), func(i int) bool { return names[i].ID > cursor })
+	names = names[start:]
+	if len(names) < limit {
+		return names, 0
+	}
+	names = names[:limit]
+	return names, names[limit-1].ID
+}
+
+func getImageURLfromName(name common.Name, size uint) string {
+	imageType := name.ImageType()
+	if imageType == "" {
+		return ""
+	}
+	return getImageURLfromIDTypeSize(name.ID, imageType, size)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+func TestSearch(t *testing.T) {
+	db := newTestDB(t)
+	// Out of ID order, as stored
+	db.Create(&[]common.Mapping{
+		{ID: 2112000005, Name: "Pilot Five", Category: common.CategoryCharacter},
+		{ID: 2112000001, Name: "Pilot One", Category: common.CategoryCharacter},
+		{ID: 2112000003, Name: "Pilot Three", Category: common.CategoryCharacter},
+		{ID: 2112000004, Name: "Pilot", Category: common.CategoryCharacter},
+		{ID: 2112000002, Name: "Pilot Two", Category: common.CategoryCharacter},
+		{ID: 98000002, Name: "Pilot", Category: common.CategoryCorporation},
+	})
+	useTestGlobals(t, db, common.NewHomeEntities(nil, nil, nil))
+
+	tests := []struct {
+		query  string
+		status int
+		want   string
+		next   string
+	}{
+		{"category=character", http.StatusOK, "[2112000001 2112000002 2112000003 2112000004 2112000005]", ""},
+		{"category=character&limit=2", http.StatusOK, "[2112000001 2112000002]", "2112000002"},
+		{"category=character&limit=2&cursor=2112000002", http.StatusOK, "[2112000003 2112000004]", "2112000004"},
+		{"category=character&limit=2&cursor=2112000004", http.StatusOK, "[2112000005]", ""},
+		// A full last page still has a cursor, giving an empty page
+		{"category=character&limit=1&cursor=2112000004", http.StatusOK, "[2112000005]", "2112000005"},
+		{"category=character&cursor=2112000005", http.StatusOK, "[]", ""},
+		{"name=pilot", http.StatusOK, "[98000002 2112000004]", ""},
+		{"name=pilot&limit=1", http.StatusOK, "[98000002]", "98000002"},
+		{"name=pilot&category=character", http.StatusOK, "[2112000004]", ""},
+		{"category=alliance", http.StatusOK, "[]", ""},
+		{"", http.StatusBadRequest, "", ""},
+		{"category=character&limit=0", http.StatusBadRequest, "", ""},
+		{"category=character&limit=1001", http.StatusBadRequest, "", ""},
+		{"category=character&cursor=last", http.StatusBadRequest, "", ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		search(rec, httptest.NewRequest("GET", "/search/?"+test.query, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.query, rec.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		results := []searchResult{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %s", test.query, err)
+		}
+		IDs := []uint{}
+		for _, result := range results {
+			IDs = append(IDs, result.ID)
+		}
+		if fmt.Sprint(IDs) != test.want {
+			t.Errorf("%s: got %v, want %s", test.query, IDs, test.want)
+		}
+		if next := rec.Header().Get("X-Next-Cursor"); next != test.next {
+			t.Errorf("%s: next cursor %q, want %q", test.query, next, test.next)
+		}
+	}
+}
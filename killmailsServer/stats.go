@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const defaultStatsPeriod = 30 * 24 * time.Hour
+const defaultStatsTop = 10
+const maxStatsTop = 100
+
+type statsBuilder struct {
+	home      *common.HomeEntities
+	stats     common.Stats
+	pilots    map[uint]*common.PilotStats
+	shipsUsed map[uint]*common.ShipStats
+	shipsLost map[uint]*common.ShipStats
+	systems   map[uint]*common.SystemStats
+}
+
+func newStatsBuilder(home *common.HomeEntities) *statsBuilder {
+	return &statsBuilder{
+		home:      home,
+		pilots:    make(map[uint]*common.PilotStats),
+		shipsUsed: make(map[uint]*common.ShipStats),
+		shipsLost: make(map[uint]*common.ShipStats),
+		systems:   make(map[uint]*common.SystemStats),
+	}
+}
+
+// Serves /stats/ and its sections: summary, pilots, ships and systems
+func getStats(db *gorm.DB, w http.ResponseWriter, r *http.Request, tenant *common.Tenant, section string) {
+	homeEntities := getRequestHome(tenant)
+	if homeEntities.Empty() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("stats require home entities\n"))
+		return
+	}
+	if section != "" && section != "summary" && section != "pilots" && section != "ships" && section != "systems" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	filter, top, err := parseStatsParams(r, homeEntities)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	if tenant != nil {
+		filter.TenantID = tenant.ID
+	}
+	builder := newStatsBuilder(homeEntities)
+	err = builder.load(db, filter)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	stats := builder.build(db, top)
+	stats.Since = filter.Since
+	stats.Until = filter.Until
+	if section != "" && section != "pilots" {
+		stats.TopFinalBlows = nil
+		stats.TopDamage = nil
+	}
+	if section != "" && section != "ships" {
+		stats.ShipsUsed = nil
+		stats.ShipsLost = nil
+	}
+	if section != "" && section != "systems" {
+		stats.Systems = nil
+	}
+	body, err := json.Marshal(stats)
+	if err != nil {
+		fmt.Println("ERROR sending stats")
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func parseStatsParams(r *http.Request, homeEntities *common.HomeEntities) (kmFilter, int, error) {
+	query := r.URL.Query()
+	filter, err := parseKMFilter(query, homeEntities)
+	if err != nil {
+		return filter, 0, err
+	}
+	if filter.Until.IsZero() {
+		filter.Until = time.Now().UTC()
+	}
+	if filter.Since.IsZero() {
+		filter.Since = filter.Until.Add(-defaultStatsPeriod)
+	}
+	top := defaultStatsTop
+	if value := query.Get("top"); value != "" {
+		top, err = strconv.Atoi(value)
+		if err != nil || top <= 0 || top > maxStatsTop {
+			return filter, 0, fmt.Errorf("%w: top must be between 1 and %d", ErrInvalidFilter, maxStatsTop)
+		}
+	}
+	return filter, top, nil
+}
+
+func (b *statsBuilder) load(db *gorm.DB, filter kmFilter) error {
+	KMs := []common.Killmail{}
+	err := filter.apply(db).Preload("Attackers").Preload("Victim.Items.SubItems").FindInBatches(&KMs, 500, func(tx *gorm.DB, batch int) error {
+		for i := range KMs {
+			b.add(&KMs[i], getKillmailValue(&KMs[i]))
+		}
+		return nil
+	}).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("unable to query killmails for stats: %w", err)
+	}
+	return nil
+}
+
+func (b *statsBuilder) add(km *common.Killmail, value float64) {
+	status := b.home.Classify(km)
+	if status == common.StatusInvolved {
+		return
+	}
+	system, ok := b.systems[km.SolarSystemID]
+	if !ok {
+		system = &common.SystemStats{SolarSystemID: km.SolarSystemID}
+		b.systems[km.SolarSystemID] = system
+	}
+	if status == common.StatusLoss {
+		b.stats.Losses++
+		b.stats.ISKLost += value
+		system.Losses++
+		ship := getShipStats(b.shipsLost, km.Victim.ShipTypeID)
+		ship.Count++
+		ship.Value += value
+		return
+	}
+	b.stats.Kills++
+	b.stats.ISKDestroyed += value
+	system.Kills++
+	if countPilots(*km.Attackers) == 1 {
+		b.stats.SoloKills++
+	} else {
+		b.stats.GangKills++
+	}
+	for _, attacker := range *km.Attackers {
+		if !b.home.Matches(attacker.CharacterID, attacker.CorporationID, attacker.AllianceID) {
+			continue
+		}
+		if attacker.ShipTypeID != 0 {
+			getShipStats(b.shipsUsed, attacker.ShipTypeID).Count++
+		}
+		if attacker.CharacterID == 0 {
+			continue
+		}
+		pilot, ok := b.pilots[attacker.CharacterID]
+		if !ok {
+			pilot = &common.PilotStats{CharacterID: attacker.CharacterID}
+			b.pilots[attacker.CharacterID] = pilot
+		}
+		pilot.Kills++
+		pilot.DamageDone += attacker.DamageDone
+		if attacker.FinalBlow {
+			pilot.FinalBlows++
+		}
+	}
+}
+
+func (b *statsBuilder) build(db *gorm.DB, top int) common.Stats {
+	stats := b.stats
+	if stats.ISKDestroyed+stats.ISKLost > 0 {
+		stats.Efficiency = stats.ISKDestroyed / (stats.ISKDestroyed + stats.ISKLost) * 100
+	}
+	lock.RLock()
+	names := resolver
+	lock.RUnlock()
+	pilots := []common.PilotStats{}
+	for _, pilot := range b.pilots {
+		pilot.CharacterName = names.NameOf(pilot.CharacterID, common.CategoryCharacter)
+		pilot.CharacterPortrait = getImageURLfromIDTypeSize(pilot.CharacterID, "characters", 64)
+		pilots = append(pilots, *pilot)
+	}
+	sort.Slice(pilots, func(i, j int) bool {
+		if pilots[i].FinalBlows != pilots[j].FinalBlows {
+			return pilots[i].FinalBlows > pilots[j].FinalBlows
+		}
+		return pilots[i].CharacterID < pilots[j].CharacterID
+	})
+	stats.TopFinalBlows = append([]common.PilotStats{}, pilots[:topLength(len(pilots), top)]...)
+	sort.Slice(pilots, func(i, j int) bool {
+		if pilots[i].DamageDone != pilots[j].DamageDone {
+			return pilots[i].DamageDone > pilots[j].DamageDone
+		}
+		return pilots[i].CharacterID < pilots[j].CharacterID
+	})
+	stats.TopDamage = pilots[:topLength(len(pilots), top)]
+	stats.ShipsUsed = sortShipStats(b.shipsUsed, names, top)
+	stats.ShipsLost = sortShipStats(b.shipsLost, names, top)
+	systems := []common.SystemStats{}
+	for _, system := range b.systems {
+		solarSystem := common.GetSolarSystem(db, system.SolarSystemID)
+		system.SolarSystemName = solarSystem.Name
+		system.RegionName = solarSystem.RegionName()
+		system.SecurityStatus = solarSystem.SecurityStatus
+		systems = append(systems, *system)
+	}
+	sort.Slice(systems, func(i, j int) bool {
+		if systems[i].Kills+systems[i].Losses != systems[j].Kills+systems[j].Losses {
+			return systems[i].Kills+systems[i].Losses > systems[j].Kills+systems[j].Losses
+		}
+		return systems[i].SolarSystemID < systems[j].SolarSystemID
+	})
+	stats.Systems = systems[:topLength(len(systems), top)]
+	return stats
+}
+
+// Ships flown on kills and losses alike
+func (b *statsBuilder) shipsFlown(top int) []common.ShipStats {
+	lock.RLock()
+	names := resolver
+	lock.RUnlock()
+	ships := make(map[uint]*common.ShipStats)
+	for _, used := range []map[uint]*common.ShipStats{b.shipsUsed, b.shipsLost} {
+		for shipTypeID, ship := range used {
+			getShipStats(ships, shipTypeID).Count += ship.Count
+		}
+	}
+	return sortShipStats(ships, names, top)
+}
+
+func countPilots(attackers []common.Attacker) int {
+	res := 0
+	for _, attacker := range attackers {
+		if attacker.CharacterID != 0 {
+			res++
+		}
+	}
+	return res
+}
+
+func getShipStats(ships map[uint]*common.ShipStats, shipTypeID uint) *common.ShipStats {
+	ship, ok := ships[shipTypeID]
+	if !ok {
+		ship = &common.ShipStats{ShipTypeID: shipTypeID}
+		ships[shipTypeID] = ship
+	}
+	return ship
+}
+
+func sortShipStats(ships map[uint]*common.ShipStats, names *common.Resolver, top int) []common.ShipStats {
+	res := []common.ShipStats{}
+	for _, ship := range ships {
+		ship.ShipTypeName = names.NameOf(ship.ShipTypeID, common.CategoryInventoryType)
+		ship.ShipTypeIcon = getImageURLfromIDTypeSize(ship.ShipTypeID, "icons", 64)
+		res = append(res, *ship)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].ShipTypeID < res[j].ShipTypeID
+	})
+	return res[:topLength(len(res), top)]
+}
+
+func topLength(length int, top int) int {
+	if length < top {
+		return length
+	}
+	return top
+}
+
+func getKillmailValue(km *common.Killmail) float64 {
+	enrichedKM := common.EnrichedKMShort{KillmailTime: km.KillmailTime, Victim: common.EnrichedVictim{Victim: *km.Victim}}
+	getKMPriceShort(&enrichedKM, prices)
+	return enrichedKM.Price
+}
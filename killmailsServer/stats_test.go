@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const otherSystemID = 30002187
+
+// newStatsKillmail stores a killmail with the given attackers, the first one
+// dealing the final blow
+func newStatsKillmail(t *testing.T, db *gorm.DB, ID uint, minutes int, systemID uint, victim common.Victim, attackers ...common.Attacker) {
+	attackers[0].FinalBlow = true
+	km := common.Killmail{
+		ID:            ID,
+		Hash:          fmt.Sprintf("hash%d", ID),
+		KillmailTime:  testTime.Add(time.Duration(minutes) * time.Minute),
+		SolarSystemID: systemID,
+		Victim:        &victim,
+		Attackers:     &attackers,
+	}
+	if err := db.Create(&km).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newStatsDB(t *testing.T) *gorm.DB {
+	db := newTestDB(t)
+	date := testTime.Truncate(24 * time.Hour)
+	db.Create(&[]common.PriceSnapshot{
+		{Source: "stub", Date: date, ItemTypeID: 587, AveragePrice: 400000},
+		{Source: "stub", Date: date, ItemTypeID: 620, AveragePrice: 9000000},
+	})
+	useTestGlobals(t, db, common.NewHomeEntities(nil, []uint{homeCorporationID}, nil))
+
+	home := func(characterID uint, shipTypeID uint, damage uint) common.Attacker {
+		return common.Attacker{CharacterID: characterID, CorporationID: homeCorporationID, ShipTypeID: shipTypeID, DamageDone: damage}
+	}
+	other := common.Attacker{CharacterID: 2113000009, CorporationID: 98000002, ShipTypeID: 620, DamageDone: 1000}
+	npc := common.Attacker{ShipTypeID: 23707, DamageDone: 50}
+
+	// Gang kill: two home pilots with someone else
+	newStatsKillmail(t, db, 2001, 0, jitaSystemID, common.Victim{CharacterID: 2112000001, CorporationID: 98000002, ShipTypeID: 620},
+		home(2111000001, 587, 300), home(2111000002, 587, 500), other)
+	// Solo kill, NPCs don't count as pilots
+	newStatsKillmail(t, db, 2002, 30, jitaSystemID, common.Victim{CharacterID: 2112000002, CorporationID: 98000002, ShipTypeID: 587},
+		home(2111000001, 620, 100), npc)
+	newStatsKillmail(t, db, 2003, 60, otherSystemID, common.Victim{CharacterID: 2111000002, CorporationID: homeCorporationID, ShipTypeID: 620}, other)
+	// Neither a kill nor a loss
+	newStatsKillmail(t, db, 2004, 90, jitaSystemID, common.Victim{CharacterID: 2112000004, CorporationID: 98000002, ShipTypeID: 620}, other)
+	// Just before and at the end of the period
+	newStatsKillmail(t, db, 2005, -1, jitaSystemID, common.Victim{CharacterID: 2112000005, CorporationID: 98000002, ShipTypeID: 620}, home(2111000001, 587, 100))
+	newStatsKillmail(t, db, 2006, 120, jitaSystemID, common.Victim{CharacterID: 2111000001, CorporationID: homeCorporationID, ShipTypeID: 587}, other)
+	return db
+}
+
+func getTestStats(t *testing.T, db *gorm.DB, section string, params url.Values) (int, common.Stats) {
+	rec := httptest.NewRecorder()
+	getStats(db, rec, httptest.NewRequest("GET", "/stats/?"+params.Encode(), nil), nil, section)
+	stats := common.Stats{}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, stats
+}
+
+func TestStats(t *testing.T) {
+	db := newStatsDB(t)
+	params := url.Values{"since": {testTime.Format(time.RFC3339)}, "until": {testTime.Add(2 * time.Hour).Format(time.RFC3339)}}
+	status, stats := getTestStats(t, db, "", params)
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	if stats.Kills != 2 || stats.Losses != 1 {
+		t.Errorf("got %d kills and %d losses, want 2 and 1", stats.Kills, stats.Losses)
+	}
+	if stats.SoloKills != 1 || stats.GangKills != 1 {
+		t.Errorf("got %d solo and %d gang kills, want 1 and 1", stats.SoloKills, stats.GangKills)
+	}
+	if stats.ISKDestroyed != 9400000 || stats.ISKLost != 9000000 {
+		t.Errorf("got %.0f ISK destroyed and %.0f lost, want 9400000 and 9000000", stats.ISKDestroyed, stats.ISKLost)
+	}
+	if math.Abs(stats.Efficiency-9400000.0/18400000*100) > 1e-9 {
+		t.Errorf("efficiency %f", stats.Efficiency)
+	}
+
+	pilots := func(ranking []common.PilotStats) string {
+		res := []string{}
+		for _, pilot := range ranking {
+			res = append(res, fmt.Sprintf("%d:%d/%d/%d", pilot.CharacterID, pilot.Kills, pilot.FinalBlows, pilot.DamageDone))
+		}
+		return fmt.Sprint(res)
+	}
+	if got := pilots(stats.TopFinalBlows); got != "[2111000001:2/2/400 2111000002:1/0/500]" {
+		t.Errorf("top final blows %s", got)
+	}
+	if got := pilots(stats.TopDamage); got != "[2111000002:1/0/500 2111000001:2/2/400]" {
+		t.Errorf("top damage %s", got)
+	}
+	ships := func(ranking []common.ShipStats) string {
+		res := []string{}
+		for _, ship := range ranking {
+			res = append(res, fmt.Sprintf("%d:%d/%.0f", ship.ShipTypeID, ship.Count, ship.Value))
+		}
+		return fmt.Sprint(res)
+	}
+	// Only the ships of home pilots are counted as used
+	if got := ships(stats.ShipsUsed); got != "[587:2/0 620:1/0]" {
+		t.Errorf("ships used %s", got)
+	}
+	if got := ships(stats.ShipsLost); got != "[620:1/9000000]" {
+		t.Errorf("ships lost %s", got)
+	}
+	systems := []string{}
+	for _, system := range stats.Systems {
+		systems = append(systems, fmt.Sprintf("%d:%d/%d", system.SolarSystemID, system.Kills, system.Losses))
+	}
+	if fmt.Sprint(systems) != fmt.Sprintf("[%d:2/0 %d:0/1]", jitaSystemID, otherSystemID) {
+		t.Errorf("systems %v", systems)
+	}
+
+	// Rankings are cut to top, sections only keep theirs
+	params.Set("top", "1")
+	_, stats = getTestStats(t, db, "pilots", params)
+	if stats.Kills != 2 || len(stats.TopFinalBlows) != 1 || len(stats.TopDamage) != 1 || stats.ShipsUsed != nil || stats.Systems != nil {
+		t.Errorf("pilots section: %+v", stats)
+	}
+	_, stats = getTestStats(t, db, "summary", params)
+	if stats.TopFinalBlows != nil || stats.ShipsLost != nil || stats.Systems != nil {
+		t.Errorf("summary section: %+v", stats)
+	}
+	if status, _ = getTestStats(t, db, "battles", params); status != http.StatusNotFound {
+		t.Errorf("unknown section: status %d", status)
+	}
+}
+
+func TestStatsPeriod(t *testing.T) {
+	db := newStatsDB(t)
+	tests := []struct {
+		since  time.Time
+		until  time.Time
+		kills  uint
+		losses uint
+	}{
+		// since is included, until is not
+		{testTime.Add(-time.Minute), testTime.Add(2 * time.Hour), 3, 1},
+		{testTime, testTime.Add(2*time.Hour + time.Second), 2, 2},
+		{testTime.Add(time.Second), testTime.Add(time.Hour), 1, 0},
+		{testTime.Add(time.Hour), testTime.Add(time.Hour + time.Second), 0, 1},
+		{testTime.Add(3 * time.Hour), testTime.Add(4 * time.Hour), 0, 0},
+	}
+	for _, test := range tests {
+		params := url.Values{"since": {test.since.Format(time.RFC3339)}, "until": {test.until.Format(time.RFC3339)}}
+		status, stats := getTestStats(t, db, "summary", params)
+		if status != http.StatusOK {
+			t.Errorf("%s - %s: status %d", test.since, test.until, status)
+			continue
+		}
+		if stats.Kills != test.kills || stats.Losses != test.losses {
+			t.Errorf("%s - %s: got %d kills and %d losses, want %d and %d", test.since, test.until, stats.Kills, stats.Losses, test.kills, test.losses)
+		}
+		if !stats.Since.Equal(test.since) || !stats.Until.Equal(test.until) {
+			t.Errorf("%s - %s: period %s - %s", test.since, test.until, stats.Since, stats.Until)
+		}
+	}
+
+	// Without bounds, the last 30 days
+	status, stats := getTestStats(t, db, "summary", url.Values{})
+	if status != http.StatusOK || stats.Until.Sub(stats.Since) != defaultStatsPeriod || time.Since(stats.Until) > time.Minute {
+		t.Errorf("default period: status %d, %s - %s", status, stats.Since, stats.Until)
+	}
+	for _, params := range []url.Values{{"top": {"0"}}, {"top": {"101"}}, {"since": {"yesterday"}}} {
+		if status, _ = getTestStats(t, db, "", params); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", params.Encode(), status, http.StatusBadRequest)
+		}
+	}
+	useTestGlobals(t, db, common.NewHomeEntities(nil, nil, nil))
+	if status, _ = getTestStats(t, db, "", url.Values{}); status != http.StatusBadRequest {
+		t.Errorf("without home entities: status %d, want %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+const defaultStreamInterval = 5 * time.Second
+const streamKeepAlive = 30 * time.Second
+
+// streamMark is the position of a killmail in storage order. The getter
+// creates killmails in batches sharing the same creation time, the ID breaks
+// the ties.
+type streamMark struct {
+	CreatedAt time.Time
+	ID        uint
+}
+
+func (m streamMark) after(query *gorm.DB) *gorm.DB {
+	return query.Where("(killmails.created_at > ? OR (killmails.created_at = ? AND killmails.id > ?))", m.CreatedAt, m.CreatedAt, m.ID)
+}
+
+func (m streamMark) equal(other streamMark) bool {
+	return m.CreatedAt.Equal(other.CreatedAt) && m.ID == other.ID
+}
+
+// killmailFeed polls the database shared with the getter for newly stored
+// killmails and wakes up the streams when there are some.
+type killmailFeed struct {
+	lock    sync.Mutex
+	mark    streamMark
+	changed chan struct{}
+}
+
+func newKillmailFeed(db *gorm.DB) (*killmailFeed, error) {
+	mark, err := getLatestMark(db)
+	if err != nil {
+		return nil, err
+	}
+	return &killmailFeed{mark: mark, changed: make(chan struct{})}, nil
+}
+
+func (f *killmailFeed) poll(db *gorm.DB, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := f.update(db)
+		if err != nil {
+			fmt.Printf("ERROR polling killmails: %s\n", err)
+		}
+	}
+}
+
+// update wakes up the streams when the latest killmail changed
+func (f *killmailFeed) update(db *gorm.DB) error {
+	mark, err := getLatestMark(db)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !mark.equal(f.mark) {
+		f.mark = mark
+		close(f.changed)
+		f.changed = make(chan struct{})
+	}
+	return nil
+}
+
+// wait returns the latest mark and a channel closed when it moves
+func (f *killmailFeed) wait() (streamMark, <-chan struct{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.mark, f.changed
+}
+
+func getLatestMark(db *gorm.DB) (streamMark, error) {
+	mark := streamMark{}
+	err := db.Model(&common.Killmail{}).Select("created_at", "id").Order("created_at desc, id desc").Limit(1).Scan(&mark).Error
+	if err != nil {
+		return mark, fmt.Errorf("unable to get latest killmail: %w", err)
+	}
+	return mark, nil
+}
+
+// Serves /killmails/stream, pushing the killmails matching the filters as
+// Server-Sent Events when the getter stores them
+func streamKMs(db *gorm.DB, feed *killmailFeed, w http.ResponseWriter, r *http.Request, tenant *common.Tenant) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	homeEntities := getRequestHome(tenant)
+	filter, err := parseKMFilter(r.URL.Query(), homeEntities)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	if tenant != nil {
+		filter.TenantID = tenant.ID
+	}
+	mark, changed := feed.wait()
+	// Clients reconnecting resume after the last killmail they received
+	if lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		last := streamMark{}
+		db.Model(&common.Killmail{}).Select("created_at", "id").Where("id = ?", lastID).Scan(&last)
+		if last.ID != 0 {
+			mark = last
+		}
+	}
+	w.Header().Add("Content-Type", "text/event-stream")
+	w.Header().Add("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		mark, err = sendKMsAfter(db, w, filter, mark)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		flusher.Flush()
+		for waiting := true; waiting; {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-changed:
+				waiting = false
+			}
+		}
+		_, changed = feed.wait()
+	}
+}
+
+// sendKMsAfter writes the killmails stored after mark and returns the mark of
+// the last one sent.
+func sendKMsAfter(db *gorm.DB, w http.ResponseWriter, filter kmFilter, mark streamMark) (streamMark, error) {
+	for {
+		KMs := []common.Killmail{}
+		query := mark.after(filter.apply(db)).Order("killmails.created_at, killmails.id").Limit(maxKMLimit)
+		err := query.Preload("Attackers").Preload("Victim.Items.SubItems").Find(&KMs).Error
+		if err != nil {
+			return mark, fmt.Errorf("unable to query new killmails: %w", err)
+		}
+		for _, km := range KMs {
+			mark = streamMark{CreatedAt: km.CreatedAt, ID: km.ID}
+			enrichedKM := getEnrichedKMShort(db, &km, filter.HistoricalNames, filter.Home)
+			body, err := json.Marshal(enrichedKM)
+			if err != nil {
+				fmt.Println("ERROR sending KM")
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: killmail\ndata: %s\n\n", km.ID, body)
+			if err != nil {
+				return mark, fmt.Errorf("unable to write killmail %d to stream: %w", km.ID, err)
+			}
+		}
+		if len(KMs) < maxKMLimit {
+			return mark, nil
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+// newStoredKillmail stores a killmail as the getter does, in a batch created at
+// the given time
+func newStoredKillmail(t *testing.T, db *gorm.DB, ID uint, createdAt time.Time) {
+	km := common.Killmail{
+		ID:            ID,
+		Hash:          fmt.Sprintf("hash%d", ID),
+		KillmailTime:  testTime,
+		SolarSystemID: jitaSystemID,
+		Victim:        &common.Victim{CharacterID: 2112000000 + ID, CorporationID: 98000002, ShipTypeID: 587},
+		Attackers:     &[]common.Attacker{{CharacterID: 2113000000 + ID, CorporationID: homeCorporationID, ShipTypeID: 620, FinalBlow: true}},
+	}
+	km.CreatedAt = createdAt
+	if err := db.Create(&km).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamMarkAfter(t *testing.T) {
+	db := newTestDB(t)
+	first, second := testTime, testTime.Add(time.Second)
+	// IDs of a batch are not in time order
+	newStoredKillmail(t, db, 10, first)
+	newStoredKillmail(t, db, 5, first)
+	newStoredKillmail(t, db, 20, first)
+	newStoredKillmail(t, db, 3, second)
+
+	tests := []struct {
+		mark streamMark
+		want string
+	}{
+		{streamMark{}, "[5 10 20 3]"},
+		{streamMark{first, 5}, "[10 20 3]"},
+		{streamMark{first, 20}, "[3]"},
+		// The mark of a killmail since removed
+		{streamMark{first, 15}, "[20 3]"},
+		{streamMark{second, 3}, "[]"},
+	}
+	for _, test := range tests {
+		IDs := []uint{}
+		test.mark.after(db.Model(&common.Killmail{})).Order("killmails.created_at, killmails.id").Pluck("id", &IDs)
+		if fmt.Sprint(IDs) != test.want {
+			t.Errorf("after %d at %s: got %v, want %s", test.mark.ID, test.mark.CreatedAt, IDs, test.want)
+		}
+	}
+
+	mark, err := getLatestMark(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mark.equal(streamMark{second, 3}) {
+		t.Errorf("latest mark %d at %s, want 3 at %s", mark.ID, mark.CreatedAt, second)
+	}
+}
+
+// readStream returns the IDs of the first count killmail events of the stream
+func readStream(t *testing.T, server *httptest.Server, lastEventID string, count int, store func()) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/killmails/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if store != nil {
+		store()
+	}
+	IDs := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for len(IDs) < count && scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "id: ") {
+			IDs = append(IDs, strings.TrimPrefix(scanner.Text(), "id: "))
+		}
+	}
+	if len(IDs) < count {
+		t.Errorf("Last-Event-ID %q: stream ended after %v: %v", lastEventID, IDs, scanner.Err())
+	}
+	return fmt.Sprint(IDs)
+}
+
+func TestStreamResume(t *testing.T) {
+	db := newTestDB(t)
+	useTestGlobals(t, db, common.NewHomeEntities(nil, []uint{homeCorporationID}, nil))
+	first := testTime
+	newStoredKillmail(t, db, 10, first)
+	newStoredKillmail(t, db, 5, first)
+	newStoredKillmail(t, db, 20, first)
+	feed, err := newKillmailFeed(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamKMs(db, feed, w, r, nil)
+	}))
+	defer server.Close()
+
+	// Killmails of the same batch with a higher ID are sent again
+	if got := readStream(t, server, "5", 2, nil); got != "[10 20]" {
+		t.Errorf("resume after 5: got %s, want [10 20]", got)
+	}
+	if got := readStream(t, server, "10", 1, nil); got != "[20]" {
+		t.Errorf("resume after 10: got %s, want [20]", got)
+	}
+
+	// Unknown or invalid IDs start from the latest killmail, like new clients
+	next := uint(30)
+	for _, lastEventID := range []string{"", "999", "latest"} {
+		ID := next
+		next++
+		got := readStream(t, server, lastEventID, 1, func() {
+			newStoredKillmail(t, db, ID, first.Add(time.Duration(ID)*time.Second))
+			if err := feed.update(db); err != nil {
+				t.Error(err)
+			}
+		})
+		if got != fmt.Sprintf("[%d]", ID) {
+			t.Errorf("Last-Event-ID %q: got %s, want [%d]", lastEventID, got, ID)
+		}
+	}
+	if got := readStream(t, server, "20", 3, nil); got != "[30 31 32]" {
+		t.Errorf("resume after 20: got %s, want [30 31 32]", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Killmails found by the tenant tokens or involving its members
+const tenantCondition = "(killmails.id IN (SELECT killmail_id FROM killmail_sources WHERE corp_id = ?)" +
+	" OR killmails.id IN (SELECT killmail_id FROM victims WHERE corporation_id = ?)" +
+	" OR killmails.id IN (SELECT killmail_id FROM attackers WHERE corporation_id = ?))"
+
+// Serves /corp/{id}/killmails/, /corp/{id}/killmails/stream,
+// /corp/{id}/killmail/{killmail_id} and /corp/{id}/stats/
+func getTenantRoute(db *gorm.DB, feed *killmailFeed, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tenantID, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tenant := common.Tenant{}
+	db.Where("id = ?", tenantID).Find(&tenant)
+	if tenant.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case parts[2] == "killmails" && len(parts) == 3:
+		getKMs(db, w, r, &tenant)
+	case parts[2] == "killmails" && len(parts) == 4 && parts[3] == "stream":
+		streamKMs(db, feed, w, r, &tenant)
+	case parts[2] == "killmail" && len(parts) == 4:
+		getKM(db, w, r, parts[3], &tenant)
+	case parts[2] == "stats" && len(parts) == 3:
+		getStats(db, w, r, &tenant, "")
+	case parts[2] == "stats" && len(parts) == 4:
+		getStats(db, w, r, &tenant, parts[3])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// addTenant creates the board of a corporation, or renames it
+func addTenant(db *gorm.DB, ID uint, name string) error {
+	if ID == 0 || name == "" {
+		return fmt.Errorf("a tenant needs a corporation ID and a name")
+	}
+	tenant := common.Tenant{ID: ID, Name: name}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"name", "updated_at", "deleted_at"}),
+	}).Create(&tenant).Error
+	if err != nil {
+		return fmt.Errorf("unable to save tenant %d: %w", ID, err)
+	}
+	return nil
+}
+
+func listTenants(db *gorm.DB, out io.Writer) error {
+	tenants := []common.Tenant{}
+	err := db.Order("name, id").Find(&tenants).Error
+	if err != nil {
+		return fmt.Errorf("unable to load tenants: %w", err)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tBOARD\tCREATED")
+	for _, tenant := range tenants {
+		fmt.Fprintf(w, "%d\t%s\t/corp/%d/killmails/\t%s\n", tenant.ID, tenant.Name, tenant.ID, tenant.CreatedAt.Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+// A tenant killmails are classified for its corporation, other requests use
+// the server home entities.
+func getRequestHome(tenant *common.Tenant) *common.HomeEntities {
+	if tenant != nil {
+		return tenant.HomeEntities()
+	}
+	lock.RLock()
+	defer lock.RUnlock()
+	return home
+}
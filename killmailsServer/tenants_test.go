@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+)
+
+const tenantID = 98000010
+
+func TestTenantCondition(t *testing.T) {
+	db := newTestDB(t)
+	newTestKillmail(t, db, 1001, 0, jitaSystemID, tenantID, 98000002)
+	newTestKillmail(t, db, 1002, 10, jitaSystemID, 98000002, tenantID)
+	newTestKillmail(t, db, 1003, 20, jitaSystemID, 98000002, 98000003)
+	newTestKillmail(t, db, 1004, 30, jitaSystemID, 98000002, 98000003)
+	// Found by a tenant token, without a member on it
+	db.Create(&common.KillmailSource{KillmailID: 1003, TokenID: 1, CharID: 2112000001, CorpID: tenantID})
+	db.Create(&common.KillmailSource{KillmailID: 1004, TokenID: 2, CharID: 2112000002, CorpID: 98000003})
+
+	IDs := []uint{}
+	db.Model(&common.Killmail{}).Where(tenantCondition, tenantID, tenantID, tenantID).Order("id").Pluck("id", &IDs)
+	if fmt.Sprint(IDs) != "[1001 1002 1003]" {
+		t.Errorf("tenant killmails %v, want its loss, its kill and the one of its token", IDs)
+	}
+	IDs = []uint{}
+	db.Model(&common.Killmail{}).Where(tenantCondition, 98000004, 98000004, 98000004).Pluck("id", &IDs)
+	if len(IDs) != 0 {
+		t.Errorf("killmails %v for a corporation on none of them", IDs)
+	}
+}
+
+func TestTenantRoute(t *testing.T) {
+	db := newTestDB(t)
+	useTestGlobals(t, db, common.NewHomeEntities(nil, []uint{98000002}, nil))
+	newTestKillmail(t, db, 1001, 0, jitaSystemID, tenantID, 98000002)
+	newTestKillmail(t, db, 1002, 10, jitaSystemID, 98000002, 98000003)
+	if err := addTenant(db, tenantID, "Tenant Corp"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/corp/98000010/killmails/", http.StatusOK, "[1001:loss]"},
+		{"/corp/98000010/killmails/?type=loss", http.StatusOK, "[1001:loss]"},
+		{"/corp/98000010/killmails/?type=kill", http.StatusOK, "[]"},
+		{"/corp/98000010/killmail/1001", http.StatusOK, ""},
+		{"/corp/98000011/killmails/", http.StatusNotFound, ""},
+		{"/corp/tenant/killmails/", http.StatusNotFound, ""},
+		{"/corp/98000010/", http.StatusNotFound, ""},
+		{"/corp/98000010/battles/", http.StatusNotFound, ""},
+		{"/corp/98000010/killmails/?limit=0", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		getTenantRoute(db, nil, rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.path, rec.Code, test.status)
+			continue
+		}
+		if test.want == "" {
+			continue
+		}
+		KMs := []common.EnrichedKMShort{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &KMs); err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		got := []string{}
+		for _, km := range KMs {
+			got = append(got, fmt.Sprintf("%d:%s", km.ID, km.Status))
+		}
+		if fmt.Sprint(got) != test.want {
+			t.Errorf("%s: got %v, want %s", test.path, got, test.want)
+		}
+	}
+
+	// The server board classifies for the server home entities
+	rec := httptest.NewRecorder()
+	getKMs(db, rec, httptest.NewRequest("GET", "/killmails/", nil), nil)
+	KMs := []common.EnrichedKMShort{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &KMs); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, km := range KMs {
+		got = append(got, fmt.Sprintf("%d:%s", km.ID, km.Status))
+	}
+	if fmt.Sprint(got) != "[1002:loss 1001:kill]" {
+		t.Errorf("server board: got %v, want [1002:loss 1001:kill]", got)
+	}
+}
+
+func TestAddTenant(t *testing.T) {
+	db := newTestDB(t)
+	if err := addTenant(db, tenantID, ""); err == nil {
+		t.Error("a tenant without name was created")
+	}
+	for _, name := range []string{"Tenant Corp", "Renamed Corp"} {
+		if err := addTenant(db, tenantID, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Delete(&common.Tenant{}, tenantID)
+	if err := addTenant(db, tenantID, "Back Corp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addTenant(db, 98000011, "Another Corp"); err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.Buffer{}
+	if err := listTenants(db, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "98000011  Another Corp") || !strings.HasPrefix(lines[2], "98000010  Back Corp") {
+		t.Errorf("listed:\n%s", out.String())
+	}
+	if !strings.Contains(lines[2], "/corp/98000010/killmails/") {
+		t.Errorf("board path missing: %s", lines[2])
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm/clause"
+)
+
+const valuesBatchSize = 500
+
+// Killmails stored since the last pass are valued within valuesInterval
+const valuesInterval = 1 * time.Minute
+
+type valuedKillmail struct {
+	ID           uint
+	KillmailTime time.Time
+	Source       string
+	Date         time.Time
+}
+
+func getVictimValue(priceMap map[uint]float64, victim *common.Victim) float64 {
+	price := priceMap[victim.ShipTypeID]
+	if victim.Items == nil {
+		return price
+	}
+	for _, item := range *victim.Items {
+		itemPrice := priceMap[item.ItemTypeID]
+		price += itemPrice * float64(item.QuantityDropped)
+		price += itemPrice * float64(item.QuantityDestroyed)
+	}
+	return price
+}
+
+// updateValues stores the value of the killmails which have none, or with
+// all, the ones valued with another snapshot than the closest one.
+func (h *priceHistory) updateValues(all bool) error {
+	h.valuesLock.Lock()
+	defer h.valuesLock.Unlock()
+	lastID := uint(0)
+	for {
+		candidates := []valuedKillmail{}
+		query := h.db.Model(&common.Killmail{}).Select("killmails.id, killmails.killmail_time, killmail_values.source, killmail_values.date").
+			Joins("LEFT JOIN killmail_values ON killmail_values.killmail_id = killmails.id AND killmail_values.deleted_at IS NULL").
+			Where("killmails.id > ?", lastID).Order("killmails.id").Limit(valuesBatchSize)
+		if !all {
+			query = query.Where("killmail_values.id IS NULL")
+		}
+		err := query.Scan(&candidates).Error
+		if err != nil {
+			return fmt.Errorf("unable to get killmails to value: %w", err)
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		lastID = candidates[len(candidates)-1].ID
+		IDs := []uint{}
+		for _, candidate := range candidates {
+			date, _ := h.closestDate(candidate.KillmailTime)
+			if candidate.Source != h.source.Name() || !candidate.Date.Equal(date) {
+				IDs = append(IDs, candidate.ID)
+			}
+		}
+		if len(IDs) == 0 {
+			continue
+		}
+		KMs := []common.Killmail{}
+		err = h.db.Preload("Victim.Items").Where("id IN ?", IDs).Find(&KMs).Error
+		if err != nil {
+			return fmt.Errorf("unable to load killmails to value: %w", err)
+		}
+		values := []common.KillmailValue{}
+		for _, km := range KMs {
+			if km.Victim == nil {
+				continue
+			}
+			date, _ := h.closestDate(km.KillmailTime)
+			priceMap, _ := h.at(km.KillmailTime)
+			values = append(values, common.KillmailValue{KillmailID: km.ID, Source: h.source.Name(), Date: date, Value: getVictimValue(priceMap, km.Victim)})
+		}
+		if len(values) == 0 {
+			continue
+		}
+		err = h.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "killmail_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"source", "date", "value", "updated_at"}),
+		}).Create(&values).Error
+		if err != nil {
+			return fmt.Errorf("unable to save killmail values: %w", err)
+		}
+	}
+}
+
+// scheduleValues values the new killmails, the requests only read the stored
+// values and never wait for a pass
+func (h *priceHistory) scheduleValues(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := h.updateValues(false)
+		if err != nil {
+			fmt.Println("ERROR updating killmail values:", err)
+		}
+	}
+}
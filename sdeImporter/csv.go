@@ -0,0 +1,115 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type csvFile struct {
+	header map[string]int
+	rows   [][]string
+}
+
+func (f *csvFile) raw() bool {
+	return f.header != nil
+}
+
+func (f *csvFile) field(row []string, name string, index int) string {
+	if f.raw() {
+		idx, ok := f.header[name]
+		if !ok || idx >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[idx])
+	}
+	if index >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[index])
+}
+
+func (f *csvFile) require(names ...string) error {
+	if !f.raw() {
+		return nil
+	}
+	for _, name := range names {
+		if _, ok := f.header[name]; !ok {
+			return fmt.Errorf("missing column %s in header", name)
+		}
+	}
+	return nil
+}
+
+func readCSV(path string) (*csvFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	switch {
+	case strings.HasSuffix(path, ".bz2"):
+		reader = bzip2.NewReader(file)
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gzip %s: %w", path, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	res := &csvFile{}
+	if len(records) == 0 {
+		return res, nil
+	}
+	// Filtered files from static/ have no header, raw fuzzwork dumps start with one
+	if _, err := strconv.ParseUint(strings.TrimSpace(records[0][0]), 10, 64); err != nil {
+		res.header = make(map[string]int)
+		for i, name := range records[0] {
+			res.header[strings.TrimSpace(name)] = i
+		}
+		records = records[1:]
+	}
+	res.rows = records
+	return res, nil
+}
+
+func parseID(value string) (uint, error) {
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q", value)
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("invalid ID %q", value)
+	}
+	return uint(id), nil
+}
+
+// Types, groups and categories start at 0, with the #System entries of the SDE
+func parseTypeID(value string) (uint, error) {
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q", value)
+	}
+	return uint(id), nil
+}
+
+func parseName(value string) (string, error) {
+	if value == "" || value == "None" {
+		return "", fmt.Errorf("empty name")
+	}
+	return value, nil
+}
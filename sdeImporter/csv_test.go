@@ -0,0 +1,131 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestCSV(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if filepath.Ext(name) == ".gz" {
+		gz := gzip.NewWriter(file)
+		defer gz.Close()
+		if _, err := gz.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	if _, err := file.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadCSVHeaders(t *testing.T) {
+	filtered, err := readCSV(writeTestCSV(t, "filtered.csv", "30000142,,,,Jita,0.9459,10000002\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtered.raw() || len(filtered.rows) != 1 {
+		t.Errorf("filtered file: raw %t, %d rows", filtered.raw(), len(filtered.rows))
+	}
+	if name := filtered.field(filtered.rows[0], "solarSystemName", 4); name != "Jita" {
+		t.Errorf("filtered name %q", name)
+	}
+	if err := filtered.require("constellationID"); err != nil {
+		t.Errorf("filtered files have no header to check: %s", err)
+	}
+
+	raw, err := readCSV(writeTestCSV(t, "raw.csv.gz", "regionID, constellationID,solarSystemID,solarSystemName,security\n10000002,20000020,30000142,Jita,0.9459\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !raw.raw() || len(raw.rows) != 1 {
+		t.Fatalf("raw file: raw %t, %d rows", raw.raw(), len(raw.rows))
+	}
+	if name := raw.field(raw.rows[0], "solarSystemName", 4); name != "Jita" {
+		t.Errorf("raw name %q", name)
+	}
+	if constellation := raw.field(raw.rows[0], "constellationID", -1); constellation != "20000020" {
+		t.Errorf("raw constellation %q", constellation)
+	}
+	if err := raw.require("solarSystemID", "regionName"); err == nil {
+		t.Error("a missing column was accepted")
+	}
+}
+
+func TestParseSolarSystemsBadRows(t *testing.T) {
+	file, err := readCSV(writeTestCSV(t, "systems.csv", `30000142,,,,Jita,0.9459,10000002
+0,,,,Zero,0.5,10000002
+30000143,,,,None,0.5,10000002
+30000144,,,,Perimeter,high,10000002
+30000145,,,,Sobaseki,1.5,10000002
+30000146,,,,Saisio,0.8
+30000142,,,,Jita again,0.9459,10000002
+30000144,,,,Perimeter,0.9,10000002
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := importReport{}
+	solarSystems, err := parseSolarSystems(file, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(solarSystems) != 2 || solarSystems[0].Name != "Jita" || solarSystems[1].Name != "Perimeter" {
+		t.Errorf("parsed %+v", solarSystems)
+	}
+	if report.invalid != 6 {
+		t.Errorf("%d invalid rows, want 6", report.invalid)
+	}
+	if solarSystems[0].SecurityStatus != 0.9459 || solarSystems[0].RegionID != 10000002 || solarSystems[0].ConstellationID != 0 {
+		t.Errorf("Jita parsed as %+v", solarSystems[0])
+	}
+}
+
+func TestParseTypesKeepsSystemEntry(t *testing.T) {
+	file, err := readCSV(writeTestCSV(t, "types.csv", "typeID,groupID,typeName\n0,0,#System\n587,25,Rifter\nx,25,Broken\n620,26,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := importReport{}
+	types, err := parseInventoryTypes(file, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 2 || types[0].ID != 0 || types[0].Name != "#System" || types[1].ID != 587 {
+		t.Errorf("parsed %+v", types)
+	}
+	if report.invalid != 2 {
+		t.Errorf("%d invalid rows, want 2", report.invalid)
+	}
+	groups, err := parseTypeGroups(file, &importReport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 || groups[1].GroupID != 25 {
+		t.Errorf("type groups %+v", groups)
+	}
+}
+
+func TestParseJumpsBothDirections(t *testing.T) {
+	file, err := readCSV(writeTestCSV(t, "jumps.csv", "10000002,20000020,30000142,30000144\n10000002,20000020,30000144,30000142\n10000002,20000020,30000142,30000142\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := importReport{}
+	jumps, err := parseJumps(file, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jumps) != 2 || report.invalid != 1 {
+		t.Errorf("parsed %+v with %d invalid rows, want both directions once", jumps, report.invalid)
+	}
+}
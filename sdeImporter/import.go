@@ -0,0 +1,627 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const inventoryTypeCategory = "inventory_type"
+
+type importReport struct {
+	name      string
+	added     int
+	changed   int
+	removed   int
+	unchanged int
+	invalid   int
+}
+
+func (r importReport) String() string {
+	return fmt.Sprintf("%s: %d added, %d changed, %d removed, %d unchanged, %d invalid rows", r.name, r.added, r.changed, r.removed, r.unchanged, r.invalid)
+}
+
+func parseSolarSystems(file *csvFile, report *importReport) ([]common.SolarSystem, error) {
+	err := file.require("solarSystemID", "solarSystemName", "security", "regionID", "constellationID")
+	if err != nil {
+		return nil, err
+	}
+	res := []common.SolarSystem{}
+	seen := make(map[uint]bool)
+	for i, row := range file.rows {
+		solarSystem, err := parseSolarSystem(file, row)
+		if err == nil && seen[solarSystem.ID] {
+			err = fmt.Errorf("duplicate ID %d", solarSystem.ID)
+		}
+		if err != nil {
+			fmt.Printf("Skipping solar system row %d: %s\n", i+1, err)
+			report.invalid++
+			continue
+		}
+		seen[solarSystem.ID] = true
+		res = append(res, solarSystem)
+	}
+	return res, nil
+}
+
+func parseSolarSystem(file *csvFile, row []string) (common.SolarSystem, error) {
+	solarSystem := common.SolarSystem{}
+	id, err := parseID(file.field(row, "solarSystemID", 0))
+	if err != nil {
+		return solarSystem, err
+	}
+	name, err := parseName(file.field(row, "solarSystemName", 4))
+	if err != nil {
+		return solarSystem, err
+	}
+	security, err := strconv.ParseFloat(file.field(row, "security", 5), 64)
+	if err != nil || math.IsNaN(security) || security < -1 || security > 1 {
+		return solarSystem, fmt.Errorf("invalid security status %q", file.field(row, "security", 5))
+	}
+	regionID, err := parseID(file.field(row, "regionID", 6))
+	if err != nil {
+		return solarSystem, err
+	}
+	// Filtered files carry no constellation, keep the one already known
+	if file.raw() {
+		constellationID, err := parseID(file.field(row, "constellationID", -1))
+		if err != nil {
+			return solarSystem, err
+		}
+		solarSystem.ConstellationID = constellationID
+	}
+	solarSystem.ID = id
+	solarSystem.Name = name
+	solarSystem.SecurityStatus = security
+	solarSystem.RegionID = regionID
+	return solarSystem, nil
+}
+
+func parseInventoryTypes(file *csvFile, report *importReport) ([]common.Mapping, error) {
+	err := file.require("typeID", "typeName")
+	if err != nil {
+		return nil, err
+	}
+	res := []common.Mapping{}
+	seen := make(map[uint]bool)
+	for i, row := range file.rows {
+		id, err := parseTypeID(file.field(row, "typeID", 0))
+		if err == nil && seen[id] {
+			err = fmt.Errorf("duplicate ID %d", id)
+		}
+		var name string
+		if err == nil {
+			name, err = parseName(file.field(row, "typeName", 1))
+		}
+		if err != nil {
+			fmt.Printf("Skipping inventory type row %d: %s\n", i+1, err)
+			report.invalid++
+			continue
+		}
+		seen[id] = true
+		res = append(res, common.Mapping{ID: id, Name: name, Category: inventoryTypeCategory})
+	}
+	return res, nil
+}
+
+func parseRegions(file *csvFile, report *importReport) ([]common.Region, error) {
+	err := file.require("regionID", "regionName")
+	if err != nil {
+		return nil, err
+	}
+	res := []common.Region{}
+	seen := make(map[uint]bool)
+	for i, row := range file.rows {
+		id, err := parseID(file.field(row, "regionID", 0))
+		if err == nil && seen[id] {
+			err = fmt.Errorf("duplicate ID %d", id)
+		}
+		var name string
+		if err == nil {
+			name, err = parseName(file.field(row, "regionName", 4))
+		}
+		if err != nil {
+			fmt.Printf("Skipping region row %d: %s\n", i+1, err)
+			report.invalid++
+			continue
+		}
+		seen[id] = true
+		res = append(res, common.Region{ID: id, Name: name})
+	}
+	return res, nil
+}
+
+func parseConstellations(file *csvFile, report *importReport) ([]common.Constellation, error) {
+	err := file.require("constellationID", "constellationName", "regionID")
+	if err != nil {
+		return nil, err
+	}
+	res := []common.Constellation{}
+	seen := make(map[uint]bool)
+	for i, row := range file.rows {
+		id, err := parseID(file.field(row, "constellationID", 0))
+		if err == nil && seen[id] {
+			err = fmt.Errorf("duplicate ID %d", id)
+		}
+		var name string
+		if err == nil {
+			name, err = parseName(file.field(row, "constellationName", 4))
+		}
+		var regionID uint
+		if err == nil {
+			regionID, err = parseID(file.field(row, "regionID", 5))
+		}
+		if err != nil {
+			fmt.Printf("Skipping constellation row %d: %s\n", i+1, err)
+			report.invalid++
+			continue
+		}
+		seen[id] = true
+		res = append(res, common.Constellation{ID: id, Name: name, RegionID: regionID})
+	}
+	return res, nil
+}
+
+type jumpKey struct {
+	from uint
+	to   uint
+}
+
+// Jumps are stored in both directions, whatever the dump holds
+func parseJumps(file *csvFile, report *importReport) ([]common.SolarSystemJump, error) {
+	err := file.require("fromSolarSystemID", "toSolarSystemID")
+	if err != nil {
+		return nil, err
+	}
+	res := []common.SolarSystemJump{}
+	seen := make(map[jumpKey]bool)
+	for i, row := range file.rows {
+		from, err := parseID(file.field(row, "fromSolarSystemID", 2))
+		var to uint
+		if err == nil {
+			to, err = parseID(file.field(row, "toSolarSystemID", 3))
+		}
+		if err == nil && from == to {
+			err = fmt.Errorf("jump from %d to itself", from)
+		}
+		if err != nil {
+			fmt.Printf("Skipping jump row %d: %s\n", i+1, err)
+			report.invalid++
+			continue
+		}
+		for _, key := range []jumpKey{{from, to}, {to, from}} {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			res = append(res, common.SolarSystemJump{FromSolarSystemID: key.from, ToSolarSystemID: key.to})
+		}
+	}
+	return res, nil
+}
+
+// Groups of inventory types are only available from the raw invTypes dump
+func parseTypeGroups(file *csvFile, report *importReport) ([]common.InventoryType, error) {
+	err := file.require("typeID", "groupID")
+	if err != nil {
+		return nil, err
+	}
+	res := []common.InventoryType{}
+	seen := make(map[uint]bool)
+	for i, row := range file.rows {
+		id, err := parseTypeID(file.field(row, "typeID", 0))
+		if err == nil && seen[id] {
+			err = fmt.Errorf("duplicate ID %d", id)
+		}
+		var groupID uint
+		if err == nil {
+			groupID, err = parseTypeID(file.field(row, "groupID", 1))
+		}
+		if err != nil {
+			fmt.Printf("Skipping inventory type group row %d: %s\n", i+1, err)
+			report.invalid++
+			continue
+		}
+		seen[id] = true
+		res = append(res, common.InventoryType{ID: id, GroupID: groupID})
+	}
+	return res, nil
+}
+
+func parseGroups(file *csvFile, report *importReport) ([]common.InventoryGroup, error) {
+	err := file.require("groupID", "categoryID", "groupName")
+	if err != nil {
+		return nil, err
+	}
+	res := []common.InventoryGroup{}
+	seen := make(map[uint]bool)
+	for i, row := range file.rows {
+		id, err := parseTypeID(file.field(row, "groupID", 0))
+		if err == nil && seen[id] {
+			err = fmt.Errorf("duplicate ID %d", id)
+		}
+		var categoryID uint
+		if err == nil {
+			categoryID, err = parseTypeID(file.field(row, "categoryID", 1))
+		}
+		var name string
+		if err == nil {
+			name, err = parseName(file.field(row, "groupName", 2))
+		}
+		if err != nil {
+			fmt.Printf("Skipping group row %d: %s\n", i+1, err)
+			report.invalid++
+			continue
+		}
+		seen[id] = true
+		res = append(res, common.InventoryGroup{ID: id, CategoryID: categoryID, Name: name})
+	}
+	return res, nil
+}
+
+const importBatchSize = 500
+
+// count records whether a record of the dump is new, changed or unchanged,
+// and returns whether it has to be written
+func (r *importReport) count(known bool, changed bool) bool {
+	switch {
+	case !known:
+		r.added++
+	case changed:
+		r.changed++
+	default:
+		r.unchanged++
+		return false
+	}
+	return true
+}
+
+// upsertColumns updates the given columns of the existing rows, soft-deleted
+// rows are restored
+func upsertColumns(conflict []string, columns ...string) clause.OnConflict {
+	conflictColumns := []clause.Column{}
+	for _, name := range conflict {
+		conflictColumns = append(conflictColumns, clause.Column{Name: name})
+	}
+	return clause.OnConflict{
+		Columns:   conflictColumns,
+		DoUpdates: clause.AssignmentColumns(append(columns, "updated_at", "deleted_at")),
+	}
+}
+
+// removeMissing soft-deletes the rows missing from the dump, in batches to
+// stay under the SQLite variables limit
+func removeMissing(tx *gorm.DB, model interface{}, IDs []uint, report *importReport) error {
+	for start := 0; start < len(IDs); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(IDs) {
+			end = len(IDs)
+		}
+		if err := tx.Where("id IN ?", IDs[start:end]).Delete(model).Error; err != nil {
+			return fmt.Errorf("unable to remove %s: %w", strings.ToLower(report.name), err)
+		}
+	}
+	report.removed += len(IDs)
+	return nil
+}
+
+func importSolarSystems(db *gorm.DB, solarSystems []common.SolarSystem, report *importReport) error {
+	if len(solarSystems) == 0 {
+		return fmt.Errorf("no valid solar systems found, refusing to import")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := []common.SolarSystem{}
+		if err := tx.Unscoped().Find(&existing).Error; err != nil {
+			return fmt.Errorf("unable to load solar systems: %w", err)
+		}
+		existingByID := make(map[uint]common.SolarSystem)
+		for _, solarSystem := range existing {
+			existingByID[solarSystem.ID] = solarSystem
+		}
+		upserts := []common.SolarSystem{}
+		seen := make(map[uint]bool)
+		for _, solarSystem := range solarSystems {
+			seen[solarSystem.ID] = true
+			current, ok := existingByID[solarSystem.ID]
+			if solarSystem.ConstellationID == 0 {
+				solarSystem.ConstellationID = current.ConstellationID
+			}
+			changed := current.DeletedAt.Valid || current.Name != solarSystem.Name || current.SecurityStatus != solarSystem.SecurityStatus || current.RegionID != solarSystem.RegionID || current.ConstellationID != solarSystem.ConstellationID
+			if report.count(ok, changed) {
+				upserts = append(upserts, solarSystem)
+			}
+		}
+		if len(upserts) > 0 {
+			err := tx.Clauses(upsertColumns([]string{"id"}, "name", "security_status", "region_id", "constellation_id")).CreateInBatches(&upserts, importBatchSize).Error
+			if err != nil {
+				return fmt.Errorf("unable to save solar systems: %w", err)
+			}
+		}
+		missing := []uint{}
+		for _, solarSystem := range existing {
+			if !seen[solarSystem.ID] && !solarSystem.DeletedAt.Valid {
+				missing = append(missing, solarSystem.ID)
+			}
+		}
+		return removeMissing(tx, &common.SolarSystem{}, missing, report)
+	})
+}
+
+// Mappings also hold the names resolved by the getter, only the inventory
+// types are replaced or removed
+func importInventoryTypes(db *gorm.DB, inventoryTypes []common.Mapping, report *importReport) error {
+	if len(inventoryTypes) == 0 {
+		return fmt.Errorf("no valid inventory types found, refusing to import")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := []common.Mapping{}
+		if err := tx.Unscoped().Find(&existing).Error; err != nil {
+			return fmt.Errorf("unable to load mappings: %w", err)
+		}
+		existingByID := make(map[uint]common.Mapping)
+		for _, mapping := range existing {
+			existingByID[mapping.ID] = mapping
+		}
+		upserts := []common.Mapping{}
+		seen := make(map[uint]bool)
+		for _, inventoryType := range inventoryTypes {
+			seen[inventoryType.ID] = true
+			current, ok := existingByID[inventoryType.ID]
+			// IDs the getter could not resolve are taken over by the dump
+			if ok && current.Category != inventoryTypeCategory && current.Category != common.CategoryUnknown && !current.DeletedAt.Valid {
+				fmt.Printf("Skipping inventory type %d: ID already mapped as %s %q\n", inventoryType.ID, current.Category, current.Name)
+				report.invalid++
+				continue
+			}
+			changed := current.DeletedAt.Valid || current.Name != inventoryType.Name || current.Category != inventoryType.Category
+			if !report.count(ok, changed) {
+				continue
+			}
+			// The database takes an ID of 0 as unset, the #System entry is inserted with its ID
+			if inventoryType.ID == 0 {
+				now := time.Now()
+				err := tx.Exec("INSERT INTO mappings (id, created_at, updated_at, name, category) VALUES (0, ?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET name = excluded.name, category = excluded.category, retry_after = NULL, updated_at = excluded.updated_at, deleted_at = NULL",
+					now, now, inventoryType.Name, inventoryType.Category).Error
+				if err != nil {
+					return fmt.Errorf("unable to save inventory type 0: %w", err)
+				}
+				continue
+			}
+			upserts = append(upserts, inventoryType)
+		}
+		if len(upserts) > 0 {
+			err := tx.Clauses(upsertColumns([]string{"id"}, "name", "category", "retry_after")).CreateInBatches(&upserts, importBatchSize).Error
+			if err != nil {
+				return fmt.Errorf("unable to save inventory types: %w", err)
+			}
+		}
+		missing := []uint{}
+		for _, mapping := range existing {
+			if !seen[mapping.ID] && !mapping.DeletedAt.Valid && mapping.Category == inventoryTypeCategory {
+				missing = append(missing, mapping.ID)
+			}
+		}
+		return removeMissing(tx, &common.Mapping{}, missing, report)
+	})
+}
+
+func importRegions(db *gorm.DB, regions []common.Region, report *importReport) error {
+	if len(regions) == 0 {
+		return fmt.Errorf("no valid regions found, refusing to import")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := []common.Region{}
+		if err := tx.Unscoped().Find(&existing).Error; err != nil {
+			return fmt.Errorf("unable to load regions: %w", err)
+		}
+		existingByID := make(map[uint]common.Region)
+		for _, region := range existing {
+			existingByID[region.ID] = region
+		}
+		upserts := []common.Region{}
+		seen := make(map[uint]bool)
+		for _, region := range regions {
+			seen[region.ID] = true
+			current, ok := existingByID[region.ID]
+			if report.count(ok, current.DeletedAt.Valid || current.Name != region.Name) {
+				upserts = append(upserts, region)
+			}
+		}
+		if len(upserts) > 0 {
+			err := tx.Clauses(upsertColumns([]string{"id"}, "name")).CreateInBatches(&upserts, importBatchSize).Error
+			if err != nil {
+				return fmt.Errorf("unable to save regions: %w", err)
+			}
+		}
+		missing := []uint{}
+		for _, region := range existing {
+			if !seen[region.ID] && !region.DeletedAt.Valid {
+				missing = append(missing, region.ID)
+			}
+		}
+		return removeMissing(tx, &common.Region{}, missing, report)
+	})
+}
+
+func importConstellations(db *gorm.DB, constellations []common.Constellation, report *importReport) error {
+	if len(constellations) == 0 {
+		return fmt.Errorf("no valid constellations found, refusing to import")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := []common.Constellation{}
+		if err := tx.Unscoped().Find(&existing).Error; err != nil {
+			return fmt.Errorf("unable to load constellations: %w", err)
+		}
+		existingByID := make(map[uint]common.Constellation)
+		for _, constellation := range existing {
+			existingByID[constellation.ID] = constellation
+		}
+		upserts := []common.Constellation{}
+		seen := make(map[uint]bool)
+		for _, constellation := range constellations {
+			seen[constellation.ID] = true
+			current, ok := existingByID[constellation.ID]
+			changed := current.DeletedAt.Valid || current.Name != constellation.Name || current.RegionID != constellation.RegionID
+			if report.count(ok, changed) {
+				upserts = append(upserts, constellation)
+			}
+		}
+		if len(upserts) > 0 {
+			err := tx.Clauses(upsertColumns([]string{"id"}, "name", "region_id")).CreateInBatches(&upserts, importBatchSize).Error
+			if err != nil {
+				return fmt.Errorf("unable to save constellations: %w", err)
+			}
+		}
+		missing := []uint{}
+		for _, constellation := range existing {
+			if !seen[constellation.ID] && !constellation.DeletedAt.Valid {
+				missing = append(missing, constellation.ID)
+			}
+		}
+		return removeMissing(tx, &common.Constellation{}, missing, report)
+	})
+}
+
+// Jumps are matched on their systems, their own IDs are generated
+func importJumps(db *gorm.DB, jumps []common.SolarSystemJump, report *importReport) error {
+	if len(jumps) == 0 {
+		return fmt.Errorf("no valid jumps found, refusing to import")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := []common.SolarSystemJump{}
+		if err := tx.Unscoped().Find(&existing).Error; err != nil {
+			return fmt.Errorf("unable to load jumps: %w", err)
+		}
+		existingByKey := make(map[jumpKey]common.SolarSystemJump)
+		for _, jump := range existing {
+			existingByKey[jumpKey{jump.FromSolarSystemID, jump.ToSolarSystemID}] = jump
+		}
+		upserts := []common.SolarSystemJump{}
+		seen := make(map[jumpKey]bool)
+		for _, jump := range jumps {
+			key := jumpKey{jump.FromSolarSystemID, jump.ToSolarSystemID}
+			seen[key] = true
+			current, ok := existingByKey[key]
+			if report.count(ok, current.DeletedAt.Valid) {
+				upserts = append(upserts, jump)
+			}
+		}
+		if len(upserts) > 0 {
+			err := tx.Clauses(upsertColumns([]string{"from_solar_system_id", "to_solar_system_id"})).CreateInBatches(&upserts, importBatchSize).Error
+			if err != nil {
+				return fmt.Errorf("unable to save jumps: %w", err)
+			}
+		}
+		missing := []uint{}
+		for _, jump := range existing {
+			if !seen[jumpKey{jump.FromSolarSystemID, jump.ToSolarSystemID}] && !jump.DeletedAt.Valid {
+				missing = append(missing, jump.ID)
+			}
+		}
+		return removeMissing(tx, &common.SolarSystemJump{}, missing, report)
+	})
+}
+
+func importTypeGroups(db *gorm.DB, inventoryTypes []common.InventoryType, report *importReport) error {
+	if len(inventoryTypes) == 0 {
+		return fmt.Errorf("no valid inventory type groups found, refusing to import")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := []common.InventoryType{}
+		if err := tx.Unscoped().Find(&existing).Error; err != nil {
+			return fmt.Errorf("unable to load inventory types: %w", err)
+		}
+		existingByID := make(map[uint]common.InventoryType)
+		for _, inventoryType := range existing {
+			existingByID[inventoryType.ID] = inventoryType
+		}
+		upserts := []common.InventoryType{}
+		seen := make(map[uint]bool)
+		for _, inventoryType := range inventoryTypes {
+			seen[inventoryType.ID] = true
+			current, ok := existingByID[inventoryType.ID]
+			if !report.count(ok, current.DeletedAt.Valid || current.GroupID != inventoryType.GroupID) {
+				continue
+			}
+			// The database takes an ID of 0 as unset, the #System entry is inserted with its ID
+			if inventoryType.ID == 0 {
+				now := time.Now()
+				err := tx.Exec("INSERT INTO inventory_types (id, created_at, updated_at, group_id) VALUES (0, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET group_id = excluded.group_id, updated_at = excluded.updated_at, deleted_at = NULL",
+					now, now, inventoryType.GroupID).Error
+				if err != nil {
+					return fmt.Errorf("unable to save inventory type group 0: %w", err)
+				}
+				continue
+			}
+			upserts = append(upserts, inventoryType)
+		}
+		if len(upserts) > 0 {
+			err := tx.Clauses(upsertColumns([]string{"id"}, "group_id")).CreateInBatches(&upserts, importBatchSize).Error
+			if err != nil {
+				return fmt.Errorf("unable to save inventory type groups: %w", err)
+			}
+		}
+		missing := []uint{}
+		for _, inventoryType := range existing {
+			if !seen[inventoryType.ID] && !inventoryType.DeletedAt.Valid {
+				missing = append(missing, inventoryType.ID)
+			}
+		}
+		return removeMissing(tx, &common.InventoryType{}, missing, report)
+	})
+}
+
+func importGroups(db *gorm.DB, groups []common.InventoryGroup, report *importReport) error {
+	if len(groups) == 0 {
+		return fmt.Errorf("no valid groups found, refusing to import")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := []common.InventoryGroup{}
+		if err := tx.Unscoped().Find(&existing).Error; err != nil {
+			return fmt.Errorf("unable to load groups: %w", err)
+		}
+		existingByID := make(map[uint]common.InventoryGroup)
+		for _, group := range existing {
+			existingByID[group.ID] = group
+		}
+		upserts := []common.InventoryGroup{}
+		seen := make(map[uint]bool)
+		for _, group := range groups {
+			seen[group.ID] = true
+			current, ok := existingByID[group.ID]
+			if !report.count(ok, current.DeletedAt.Valid || current.Name != group.Name || current.CategoryID != group.CategoryID) {
+				continue
+			}
+			// The database takes an ID of 0 as unset, the #System entry is inserted with its ID
+			if group.ID == 0 {
+				now := time.Now()
+				err := tx.Exec("INSERT INTO inventory_groups (id, created_at, updated_at, category_id, name) VALUES (0, ?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET category_id = excluded.category_id, name = excluded.name, updated_at = excluded.updated_at, deleted_at = NULL",
+					now, now, group.CategoryID, group.Name).Error
+				if err != nil {
+					return fmt.Errorf("unable to save group 0: %w", err)
+				}
+				continue
+			}
+			upserts = append(upserts, group)
+		}
+		if len(upserts) > 0 {
+			err := tx.Clauses(upsertColumns([]string{"id"}, "name", "category_id")).CreateInBatches(&upserts, importBatchSize).Error
+			if err != nil {
+				return fmt.Errorf("unable to save groups: %w", err)
+			}
+		}
+		missing := []uint{}
+		for _, group := range existing {
+			if !seen[group.ID] && !group.DeletedAt.Valid {
+				missing = append(missing, group.ID)
+			}
+		}
+		return removeMissing(tx, &common.InventoryGroup{}, missing, report)
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&common.Mapping{}, &common.SolarSystem{}, &common.Region{}, &common.Constellation{}, &common.SolarSystemJump{}, &common.InventoryType{}, &common.InventoryGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestImportInventoryTypesIdempotent(t *testing.T) {
+	db := newTestDB(t)
+	db.Create(&common.Mapping{ID: 98000001, Name: "Home Corp", Category: "corporation"})
+	types := []common.Mapping{
+		{ID: 0, Name: "#System", Category: inventoryTypeCategory},
+		{ID: 587, Name: "Rifter", Category: inventoryTypeCategory},
+		{ID: 620, Name: "Thorax", Category: inventoryTypeCategory},
+		{ID: 98000001, Name: "Clash", Category: inventoryTypeCategory},
+	}
+	report := importReport{}
+	if err := importInventoryTypes(db, types, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.added != 3 || report.invalid != 1 {
+		t.Errorf("first import: %s", report)
+	}
+	system := common.Mapping{}
+	if err := db.First(&system, "id = 0").Error; err != nil || system.Name != "#System" {
+		t.Errorf("#System stored as %+v: %v", system, err)
+	}
+
+	report = importReport{}
+	if err := importInventoryTypes(db, types, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.added != 0 || report.changed != 0 || report.removed != 0 || report.unchanged != 3 {
+		t.Errorf("second import: %s", report)
+	}
+	var count int64
+	db.Model(&common.Mapping{}).Count(&count)
+	if count != 4 {
+		t.Errorf("%d mappings after a re-import, want 4", count)
+	}
+
+	// Types missing from the dump are soft-deleted, and restored if they come back
+	report = importReport{}
+	if err := importInventoryTypes(db, []common.Mapping{types[0], {ID: 587, Name: "Rifter II", Category: inventoryTypeCategory}}, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.changed != 1 || report.removed != 1 || report.unchanged != 1 {
+		t.Errorf("third import: %s", report)
+	}
+	if err := db.First(&common.Mapping{}, 620).Error; err == nil {
+		t.Error("a type missing from the dump was kept")
+	}
+	if err := db.First(&common.Mapping{}, 98000001).Error; err != nil {
+		t.Errorf("the corporation mapping was removed: %s", err)
+	}
+	report = importReport{}
+	if err := importInventoryTypes(db, types, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.changed != 2 || report.unchanged != 1 {
+		t.Errorf("fourth import: %s", report)
+	}
+	if err := db.First(&common.Mapping{}, 620).Error; err != nil {
+		t.Errorf("the type back in the dump was not restored: %s", err)
+	}
+}
+
+func TestImportInventoryTypesReplacesUnknownIDs(t *testing.T) {
+	db := newTestDB(t)
+	retryAfter := time.Now().Add(time.Hour)
+	db.Create(&common.Mapping{ID: 670, Category: common.CategoryUnknown, RetryAfter: &retryAfter})
+	report := importReport{}
+	if err := importInventoryTypes(db, []common.Mapping{{ID: 670, Name: "Capsule", Category: inventoryTypeCategory}}, &report); err != nil {
+		t.Fatal(err)
+	}
+	mapping := common.Mapping{}
+	db.First(&mapping, 670)
+	if report.changed != 1 || mapping.Name != "Capsule" || mapping.Category != inventoryTypeCategory || mapping.RetryAfter != nil {
+		t.Errorf("%s, stored %+v", report, mapping)
+	}
+}
+
+func TestImportSolarSystemsKeepsConstellation(t *testing.T) {
+	db := newTestDB(t)
+	report := importReport{}
+	raw := []common.SolarSystem{{ID: 30000142, Name: "Jita", SecurityStatus: 0.9459, RegionID: 10000002, ConstellationID: 20000020}}
+	if err := importSolarSystems(db, raw, &report); err != nil {
+		t.Fatal(err)
+	}
+	// Filtered files carry no constellation
+	report = importReport{}
+	filtered := []common.SolarSystem{{ID: 30000142, Name: "Jita", SecurityStatus: 0.9459, RegionID: 10000002}}
+	if err := importSolarSystems(db, filtered, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.unchanged != 1 {
+		t.Errorf("filtered import: %s", report)
+	}
+	solarSystem := common.SolarSystem{}
+	db.First(&solarSystem, 30000142)
+	if solarSystem.ConstellationID != 20000020 {
+		t.Errorf("constellation %d, want 20000020", solarSystem.ConstellationID)
+	}
+}
+
+func TestImportJumpsAndGroupsIdempotent(t *testing.T) {
+	db := newTestDB(t)
+	jumps := []common.SolarSystemJump{{FromSolarSystemID: 30000142, ToSolarSystemID: 30000144}, {FromSolarSystemID: 30000144, ToSolarSystemID: 30000142}}
+	groups := []common.InventoryGroup{{ID: 0, CategoryID: 0, Name: "#System"}, {ID: 25, CategoryID: 6, Name: "Frigate"}}
+	typeGroups := []common.InventoryType{{ID: 0, GroupID: 0}, {ID: 587, GroupID: 25}}
+	for i := 0; i < 2; i++ {
+		jumpsReport, groupsReport, typesReport := importReport{}, importReport{}, importReport{}
+		if err := importJumps(db, jumps, &jumpsReport); err != nil {
+			t.Fatal(err)
+		}
+		if err := importGroups(db, groups, &groupsReport); err != nil {
+			t.Fatal(err)
+		}
+		if err := importTypeGroups(db, typeGroups, &typesReport); err != nil {
+			t.Fatal(err)
+		}
+		want := 2
+		if i == 0 {
+			want = 0
+		}
+		for _, report := range []importReport{jumpsReport, groupsReport, typesReport} {
+			if report.unchanged != want || report.added != 2-want || report.changed != 0 || report.removed != 0 {
+				t.Errorf("import %d: %s", i+1, report)
+			}
+		}
+	}
+	var jumpsCount, groupsCount, typesCount int64
+	db.Model(&common.SolarSystemJump{}).Count(&jumpsCount)
+	db.Model(&common.InventoryGroup{}).Count(&groupsCount)
+	db.Model(&common.InventoryType{}).Where("id = 0").Count(&typesCount)
+	if jumpsCount != 2 || groupsCount != 2 || typesCount != 1 {
+		t.Errorf("%d jumps, %d groups, %d #System types after a re-import", jumpsCount, groupsCount, typesCount)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func main() {
+	dbPath := flag.String("db", "test.db", "SQLite database to import into")
+	regionsPath := flag.String("regions", "", "mapRegions CSV (filtered or raw fuzzwork dump), empty to skip")
+	constellationsPath := flag.String("constellations", "", "mapConstellations CSV (filtered or raw fuzzwork dump), empty to skip")
+	systemsPath := flag.String("systems", "../static/mapSolarSystemsfiltered.csv", "mapSolarSystems CSV (filtered or raw fuzzwork dump), empty to skip")
+	typesPath := flag.String("types", "../static/invTypesfiltered.csv", "invTypes CSV (filtered or raw fuzzwork dump), empty to skip")
+	groupsPath := flag.String("groups", "", "invGroups CSV (raw fuzzwork dump or same columns without header), empty to skip")
+	jumpsPath := flag.String("jumps", "", "mapSolarSystemJumps CSV (raw fuzzwork dump or same columns without header), empty to skip")
+	flag.Parse()
+
+	db, err := gorm.Open(sqlite.Open(*dbPath), &gorm.Config{})
+	if err != nil {
+		panic(err)
+	}
+	db.AutoMigrate(&common.Mapping{}, &common.SolarSystem{}, &common.Region{}, &common.Constellation{}, &common.SolarSystemJump{}, &common.InventoryType{}, &common.InventoryGroup{})
+
+	reports := []importReport{}
+	if *regionsPath != "" {
+		report, err := runRegions(db, *regionsPath)
+		if err != nil {
+			fmt.Println("ERROR importing regions:", err)
+			os.Exit(1)
+		}
+		reports = append(reports, report)
+	}
+	if *constellationsPath != "" {
+		report, err := runConstellations(db, *constellationsPath)
+		if err != nil {
+			fmt.Println("ERROR importing constellations:", err)
+			os.Exit(1)
+		}
+		reports = append(reports, report)
+	}
+	if *systemsPath != "" {
+		report, err := runSolarSystems(db, *systemsPath)
+		if err != nil {
+			fmt.Println("ERROR importing solar systems:", err)
+			os.Exit(1)
+		}
+		reports = append(reports, report)
+	}
+	if *typesPath != "" {
+		typeReports, err := runInventoryTypes(db, *typesPath)
+		if err != nil {
+			fmt.Println("ERROR importing inventory types:", err)
+			os.Exit(1)
+		}
+		reports = append(reports, typeReports...)
+	}
+	if *groupsPath != "" {
+		report, err := runGroups(db, *groupsPath)
+		if err != nil {
+			fmt.Println("ERROR importing groups:", err)
+			os.Exit(1)
+		}
+		reports = append(reports, report)
+	}
+	if *jumpsPath != "" {
+		report, err := runJumps(db, *jumpsPath)
+		if err != nil {
+			fmt.Println("ERROR importing jumps:", err)
+			os.Exit(1)
+		}
+		reports = append(reports, report)
+	}
+	for _, report := range reports {
+		fmt.Println(report)
+	}
+}
+
+func runRegions(db *gorm.DB, path string) (importReport, error) {
+	report := importReport{name: "Regions"}
+	file, err := readCSV(path)
+	if err != nil {
+		return report, err
+	}
+	regions, err := parseRegions(file, &report)
+	if err != nil {
+		return report, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	err = importRegions(db, regions, &report)
+	return report, err
+}
+
+func runConstellations(db *gorm.DB, path string) (importReport, error) {
+	report := importReport{name: "Constellations"}
+	file, err := readCSV(path)
+	if err != nil {
+		return report, err
+	}
+	constellations, err := parseConstellations(file, &report)
+	if err != nil {
+		return report, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	err = importConstellations(db, constellations, &report)
+	return report, err
+}
+
+func runSolarSystems(db *gorm.DB, path string) (importReport, error) {
+	report := importReport{name: "Solar systems"}
+	file, err := readCSV(path)
+	if err != nil {
+		return report, err
+	}
+	solarSystems, err := parseSolarSystems(file, &report)
+	if err != nil {
+		return report, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	err = importSolarSystems(db, solarSystems, &report)
+	return report, err
+}
+
+// The groups of the types are imported as well from raw dumps
+func runInventoryTypes(db *gorm.DB, path string) ([]importReport, error) {
+	report := importReport{name: "Inventory types"}
+	file, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	inventoryTypes, err := parseInventoryTypes(file, &report)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	err = importInventoryTypes(db, inventoryTypes, &report)
+	if err != nil || !file.raw() {
+		return []importReport{report}, err
+	}
+	groupsReport := importReport{name: "Inventory type groups"}
+	typeGroups, err := parseTypeGroups(file, &groupsReport)
+	if err != nil {
+		return []importReport{report}, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	err = importTypeGroups(db, typeGroups, &groupsReport)
+	return []importReport{report, groupsReport}, err
+}
+
+func runGroups(db *gorm.DB, path string) (importReport, error) {
+	report := importReport{name: "Groups"}
+	file, err := readCSV(path)
+	if err != nil {
+		return report, err
+	}
+	groups, err := parseGroups(file, &report)
+	if err != nil {
+		return report, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	err = importGroups(db, groups, &report)
+	return report, err
+}
+
+func runJumps(db *gorm.DB, path string) (importReport, error) {
+	report := importReport{name: "Jumps"}
+	file, err := readCSV(path)
+	if err != nil {
+		return report, err
+	}
+	jumps, err := parseJumps(file, &report)
+	if err != nil {
+		return report, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	err = importJumps(db, jumps, &report)
+	return report, err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Pragmatic-Kernel/EveGonline/common"
+	"gorm.io/gorm"
+)
+
+func listTokens(db *gorm.DB, out io.Writer) error {
+	tokens := []common.Token{}
+	err := db.Order("char_name, char_id").Find(&tokens).Error
+	if err != nil {
+		return fmt.Errorf("unable to load tokens: %w", err)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCHARACTER\tCHAR ID\tCORP ID\tSTATUS\tFAILURES\tLAST REFRESH\tLAST FAILURE\tLAST ERROR")
+	for _, token := range tokens {
+		status := token.Status
+		if status == "" {
+			status = "unknown"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%d\t%s\t%s\t%s\n", token.ID, token.CharName, token.CharID, token.CorpID, status, token.FailureCount, formatTime(token.LastRefreshAt), formatTime(token.LastFailureAt), token.LastError)
+	}
+	return w.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
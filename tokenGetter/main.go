@@ -2,14 +2,12 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/Pragmatic-Kernel/EveGonline/common"
@@ -21,115 +19,182 @@ var ClientId string
 var SecretKey string
 var CallbackUri string
 
-func getCharID(charID string) (uint, error) {
-	segments := strings.Split(charID, ":")
-	if len(segments) < 3 {
-		errMsg := fmt.Sprintf("unable to extract CharID from %s", charID)
-		return 0, errors.New(errMsg)
-	}
-	charIDint, err := strconv.Atoi(segments[2])
-	if err != nil {
-		return 0, err
-	}
-	return uint(charIDint), nil
+// SSO endpoints, overridable to stand in a fake SSO
+var AuthorizeUrl string
+var TokenUrl string
 
+func getEnv(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
 }
 
 func main() {
+	list := flag.Bool("list", false, "list the registered tokens and their health, then exit")
+	flag.Parse()
 	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
 	if err != nil {
 		panic(err)
 	}
-	db.AutoMigrate(&common.Token{})
+	if err := common.MigrateTokens(db); err != nil {
+		panic(err)
+	}
+	if *list {
+		err := listTokens(db, os.Stdout)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	ClientId = os.Getenv("CLIENT_ID")
 	SecretKey = os.Getenv("SECRET_KEY")
 	CallbackUri = os.Getenv("CALLBACK_URI")
+	AuthorizeUrl = getEnv("SSO_AUTHORIZE_URL", common.EveApiAuthorizeUrl)
+	TokenUrl = getEnv("SSO_TOKEN_URL", common.EveApiTokenUrl)
+	states := newLoginStates()
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/login", func(w http.ResponseWriter, _ *http.Request) {
+	mux.HandleFunc("/login", handleLogin(states))
+	mux.HandleFunc("/callback", handleCallback(db, states))
+	s := &http.Server{
+		Addr:    ":4200",
+		Handler: mux,
+	}
+	s.ListenAndServe()
+}
+
+func handleLogin(states *loginStates) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		state, challenge, err := states.add()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			writeFailure(w, http.StatusInternalServerError, "Unable to start the login, please try again.")
+			return
+		}
 		params := url.Values{}
 		params.Add("response_type", "code")
 		params.Add("redirect_uri", CallbackUri)
 		params.Add("client_id", ClientId)
-		params.Add("state", randomString(16))
-		location := common.EveApiAuthorizeUrl + "?" + params.Encode()
+		params.Add("state", state)
+		params.Add("code_challenge", challenge)
+		params.Add("code_challenge_method", "S256")
+		location := AuthorizeUrl + "?" + params.Encode()
 		//FIXME hardcoded scopes
-		location += "&scope=esi-killmails.read_killmails.v1%20esi-killmails.read_corporation_killmails.v1"
+		location += "&scope=esi-killmails.read_killmails.v1%20esi-killmails.read_corporation_killmails.v1%20esi-characters.read_corporation_roles.v1"
 		fmt.Println(location)
 		w.Header().Add("Location", location)
-		w.WriteHeader(301)
+		w.WriteHeader(http.StatusFound)
 		w.Write([]byte{})
-	})
-	mux.HandleFunc("/callback", func(_ http.ResponseWriter, r *http.Request) {
-		codes, ok := r.URL.Query()["code"]
-		if !ok {
-			fmt.Println("ERROR: no code found in URL")
-			return
-		}
-		code := codes[0]
-		params := url.Values{}
-		params.Add("grant_type", "authorization_code")
-		params.Add("code", code)
-		req, err := http.NewRequest("POST", common.EveApiTokenUrl, strings.NewReader(params.Encode()))
-		if err != nil {
-			fmt.Println("ERROR:", err)
+	}
+}
+
+func handleCallback(db *gorm.DB, states *loginStates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		// A refused login uses up its state too
+		verifier, err := states.take(query.Get("state"))
+		if ssoErr := query.Get("error"); ssoErr != "" {
+			fmt.Println("ERROR: SSO returned", ssoErr)
+			writeFailure(w, http.StatusBadRequest, fmt.Sprintf("EVE SSO refused the login: %s %s", ssoErr, query.Get("error_description")))
 			return
 		}
-		req.Header.Add("Host", "login.eveonline.com")
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-		req.SetBasicAuth(ClientId, SecretKey)
-		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			fmt.Println("ERROR:", err)
+			writeFailure(w, http.StatusBadRequest, fmt.Sprintf("Invalid login: %s.", err))
 			return
 		}
-		pretoken := common.PreToken{}
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println("ERROR:", err)
+		code := query.Get("code")
+		if code == "" {
+			fmt.Println("ERROR: no code found in URL")
+			writeFailure(w, http.StatusBadRequest, "Invalid login: no authorization code.")
 			return
 		}
-		err = json.Unmarshal(body, &pretoken)
+		pretoken, err := getPreToken(code, verifier)
 		if err != nil {
 			fmt.Println("ERROR:", err)
+			writeFailure(w, http.StatusBadGateway, fmt.Sprintf("Unable to get a token from EVE SSO: %s.", err))
 			return
 		}
-		fmt.Println(pretoken.AccessToken)
-		fmt.Println(pretoken.RefreshToken)
-		payload, err := common.GetTokenPayload(pretoken.AccessToken)
+		payload, err := common.GetTokenPayload(pretoken.AccessToken, ClientId)
 		if err != nil {
 			fmt.Println("ERROR:", err)
+			writeFailure(w, http.StatusBadGateway, fmt.Sprintf("Invalid token from EVE SSO: %s.", err))
 			return
 		}
-		charID, err := getCharID(payload.Sub)
+		charID, err := payload.CharacterID()
 		if err != nil {
 			fmt.Println("ERROR:", err)
+			writeFailure(w, http.StatusBadGateway, fmt.Sprintf("Invalid token from EVE SSO: %s.", err))
 			return
 		}
+		// Logging in again updates the token of the character
 		token := common.Token{}
+		db.Where("char_id = ?", charID).Find(&token)
+		added := token.ID == 0
 		token.AccessToken = pretoken.AccessToken
 		token.RefreshToken = pretoken.RefreshToken
 		token.Exp = payload.Exp
-		result := db.Create(&token)
+		token.CharID = charID
+		token.CharName = payload.Name
+		token.Scopes = strings.Join(payload.Scp, " ")
+		token.Owner = payload.Owner
+		token.RecordRefresh(nil)
+		character, err := common.GetCharacter(charID)
+		if err != nil {
+			fmt.Println("ERROR: keeping corporation", token.CorpID, "of charID", charID, err)
+		} else {
+			token.CorpID = character.CorporationID
+		}
+		result := db.Save(&token)
 		if result.Error != nil {
-			fmt.Println("ERROR:", err)
+			fmt.Println("ERROR:", result.Error)
+			writeFailure(w, http.StatusInternalServerError, "Unable to save the token, please try again.")
 			return
 		}
-		fmt.Printf("Added Token for charID %d", charID)
-	})
-	s := &http.Server{
-		Addr:    ":4200",
-		Handler: mux,
+		if added {
+			fmt.Printf("Added Token for charID %d\n", charID)
+		} else {
+			fmt.Printf("Updated Token for charID %d\n", charID)
+		}
+		writeResult(w, http.StatusOK, pageResult{Title: "Login successful", Message: fmt.Sprintf("Killmails of %s will now be retrieved. You can close this page.", payload.Name)})
 	}
-	s.ListenAndServe()
 }
 
-func randomString(n int) string {
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-
-	s := make([]rune, n)
-	for i := range s {
-		s[i] = letters[rand.Intn(len(letters))]
+func getPreToken(code string, verifier string) (*common.PreToken, error) {
+	params := url.Values{}
+	params.Add("grant_type", "authorization_code")
+	params.Add("code", code)
+	params.Add("code_verifier", verifier)
+	req, err := http.NewRequest("POST", TokenUrl, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(ClientId, SecretKey)
+	// Codes can only be used once, a retried POST would fail anyway
+	req.Header.Set("User-Agent", common.ESI.UserAgent)
+	resp, err := common.ESI.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		ssoErr := common.SSOError{}
+		if json.Unmarshal(body, &ssoErr) == nil && ssoErr.Error != "" {
+			return nil, fmt.Errorf("%s (%s)", ssoErr.Error, ssoErr.ErrorDescription)
+		}
+		return nil, fmt.Errorf("invalid Status Code: %d", resp.StatusCode)
+	}
+	pretoken := common.PreToken{}
+	err = json.Unmarshal(body, &pretoken)
+	if err != nil {
+		return nil, err
 	}
-	return string(s)
+	return &pretoken, nil
 }
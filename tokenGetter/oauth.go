@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const loginStateExpiry = 10 * time.Minute
+
+var ErrUnknownState = errors.New("unknown or already used login state")
+var ErrExpiredState = errors.New("login state expired")
+
+// loginState is kept between /login and /callback, it holds the PKCE
+// verifier of the login.
+type loginState struct {
+	verifier string
+	expires  time.Time
+}
+
+type loginStates struct {
+	lock   sync.Mutex
+	states map[string]loginState
+}
+
+func newLoginStates() *loginStates {
+	return &loginStates{states: make(map[string]loginState)}
+}
+
+// add returns a new state and the PKCE challenge of its verifier
+func (s *loginStates) add() (string, string, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, value := range s.states {
+		if now.After(value.expires) {
+			delete(s.states, key)
+		}
+	}
+	s.states[state] = loginState{verifier: verifier, expires: now.Add(loginStateExpiry)}
+	return state, getCodeChallenge(verifier), nil
+}
+
+// take returns the verifier of a state, which can only be used once
+func (s *loginStates) take(state string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, ok := s.states[state]
+	if !ok {
+		return "", ErrUnknownState
+	}
+	delete(s.states, state)
+	if time.Now().After(value.expires) {
+		return "", ErrExpiredState
+	}
+	return value.verifier, nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate random string: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// PKCE S256 challenge
+func getCodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+var resultPage = template.Must(template.New("result").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>EveGonline - {{.Title}}</title></head>
+<body style="font-family: sans-serif; margin: 3em;">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Retry}}<p><a href="/login">Log in again</a></p>{{end}}
+</body>
+</html>
+`))
+
+type pageResult struct {
+	Title   string
+	Message string
+	Retry   bool
+}
+
+func writeResult(w http.ResponseWriter, status int, res pageResult) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := resultPage.Execute(w, res); err != nil {
+		fmt.Println("ERROR:", err)
+	}
+}
+
+func writeFailure(w http.ResponseWriter, status int, message string) {
+	writeResult(w, status, pageResult{Title: "Login failed", Message: message, Retry: true})
+}
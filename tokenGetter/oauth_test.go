@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginStates(t *testing.T) {
+	states := newLoginStates()
+	state, challenge, err := states.add()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := states.take("unknown"); err != ErrUnknownState {
+		t.Errorf("unknown state: got %v, want %v", err, ErrUnknownState)
+	}
+	verifier, err := states.take(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getCodeChallenge(verifier) != challenge {
+		t.Error("the challenge is not the one of the verifier")
+	}
+	if _, err := states.take(state); err != ErrUnknownState {
+		t.Errorf("reused state: got %v, want %v", err, ErrUnknownState)
+	}
+
+	state, _, err = states.add()
+	if err != nil {
+		t.Fatal(err)
+	}
+	states.lock.Lock()
+	value := states.states[state]
+	value.expires = time.Now().Add(-time.Second)
+	states.states[state] = value
+	states.lock.Unlock()
+	if _, err := states.take(state); err != ErrExpiredState {
+		t.Errorf("expired state: got %v, want %v", err, ErrExpiredState)
+	}
+	if _, err := states.take(state); err != ErrUnknownState {
+		t.Errorf("expired state used again: got %v, want %v", err, ErrUnknownState)
+	}
+}
+
+// login goes through /login and returns the state and challenge sent to the SSO
+func login(t *testing.T, states *loginStates) (string, string) {
+	rec := httptest.NewRecorder()
+	handleLogin(states)(rec, httptest.NewRequest("GET", "/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status %d, want %d", rec.Code, http.StatusFound)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Errorf("code_challenge_method = %q", query.Get("code_challenge_method"))
+	}
+	return query.Get("state"), query.Get("code_challenge")
+}
+
+func callback(states *loginStates, query string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleCallback(nil, states)(rec, httptest.NewRequest("GET", "/callback?"+query, nil))
+	return rec
+}
+
+func TestCallbackInvalidState(t *testing.T) {
+	states := newLoginStates()
+	rec := callback(states, "code=abc&state=unknown")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), ErrUnknownState.Error()) {
+		t.Errorf("unknown state: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// A login refused by the SSO cannot be replayed with its state
+	state, _ := login(t, states)
+	rec = callback(states, "error=access_denied&error_description=denied&state="+state)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "EVE SSO refused the login: access_denied denied") {
+		t.Errorf("refused login: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = callback(states, "code=abc&state="+state)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), ErrUnknownState.Error()) {
+		t.Errorf("state of a refused login: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCallbackTokenError(t *testing.T) {
+	states := newLoginStates()
+	state, challenge := login(t, states)
+
+	posts := 0
+	sso := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		clientID, secret, ok := r.BasicAuth()
+		if !ok || clientID != "client" || secret != "secret" {
+			t.Errorf("basic auth %q:%q", clientID, secret)
+		}
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != "abc" {
+			t.Errorf("form %v", r.PostForm)
+		}
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			t.Error("the code_verifier does not match the code_challenge")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"temporarily_unavailable","error_description":"SSO <down>"}`))
+	}))
+	defer sso.Close()
+	ClientId, SecretKey, TokenUrl = "client", "secret", sso.URL
+	defer func() { ClientId, SecretKey, TokenUrl = "", "", "" }()
+
+	rec := callback(states, "code=abc&state="+state)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "Login failed") || !strings.Contains(body, "temporarily_unavailable (SSO &lt;down&gt;)") {
+		t.Errorf("failure page: %s", body)
+	}
+	if posts != 1 {
+		t.Errorf("%d token requests, want 1 without retries", posts)
+	}
+}